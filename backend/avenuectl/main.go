@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
+	"log"
+	"time"
+
 	"avenue/backend/handlers"
 	"avenue/backend/persist"
 	"avenue/backend/shared"
+	"avenue/backend/storage"
 )
 
 func main() {
@@ -16,11 +21,42 @@ func main() {
 
 	_ = persist.UpsertRootUser()
 
-	server := handlers.SetupServer(persist)
+	blobs, err := storage.NewFromEnv()
+	if err != nil {
+		log.Fatalf("could not set up storage: %v", err)
+	}
 
-	handlers.Sessions = make(map[string]handlers.SessionData, 0)
+	server := handlers.SetupServer(persist, persist.SessionStore(), blobs)
 	server.SetupRoutes()
 
+	if err := server.MigrateLegacyBlobs(); err != nil {
+		log.Fatalf("could not migrate file content: %v", err)
+	}
+	go func() {
+		if err := server.IndexMissingContent(); err != nil {
+			log.Printf("could not index file content: %v", err)
+		}
+	}()
+
+	go server.ReapSessions(context.Background(), shared.GetEnvDuration("SESSION_REAP_INTERVAL", 10*time.Minute))
+	go server.CollectBlobs(context.Background(), shared.GetEnvDuration("BLOB_GC_INTERVAL", time.Hour))
+	go server.RunThumbnails(context.Background(), shared.GetEnvDuration("THUMBNAIL_INTERVAL", time.Minute))
+	go server.JanitorTrash(context.Background(), shared.GetEnvDuration("TRASH_JANITOR_INTERVAL", time.Hour), handlers.TRASHRETENTION)
+	go server.JanitorUploads(context.Background(), shared.GetEnvDuration("UPLOAD_JANITOR_INTERVAL", time.Hour), handlers.UPLOADTTL)
+	go server.JanitorVersions(context.Background(), shared.GetEnvDuration("VERSION_JANITOR_INTERVAL", time.Hour))
+	go server.RunEvents(context.Background(), handlers.EVENTSLISTEN, handlers.EVENTSPOLL)
+	go server.RunWebhooks(context.Background(), shared.GetEnvDuration("WEBHOOK_INTERVAL", 30*time.Second))
+	go server.JanitorWebhookDeliveries(context.Background(), shared.GetEnvDuration("WEBHOOK_JANITOR_INTERVAL", time.Hour), handlers.WEBHOOKLOGRETENTION)
+	if handlers.CHANGERETENTION > 0 {
+		go server.JanitorChanges(context.Background(), shared.GetEnvDuration("CHANGE_JANITOR_INTERVAL", time.Hour), handlers.CHANGERETENTION)
+	}
+	if handlers.S3ADDR != "" {
+		go server.JanitorMultipartUploads(context.Background(), shared.GetEnvDuration("S3_MULTIPART_JANITOR_INTERVAL", time.Hour), handlers.S3MULTIPARTTTL)
+		go func() {
+			log.Fatalf("could not serve the S3 API: %v", server.RunS3(handlers.S3ADDR))
+		}()
+	}
+
 	// Start the server
 	_ = server.Run(":8080")
 }
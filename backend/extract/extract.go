@@ -0,0 +1,73 @@
+// Package extract pulls the plain text out of documents so they can be
+// searched.
+package extract
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrUnsupported is returned for content Text can't read, trying again won't
+// help.
+var ErrUnsupported = errors.New("extract: unsupported file type")
+
+var plainText = map[string]bool{
+	"txt":      true,
+	"text":     true,
+	"md":       true,
+	"markdown": true,
+	"log":      true,
+	"csv":      true,
+}
+
+// Supported reports whether Text can read files with extension ext.
+func Supported(ext string) bool {
+	ext = strings.ToLower(ext)
+	return plainText[ext] || ext == "pdf"
+}
+
+// Extensions lists every extension Text can read.
+func Extensions() []string {
+	exts := []string{"pdf"}
+	for ext := range plainText {
+		exts = append(exts, ext)
+	}
+	return exts
+}
+
+// Text returns at most limit bytes of the text in a document with extension
+// ext, read from r.
+func Text(ext string, r io.Reader, limit int) (string, error) {
+	ext = strings.ToLower(ext)
+	switch {
+	case plainText[ext]:
+		b, err := io.ReadAll(io.LimitReader(r, int64(limit)))
+		if err != nil {
+			return "", err
+		}
+		return clean(string(b), limit), nil
+	case ext == "pdf":
+		text, err := pdfText(r, limit)
+		if err != nil {
+			return "", err
+		}
+		return clean(text, limit), nil
+	}
+	return "", ErrUnsupported
+}
+
+// clean makes s valid UTF-8 without NULs, which postgres text can't hold,
+// and cuts it to at most limit bytes on a rune boundary.
+func clean(s string, limit int) string {
+	s = strings.ToValidUTF8(s, "")
+	s = strings.ReplaceAll(s, "\x00", "")
+	if len(s) > limit {
+		s = s[:limit]
+		for len(s) > 0 && !utf8.ValidString(s) {
+			s = s[:len(s)-1]
+		}
+	}
+	return s
+}
@@ -0,0 +1,246 @@
+package extract
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// maxPDFSize is the most of a PDF that is read. Text in anything past it is
+// not found.
+const maxPDFSize = 64 << 20
+
+// maxPDFContent is the most content that is decoded from all the streams of
+// a PDF together, so small compressed streams can't each expand to the limit.
+const maxPDFContent = 64 << 20
+
+var errNotPDF = fmt.Errorf("%w: not a PDF", ErrUnsupported)
+
+// pdfText is a best effort extraction of the text shown by the content
+// streams of a PDF. It understands uncompressed and FlateDecode streams and
+// the text showing operators, which covers what most tools write with
+// simple fonts. Text in fonts with custom encodings comes out garbled or not
+// at all. It stops once it has limit bytes of text.
+func pdfText(r io.Reader, limit int) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxPDFSize))
+	if err != nil {
+		return "", err
+	}
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		return "", errNotPDF
+	}
+
+	var out strings.Builder
+	budget := int64(maxPDFContent)
+	for rest := data; out.Len() < limit && budget > 0; {
+		start := bytes.Index(rest, []byte("stream"))
+		if start < 0 {
+			break
+		}
+		dict := rest[max(0, start-1024):start]
+		if i := bytes.LastIndex(dict, []byte("<<")); i >= 0 {
+			dict = dict[i:]
+		}
+
+		body := rest[start+len("stream"):]
+		body = bytes.TrimPrefix(body, []byte("\r"))
+		body = bytes.TrimPrefix(body, []byte("\n"))
+		end := bytes.Index(body, []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		rest = body[end+len("endstream"):]
+
+		content, ok := streamContent(dict, body[:end], budget)
+		if ok {
+			budget -= int64(len(content))
+			showText(&out, content, limit)
+		}
+	}
+	return out.String(), nil
+}
+
+// streamContent decodes a stream if it might be a page's content, inflating
+// at most budget bytes.
+func streamContent(dict, raw []byte, budget int64) ([]byte, bool) {
+	for _, skip := range []string{"/Subtype/Image", "/Subtype /Image", "/Length1", "/Length2", "/XRef", "/ObjStm", "/Metadata"} {
+		if bytes.Contains(dict, []byte(skip)) {
+			return nil, false
+		}
+	}
+	if !bytes.Contains(dict, []byte("/Filter")) {
+		return raw, true
+	}
+	if !bytes.Contains(dict, []byte("/FlateDecode")) || bytes.Contains(dict, []byte("/DecodeParms")) {
+		return nil, false
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, false
+	}
+	defer zr.Close()
+	// a truncated stream still has useful text up to where it stops
+	content, _ := io.ReadAll(io.LimitReader(zr, budget))
+	return content, len(content) > 0
+}
+
+// showText writes the strings shown by the text operators in a content
+// stream to out, until out holds limit bytes.
+func showText(out *strings.Builder, content []byte, limit int) {
+	var operands []string
+	for i := 0; i < len(content) && out.Len() < limit; {
+		ch := content[i]
+		switch {
+		case ch == '(':
+			s, n := literalString(content[i:])
+			operands = append(operands, s)
+			i += n
+		case ch == '<' && i+1 < len(content) && content[i+1] != '<':
+			s, n := hexString(content[i:])
+			operands = append(operands, s)
+			i += n
+		case ch == '%':
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+		case isDelimiter(ch) || isSpace(ch):
+			i++
+		default:
+			j := i
+			for j < len(content) && !isDelimiter(content[j]) && !isSpace(content[j]) {
+				j++
+			}
+			switch string(content[i:j]) {
+			case "Tj", "TJ":
+				out.WriteString(strings.Join(operands, ""))
+			case "'", `"`:
+				out.WriteString("\n")
+				out.WriteString(strings.Join(operands, ""))
+			case "T*", "Td", "TD", "ET":
+				out.WriteString("\n")
+			}
+			if j == i {
+				j++
+			}
+			// numbers are operands too, but nothing here needs them
+			if !isNumber(content[i:j]) {
+				operands = operands[:0]
+			}
+			i = j
+		}
+	}
+}
+
+// literalString reads a (string) from the start of b, returning it and how
+// many bytes it took up.
+func literalString(b []byte) (string, int) {
+	var s []byte
+	depth := 0
+	i := 0
+	for ; i < len(b); i++ {
+		ch := b[i]
+		switch ch {
+		case '(':
+			depth++
+			if depth == 1 {
+				continue
+			}
+		case ')':
+			depth--
+			if depth == 0 {
+				return string(s), i + 1
+			}
+		case '\\':
+			i++
+			if i >= len(b) {
+				break
+			}
+			switch e := b[i]; e {
+			case 'n':
+				s = append(s, '\n')
+			case 'r':
+				s = append(s, '\r')
+			case 't':
+				s = append(s, '\t')
+			case 'b', 'f':
+			case '\r', '\n':
+				// line continuation
+			default:
+				if e >= '0' && e <= '7' {
+					v := 0
+					for k := 0; k < 3 && i < len(b) && b[i] >= '0' && b[i] <= '7'; k++ {
+						v = v*8 + int(b[i]-'0')
+						i++
+					}
+					i--
+					s = append(s, byte(v))
+				} else {
+					s = append(s, e)
+				}
+			}
+			continue
+		}
+		s = append(s, ch)
+	}
+	return string(s), i
+}
+
+// hexString reads a <hex string> from the start of b, returning it and how
+// many bytes it took up. Two byte encodings are narrowed by dropping NULs.
+func hexString(b []byte) (string, int) {
+	end := bytes.IndexByte(b, '>')
+	if end < 0 {
+		return "", len(b)
+	}
+	var digits []byte
+	for _, ch := range b[1:end] {
+		if unhex(ch) >= 0 {
+			digits = append(digits, ch)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	s := make([]byte, 0, len(digits)/2)
+	for k := 0; k < len(digits); k += 2 {
+		v := byte(unhex(digits[k])<<4 | unhex(digits[k+1]))
+		if v != 0 {
+			s = append(s, v)
+		}
+	}
+	return string(s), end + 1
+}
+
+func unhex(ch byte) int {
+	switch {
+	case ch >= '0' && ch <= '9':
+		return int(ch - '0')
+	case ch >= 'a' && ch <= 'f':
+		return int(ch-'a') + 10
+	case ch >= 'A' && ch <= 'F':
+		return int(ch-'A') + 10
+	}
+	return -1
+}
+
+func isSpace(ch byte) bool {
+	return ch == ' ' || ch == '\n' || ch == '\r' || ch == '\t' || ch == '\f' || ch == 0
+}
+
+func isDelimiter(ch byte) bool {
+	return strings.IndexByte("()<>[]{}/%", ch) >= 0
+}
+
+func isNumber(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, ch := range b {
+		if (ch < '0' || ch > '9') && ch != '.' && ch != '-' && ch != '+' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"net/http"
+
+	"avenue/backend/persist"
+
+	"github.com/gin-gonic/gin"
+)
+
+type CreateAccessKeyReq struct {
+	Name string `json:"name" validate:"required,min=1,max=100"`
+}
+
+type AccessKeyResponse struct {
+	persist.AccessKey
+	// SecretKey is only ever returned when the access key is created.
+	SecretKey string `json:"secret_access_key"`
+}
+
+// CreateAccessKey makes a new access key for signing requests to the S3
+// compatible API.
+func (s *Server) CreateAccessKey(c *gin.Context) {
+	var id string
+	defer func() {
+		s.audit(c, persist.AuditEvent{Action: "user.access_key.create", TargetType: "access_key", TargetID: id})
+	}()
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	var req CreateAccessKeyReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "could not marshal all data to json",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "invalid access key",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	k, err := s.persist.CreateAccessKey(uint(uid), req.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not create access key",
+			Error:   err.Error(),
+		})
+		return
+	}
+	id = k.ID
+
+	c.JSON(http.StatusCreated, AccessKeyResponse{AccessKey: k, SecretKey: k.SecretKey})
+}
+
+func (s *Server) ListAccessKeys(c *gin.Context) {
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	keys, err := s.persist.ListAccessKeys(uint(uid))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not list access keys",
+			Error:   err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+func (s *Server) DeleteAccessKey(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "user.access_key.delete", TargetType: "access_key", TargetID: c.Param("accessKeyID")})
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	if err := s.persist.DeleteAccessKey(uint(uid), c.Param("accessKeyID")); err != nil {
+		lookupError(c, "access key", err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
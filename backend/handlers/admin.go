@@ -0,0 +1,415 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"avenue/backend/persist"
+	"avenue/backend/shared"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IMPERSONATIONTTL is how long a session opened by an admin impersonating a
+// user lasts. Unlike normal sessions it doesn't slide.
+var IMPERSONATIONTTL = shared.GetEnvDuration("IMPERSONATION_TTL", time.Hour)
+
+// readOnlyWrites are the routes read-only users may still call with a method
+// that changes something, about their own login or only reading.
+var readOnlyWrites = map[string]bool{
+	"POST /v1/logout":                              true,
+	"PATCH /v1/user/password":                      true,
+	"DELETE /v1/user/sessions/:sessionID":          true,
+	"POST /v1/user/app-passwords":                  true,
+	"DELETE /v1/user/app-passwords/:appPasswordID": true,
+	"POST /v1/user/access-keys":                    true,
+	"DELETE /v1/user/access-keys/:accessKeyID":     true,
+	"POST /v1/events/ticket":                       true,
+}
+
+func requestRole(c *gin.Context) string {
+	role, _ := c.Request.Context().Value(shared.USERROLENAME).(string)
+	return role
+}
+
+// roleCheck stops read-only users from changing anything.
+func (s *Server) roleCheck(c *gin.Context) {
+	if requestRole(c) != persist.UserRoleReadOnly {
+		c.Next()
+		return
+	}
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		c.Next()
+		return
+	}
+	if readOnlyWrites[c.Request.Method+" "+c.FullPath()] {
+		c.Next()
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusForbidden, Response{
+		Message: "read-only users can't make changes",
+	})
+}
+
+// adminCheck only lets admins through.
+func (s *Server) adminCheck(c *gin.Context) {
+	if requestRole(c) != persist.UserRoleAdmin {
+		c.AbortWithStatusJSON(http.StatusForbidden, Response{
+			Message: "admin only",
+		})
+		return
+	}
+	c.Next()
+}
+
+// adminTarget parses :userID. Admins can't use it on themselves with
+// allowSelf false, so they can't lock themselves out. If it fails an error
+// response has already been written and ok is false.
+func adminTarget(c *gin.Context, allowSelf bool) (adminId, targetId int, ok bool) {
+	adminId, ok = requestUserId(c)
+	if !ok {
+		return 0, 0, false
+	}
+	targetId, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "user id not an int",
+			Error:   err.Error(),
+		})
+		return 0, 0, false
+	}
+	if !allowSelf && targetId == adminId {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "admins can't do this to themselves",
+		})
+		return 0, 0, false
+	}
+	return adminId, targetId, true
+}
+
+// adminPeer refuses, with 403, when target is an admin and the caller isn't
+// root, so one admin can't lock out or take over the others.
+func adminPeer(c *gin.Context, adminId int, target persist.User) bool {
+	if target.Role != persist.UserRoleAdmin || adminId == persist.RootUserID {
+		return false
+	}
+	c.JSON(http.StatusForbidden, Response{
+		Message: "only the root admin can do this to other admins",
+	})
+	return true
+}
+
+type AdminUserListResponse struct {
+	Users []persist.User `json:"users"`
+	Total int64          `json:"total"`
+}
+
+// AdminListUsers searches users by email with ?q=, paged with ?limit= and
+// ?offset=. Pass ?deleted=true to include deleted users.
+func (s *Server) AdminListUsers(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		limit = 50
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	deleted, _ := strconv.ParseBool(c.Query("deleted"))
+
+	users, total, err := s.persist.SearchUsers(c.Query("q"), deleted, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not list users",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, AdminUserListResponse{Users: users, Total: total})
+}
+
+func (s *Server) AdminGetUser(c *gin.Context) {
+	_, id, ok := adminTarget(c, true)
+	if !ok {
+		return
+	}
+	u, err := s.persist.GetAnyUserById(id)
+	if err != nil {
+		lookupError(c, "user", err)
+		return
+	}
+	c.JSON(http.StatusOK, u)
+}
+
+type AdminUpdateUserReq struct {
+	CanLogin *bool   `json:"canLogin"`
+	Role     *string `json:"role" validate:"omitempty,oneof=admin user read-only"`
+}
+
+// AdminUpdateUser enables or disables login for a user and changes their
+// role. Disabling login also ends their sessions.
+func (s *Server) AdminUpdateUser(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "admin.user.update", TargetType: "user", TargetID: c.Param("userID")})
+
+	adminId, id, ok := adminTarget(c, false)
+	if !ok {
+		return
+	}
+	var req AdminUpdateUserReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "could not marshal all data to json",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "invalid user update",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	target, err := s.persist.GetUserById(id)
+	if err != nil {
+		lookupError(c, "user", err)
+		return
+	}
+	disables := req.CanLogin != nil && !*req.CanLogin
+	demotes := req.Role != nil && *req.Role != persist.UserRoleAdmin
+	if (disables || demotes) && adminPeer(c, adminId, target) {
+		return
+	}
+
+	u, err := s.persist.UpdateUserAccess(id, req.CanLogin, req.Role)
+	if err != nil {
+		lookupError(c, "user", err)
+		return
+	}
+	if !u.CanLogin {
+		s.revokeAllSessions(u.ID)
+	}
+	s.queueUserWebhook("update", u)
+
+	c.JSON(http.StatusOK, u)
+}
+
+type AdminSetQuotaReq struct {
+	// QuotaBytes of null puts the user back on the default quota.
+	QuotaBytes *int64 `json:"quotaBytes" validate:"omitempty,min=0"`
+}
+
+func (s *Server) AdminSetQuota(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "admin.user.quota", TargetType: "user", TargetID: c.Param("userID")})
+
+	_, id, ok := adminTarget(c, true)
+	if !ok {
+		return
+	}
+	var req AdminSetQuotaReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "could not marshal all data to json",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "invalid quota",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	u, err := s.persist.SetUserQuota(id, req.QuotaBytes)
+	if err != nil {
+		lookupError(c, "user", err)
+		return
+	}
+	s.queueUserWebhook("update", u)
+
+	c.JSON(http.StatusOK, u)
+}
+
+type AdminResetPasswordReq struct {
+	Password string `json:"password" validate:"required,min=4,max=64"`
+}
+
+// AdminResetPassword sets a new password for a user and ends their sessions.
+func (s *Server) AdminResetPassword(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "admin.user.password_reset", TargetType: "user", TargetID: c.Param("userID")})
+
+	adminId, id, ok := adminTarget(c, true)
+	if !ok {
+		return
+	}
+	var req AdminResetPasswordReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "could not marshal all data to json",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "invalid password",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	u, err := s.persist.GetUserById(id)
+	if err != nil {
+		lookupError(c, "user", err)
+		return
+	}
+	if id != adminId && adminPeer(c, adminId, u) {
+		return
+	}
+	if err := s.persist.UpdatePassword(u.ID, req.Password); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not update password",
+			Error:   err.Error(),
+		})
+		return
+	}
+	s.revokeAllSessions(u.ID)
+
+	c.Status(http.StatusNoContent)
+}
+
+// AdminDeleteUser soft deletes a user, keeping their files. With
+// ?purge=true the user and everything they own is deleted for good; their
+// content is removed by the blob garbage collector.
+func (s *Server) AdminDeleteUser(c *gin.Context) {
+	action := "admin.user.delete"
+	if purge, _ := strconv.ParseBool(c.Query("purge")); purge {
+		action = "admin.user.purge"
+	}
+	defer s.audit(c, persist.AuditEvent{Action: action, TargetType: "user", TargetID: c.Param("userID")})
+
+	adminId, id, ok := adminTarget(c, false)
+	if !ok {
+		return
+	}
+	u, err := s.persist.GetAnyUserById(id)
+	if err != nil {
+		lookupError(c, "user", err)
+		return
+	}
+	if adminPeer(c, adminId, u) {
+		return
+	}
+
+	if purge, _ := strconv.ParseBool(c.Query("purge")); purge {
+		if err := s.persist.PurgeUser(id); err != nil {
+			lookupError(c, "user", err)
+			return
+		}
+		s.revokeAllSessions(uint(id))
+		// drop their unfinished resumable uploads
+		if err := s.fs.RemoveAll(fmt.Sprintf("/%d", id)); err != nil {
+			log.Printf("could not remove uploads of purged user %d: %v", id, err)
+		}
+		s.queueUserWebhook("delete", u)
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	if err := s.persist.DeleteUser(id); err != nil {
+		lookupError(c, "user", err)
+		return
+	}
+	s.revokeAllSessions(uint(id))
+	s.queueUserWebhook("delete", u)
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) AdminRestoreUser(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "admin.user.restore", TargetType: "user", TargetID: c.Param("userID")})
+
+	_, id, ok := adminTarget(c, true)
+	if !ok {
+		return
+	}
+	u, err := s.persist.RestoreUser(id)
+	if err != nil {
+		lookupError(c, "deleted user", err)
+		return
+	}
+	s.queueUserWebhook("restore", u)
+	c.JSON(http.StatusOK, u)
+}
+
+type ImpersonateResponse struct {
+	UserID    uint      `json:"user_id"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// AdminImpersonate opens a short lived session as another user, for support.
+// The session records which admin opened it and shows up in the user's own
+// session list, and is audited.
+func (s *Server) AdminImpersonate(c *gin.Context) {
+	ev := persist.AuditEvent{Action: "admin.impersonate", TargetType: "user", TargetID: c.Param("userID")}
+	defer func() {
+		s.audit(c, ev)
+	}()
+
+	adminId, id, ok := adminTarget(c, false)
+	if !ok {
+		return
+	}
+	u, err := s.persist.GetUserById(id)
+	if err != nil {
+		lookupError(c, "user", err)
+		return
+	}
+	if adminPeer(c, adminId, u) {
+		return
+	}
+	if !u.CanLogin {
+		c.JSON(http.StatusConflict, Response{
+			Message: "user can't log in",
+		})
+		return
+	}
+
+	impersonator := uint(adminId)
+	sess := persist.Session{
+		UserID:         u.ID,
+		Device:         c.Request.UserAgent(),
+		IP:             c.ClientIP(),
+		ExpiresAt:      time.Now().Add(IMPERSONATIONTTL),
+		ImpersonatorID: &impersonator,
+	}
+	if err := s.sessions.Create(&sess); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not create session",
+			Error:   err.Error(),
+		})
+		return
+	}
+	ev.Detail = "session " + sess.ID
+
+	c.JSON(http.StatusOK, ImpersonateResponse{
+		UserID:    u.ID,
+		Token:     sess.Token,
+		ExpiresAt: sess.ExpiresAt,
+	})
+}
+
+func (s *Server) revokeAllSessions(userId uint) {
+	if err := s.sessions.RevokeAll(userId); err != nil {
+		log.Printf("could not revoke sessions of user %d: %v", userId, err)
+	}
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"net/http"
+
+	"avenue/backend/persist"
+
+	"github.com/gin-gonic/gin"
+)
+
+type CreateAppPasswordReq struct {
+	Name string `json:"name" validate:"required,min=1,max=100"`
+}
+
+type AppPasswordResponse struct {
+	persist.AppPassword
+	// Password is only ever returned when the app password is created.
+	Password string `json:"password"`
+}
+
+// CreateAppPassword makes a new password for signing in to WebDAV without
+// the account password.
+func (s *Server) CreateAppPassword(c *gin.Context) {
+	var id string
+	defer func() {
+		s.audit(c, persist.AuditEvent{Action: "user.app_password.create", TargetType: "app_password", TargetID: id})
+	}()
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	var req CreateAppPasswordReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "could not marshal all data to json",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "invalid app password",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	ap, password, err := s.persist.CreateAppPassword(uint(uid), req.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not create app password",
+			Error:   err.Error(),
+		})
+		return
+	}
+	id = ap.ID
+
+	c.JSON(http.StatusCreated, AppPasswordResponse{AppPassword: ap, Password: password})
+}
+
+func (s *Server) ListAppPasswords(c *gin.Context) {
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	aps, err := s.persist.ListAppPasswords(uint(uid))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not list app passwords",
+			Error:   err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, aps)
+}
+
+func (s *Server) DeleteAppPassword(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "user.app_password.delete", TargetType: "app_password", TargetID: c.Param("appPasswordID")})
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	if err := s.persist.DeleteAppPassword(uint(uid), c.Param("appPasswordID")); err != nil {
+		lookupError(c, "app password", err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"avenue/backend/persist"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxArchiveItems is the most files and folders DownloadArchive takes.
+const maxArchiveItems = 1000
+
+// archiveFormat is a format folders can be downloaded in.
+type archiveFormat struct {
+	ext         string
+	contentType string
+	open        func(w io.Writer) archiveWriter
+}
+
+// archiveFormats are the archive formats by the ?format= asking for them.
+var archiveFormats = map[string]archiveFormat{
+	"zip":    {ext: ".zip", contentType: "application/zip", open: newZipArchive},
+	"tar.gz": {ext: ".tar.gz", contentType: "application/gzip", open: newTarGzArchive},
+}
+
+// archiveWriter writes entries to an archive as they come, so archives are
+// streamed without being held anywhere.
+type archiveWriter interface {
+	dir(name string) error
+	file(name string, f *persist.File, content io.Reader) error
+	Close() error
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func newZipArchive(w io.Writer) archiveWriter {
+	return zipArchive{zip.NewWriter(w)}
+}
+
+func (a zipArchive) dir(name string) error {
+	_, err := a.zw.Create(name + "/")
+	return err
+}
+
+func (a zipArchive) file(name string, f *persist.File, content io.Reader) error {
+	w, err := a.zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: fileModTime(f),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, content)
+	return err
+}
+
+func (a zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+type tarGzArchive struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func newTarGzArchive(w io.Writer) archiveWriter {
+	gz := gzip.NewWriter(w)
+	return tarGzArchive{gz: gz, tw: tar.NewWriter(gz)}
+}
+
+func (a tarGzArchive) dir(name string) error {
+	return a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     0o755,
+		ModTime:  time.Now(),
+	})
+}
+
+// file writes the header before the content, so it takes the size recorded
+// for f. Content of another length fails the archive.
+func (a tarGzArchive) file(name string, f *persist.File, content io.Reader) error {
+	err := a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(f.FileSize),
+		Mode:     0o644,
+		ModTime:  fileModTime(f),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(a.tw, content)
+	return err
+}
+
+func (a tarGzArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+// fileModTime is when the content of f last changed.
+func fileModTime(f *persist.File) time.Time {
+	if f.UpdatedAt.IsZero() {
+		return f.CreatedAt
+	}
+	return f.UpdatedAt
+}
+
+// archiveName makes a file or folder name safe to use as one path element in an
+// archive.
+func archiveName(name string) string {
+	name = strings.NewReplacer("/", "_", "\\", "_").Replace(name)
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+// archiveNames hands out the names of the entries in one folder of an
+// archive. Names in a folder needn't be unique, repeats are numbered.
+type archiveNames map[string]bool
+
+func (n archiveNames) unique(name string) string {
+	name = archiveName(name)
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 2; n[name]; i++ {
+		name = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	n[name] = true
+	return name
+}
+
+// archiveFolder writes the folder tree under folderId, owned by ownerId, to a
+// below prefix.
+func (s *Server) archiveFolder(a archiveWriter, ownerId int, folderId, prefix string) error {
+	files, err := s.persist.ListChildFile(ownerId, folderId)
+	if err != nil {
+		return err
+	}
+	folders, err := s.persist.ListChildFolder(ownerId, folderId)
+	if err != nil {
+		return err
+	}
+
+	names := archiveNames{}
+	for i := range files {
+		if err := s.archiveFile(a, &files[i], path.Join(prefix, names.unique(files[i].Name))); err != nil {
+			return err
+		}
+	}
+	for _, f := range folders {
+		dir := path.Join(prefix, names.unique(f.Name))
+		if err := a.dir(dir); err != nil {
+			return err
+		}
+		if err := s.archiveFolder(a, ownerId, f.FolderID, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) archiveFile(a archiveWriter, f *persist.File, name string) error {
+	// files whose content went missing before it could be migrated have
+	// nothing to add, failing would cut the rest of the archive short
+	if f.Sha256 == "" {
+		return nil
+	}
+	content, err := s.blobs.Open(f.Sha256)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	return a.file(name, f, content)
+}
+
+// archiveFormatQuery reads ?format=, zip if it is missing. If it is unknown
+// an error response has already been written and ok is false.
+func archiveFormatQuery(c *gin.Context) (archiveFormat, bool) {
+	format, ok := archiveFormats[c.DefaultQuery("format", "zip")]
+	if !ok {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "unknown archive format",
+			Error:   "format must be zip or tar.gz",
+		})
+	}
+	return format, ok
+}
+
+// serveArchive streams an archive called name, with the entries write adds.
+func serveArchive(c *gin.Context, format archiveFormat, name string, write func(a archiveWriter) error) {
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + format.ext}))
+	c.Header("Content-Type", format.contentType)
+	c.Status(http.StatusOK)
+
+	a := format.open(c.Writer)
+	err := write(a)
+	if err == nil {
+		err = a.Close()
+	}
+	// the status is already sent, all we can do is cut the archive short
+	if err != nil {
+		log.Printf("could not write archive %s: %v", name, err)
+	}
+}
+
+// DownloadFolder streams a folder and everything in it as an archive, in the
+// ?format= zip or tar.gz. Folder "-1" is the caller's top level.
+func (s *Server) DownloadFolder(c *gin.Context) {
+	folderID := c.Param("folderID")
+	defer s.audit(c, persist.AuditEvent{Action: "folder.download", TargetType: "folder", TargetID: folderID})
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	format, ok := archiveFormatQuery(c)
+	if !ok {
+		return
+	}
+	owner, name := uid, "files"
+	if folderID != "-1" {
+		f, ok := s.authorizeFolder(c, uid, folderID, persist.PermissionView)
+		if !ok {
+			return
+		}
+		owner, name = f.OwnerId, f.Name
+	}
+
+	serveArchive(c, format, name, func(a archiveWriter) error {
+		return s.archiveFolder(a, owner, folderID, "")
+	})
+}
+
+// DownloadArchive streams a selection of files and folders as one archive,
+// picked by repeating ?file= and ?folder= with their ids.
+func (s *Server) DownloadArchive(c *gin.Context) {
+	fileIDs, folderIDs := c.QueryArray("file"), c.QueryArray("folder")
+	defer s.audit(c, persist.AuditEvent{
+		Action:     "archive.download",
+		TargetType: "selection",
+		Detail:     fmt.Sprintf("%d files, %d folders", len(fileIDs), len(folderIDs)),
+	})
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	format, ok := archiveFormatQuery(c)
+	if !ok {
+		return
+	}
+	if n := len(fileIDs) + len(folderIDs); n == 0 || n > maxArchiveItems {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "invalid selection",
+			Error:   fmt.Sprintf("select between 1 and %d files and folders", maxArchiveItems),
+		})
+		return
+	}
+
+	files := make([]*persist.File, 0, len(fileIDs))
+	for _, id := range fileIDs {
+		f, ok := s.authorizeFile(c, uid, id, persist.PermissionView)
+		if !ok {
+			return
+		}
+		files = append(files, f)
+	}
+	folders := make([]*persist.Folder, 0, len(folderIDs))
+	for _, id := range folderIDs {
+		f, ok := s.authorizeFolder(c, uid, id, persist.PermissionView)
+		if !ok {
+			return
+		}
+		folders = append(folders, f)
+	}
+
+	serveArchive(c, format, "files", func(a archiveWriter) error {
+		names := archiveNames{}
+		for _, f := range files {
+			if err := s.archiveFile(a, f, names.unique(f.Name)); err != nil {
+				return err
+			}
+		}
+		for _, f := range folders {
+			dir := names.unique(f.Name)
+			if err := a.dir(dir); err != nil {
+				return err
+			}
+			if err := s.archiveFolder(a, f.OwnerId, f.FolderID, dir); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"avenue/backend/persist"
+	"avenue/backend/shared"
+
+	"github.com/gin-gonic/gin"
+)
+
+// auditedKey marks a request an explicit hook already recorded, so
+// auditRequests doesn't record it twice.
+const auditedKey = "audited"
+
+// audit records ev for the request in c, filling in the actor, client and
+// status from the request. Unless set, the outcome follows the response
+// status, so hooks deferred at the top of a handler see how it ended.
+func (s *Server) audit(c *gin.Context, ev persist.AuditEvent) {
+	c.Set(auditedKey, true)
+
+	ctx := c.Request.Context()
+	if ev.ActorID == nil {
+		if id, err := shared.GetUserIdFromContext(ctx); err == nil {
+			if uid, err := strconv.Atoi(id); err == nil {
+				ev.ActorID = &uid
+			}
+		}
+	}
+	if imp, ok := ctx.Value(shared.IMPERSONATORNAME).(int); ok {
+		ev.ImpersonatorID = &imp
+	}
+	ev.IP = c.ClientIP()
+	ev.UserAgent = c.Request.UserAgent()
+	ev.Status = c.Writer.Status()
+	if ev.Outcome == "" {
+		switch {
+		case ev.Status == http.StatusUnauthorized || ev.Status == http.StatusForbidden:
+			ev.Outcome = persist.AuditDenied
+		case ev.Status >= 400:
+			ev.Outcome = persist.AuditFailure
+		default:
+			ev.Outcome = persist.AuditSuccess
+		}
+	}
+
+	if err := s.persist.CreateAuditEvent(&ev); err != nil {
+		log.Printf("could not record audit event %s: %v", ev.Action, err)
+	}
+}
+
+// auditRequests records every request that changes something, and every
+// request refused for lack of authentication or access, unless a handler
+// recorded it already.
+func (s *Server) auditRequests(c *gin.Context) {
+	c.Next()
+
+	if c.GetBool(auditedKey) {
+		return
+	}
+	status := c.Writer.Status()
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		if status != http.StatusUnauthorized && status != http.StatusForbidden {
+			return
+		}
+	}
+
+	route := c.FullPath()
+	if route == "" {
+		route = c.Request.URL.Path
+	}
+	s.audit(c, persist.AuditEvent{
+		Action:     "http." + strings.ToLower(c.Request.Method),
+		TargetType: "route",
+		TargetID:   route,
+	})
+}
+
+// auditQuery reads the filters shared by the audit endpoints: ?from= and ?to=
+// as RFC 3339 times, ?actor= a user id and ?action=. If they are malformed an
+// error response has already been written and ok is false.
+func auditQuery(c *gin.Context) (q persist.AuditQuery, ok bool) {
+	for _, t := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &q.From}, {"to", &q.To}} {
+		v := c.Query(t.name)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, Response{
+				Message: "invalid " + t.name,
+				Error:   err.Error(),
+			})
+			return q, false
+		}
+		*t.dst = parsed
+	}
+	if v := c.Query("actor"); v != "" {
+		actor, err := strconv.Atoi(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, Response{
+				Message: "invalid actor",
+				Error:   err.Error(),
+			})
+			return q, false
+		}
+		q.ActorID = &actor
+	}
+	q.Action = c.Query("action")
+	return q, true
+}
+
+// AdminListAudit returns a page of audit events, newest first. Pass the
+// smallest id of a page as ?before= to get the next one.
+func (s *Server) AdminListAudit(c *gin.Context) {
+	q, ok := auditQuery(c)
+	if !ok {
+		return
+	}
+	q.Limit = 100
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 && l <= 1000 {
+		q.Limit = l
+	}
+	if b, err := strconv.ParseUint(c.Query("before"), 10, 64); err == nil {
+		q.BeforeID = uint(b)
+	}
+
+	events, err := s.persist.ListAuditEvents(q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not list audit events",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, events)
+}
+
+// AdminExportAudit streams every matching audit event, oldest first, as
+// newline delimited JSON.
+func (s *Server) AdminExportAudit(c *gin.Context) {
+	q, ok := auditQuery(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", `attachment; filename="audit.ndjson"`)
+	c.Status(http.StatusOK)
+
+	enc := json.NewEncoder(c.Writer)
+	// the status is already sent, all we can do is cut the export short
+	err := s.persist.EachAuditEvent(q, func(e persist.AuditEvent) error {
+		return enc.Encode(e)
+	})
+	if err != nil {
+		log.Printf("could not export audit events: %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"net/http"
+
+	"avenue/backend/persist"
+
+	"github.com/gin-gonic/gin"
+)
+
+// authzError answers a request uid isn't allowed to make. Without any access
+// it is a 404 like a missing record, so ids can't be probed; with too little
+// it is a 403.
+func authzError(c *gin.Context, what string, perm persist.Permission) {
+	if perm == persist.PermissionNone {
+		c.JSON(http.StatusNotFound, Response{
+			Message: what + " not found",
+			Error:   persist.ErrNotFound.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusForbidden, Response{
+		Message: "not allowed to do this to the " + what,
+	})
+}
+
+// authorizeFile returns the file with id if uid holds at least need on it. If
+// not an error response has already been written and ok is false.
+func (s *Server) authorizeFile(c *gin.Context, uid int, id string, need persist.Permission) (*persist.File, bool) {
+	f, perm, err := s.persist.FilePermission(uid, id)
+	if err != nil {
+		lookupError(c, "file", err)
+		return nil, false
+	}
+	if perm < need {
+		authzError(c, "file", perm)
+		return nil, false
+	}
+	return f, true
+}
+
+// authorizeFolder returns the folder with id if uid holds at least need on
+// it. If not an error response has already been written and ok is false.
+func (s *Server) authorizeFolder(c *gin.Context, uid int, id string, need persist.Permission) (*persist.Folder, bool) {
+	f, perm, err := s.persist.FolderPermission(uid, id)
+	if err != nil {
+		lookupError(c, "folder", err)
+		return nil, false
+	}
+	if perm < need {
+		authzError(c, "folder", perm)
+		return nil, false
+	}
+	return f, true
+}
+
+// authorizeParent checks uid may add to the folder parent and returns the id
+// of whoever owns it. An empty parent is uid's own top level.
+func (s *Server) authorizeParent(c *gin.Context, uid int, parent string) (int, bool) {
+	if parent == "" {
+		return uid, true
+	}
+	f, ok := s.authorizeFolder(c, uid, parent, persist.PermissionEdit)
+	if !ok {
+		return 0, false
+	}
+	return f.OwnerId, true
+}
+
+// authorizeMove checks uid may move something owned by ownerId into parent.
+// Moves can't change who owns something.
+func (s *Server) authorizeMove(c *gin.Context, uid, ownerId int, parent string) bool {
+	parentOwner, ok := s.authorizeParent(c, uid, parent)
+	if !ok {
+		return false
+	}
+	if parentOwner != ownerId {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "could not move",
+			Error:   "items can't be moved to a folder with a different owner",
+		})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"avenue/backend/persist"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAuthorizeMove(t *testing.T) {
+	s := testServer(t)
+	owner, editor, viewer := testUser(t, s), testUser(t, s), testUser(t, s)
+	folder := func(ownerId int, name string) string {
+		id, err := s.persist.CreateFolder(&persist.Folder{Name: name, OwnerId: ownerId})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	shared, other, editors := folder(owner, "shared"), folder(owner, "other"), folder(editor, "mine")
+	for uid, role := range map[int]string{editor: persist.RoleEditor, viewer: persist.RoleViewer} {
+		_, err := s.persist.CreateFolderGrant(&persist.FolderGrant{FolderID: shared, OwnerId: owner, UserID: &uid, Role: role, CreatedBy: owner})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		uid     int
+		ownerId int
+		parent  string
+		status  int
+	}{
+		{"owner between their folders", owner, owner, other, http.StatusOK},
+		{"owner to their top level", owner, owner, "", http.StatusOK},
+		{"editor within the owner's folders", editor, owner, shared, http.StatusOK},
+		{"editor of the owner's item to their own folder", editor, owner, editors, http.StatusBadRequest},
+		{"editor of the owner's item to their top level", editor, owner, "", http.StatusBadRequest},
+		{"editor of their own item to the owner's folder", editor, editor, shared, http.StatusBadRequest},
+		{"viewer to a folder they can only see", viewer, owner, shared, http.StatusForbidden},
+		{"editor to a folder they can't see", editor, owner, other, http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			ok := s.authorizeMove(c, tc.uid, tc.ownerId, tc.parent)
+			if ok != (tc.status == http.StatusOK) {
+				t.Fatalf("authorizeMove = %v, answered %d %s", ok, w.Code, w.Body)
+			}
+			if !ok && w.Code != tc.status {
+				t.Errorf("refused with %d %s, want %d", w.Code, w.Body, tc.status)
+			}
+		})
+	}
+}
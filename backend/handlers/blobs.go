@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"avenue/backend/shared"
+	"avenue/backend/storage"
+)
+
+// BLOBGCGRACE is how long an unreferenced blob is kept before it is garbage
+// collected. Uploads touch their blob before creating the file that points at
+// it, so this must comfortably exceed the time between the two.
+var BLOBGCGRACE = shared.GetEnvDuration("BLOB_GC_GRACE", time.Hour)
+
+// commitBlob stores staged content under its hash. The blob row is touched
+// first, under the same per-hash lock the garbage collector takes, so the
+// content can't be collected between being stored and being referenced.
+func (s *Server) commitBlob(b storage.StagedBlob) error {
+	unlock := s.blobLocks.Lock(b.Hash())
+	defer unlock()
+
+	if err := s.persist.TouchBlob(b.Hash(), b.Size()); err != nil {
+		_ = b.Discard()
+		return err
+	}
+	return b.Commit()
+}
+
+// CollectBlobs garbage collects unreferenced blobs every interval until ctx is
+// done.
+func (s *Server) CollectBlobs(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n, err := s.collectBlobs(time.Now().Add(-BLOBGCGRACE))
+			if err != nil {
+				log.Printf("could not collect blobs: %v", err)
+			}
+			if n > 0 {
+				log.Printf("collected %d blobs", n)
+			}
+		}
+	}
+}
+
+// collectBlobs removes the content of blobs that have been unreferenced and
+// untouched since before, returning how many were removed.
+func (s *Server) collectBlobs(before time.Time) (int, error) {
+	blobs, err := s.persist.ListUnreferencedBlobs(before)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, b := range blobs {
+		removed, err := s.collectBlob(b.Hash, before)
+		if err != nil {
+			log.Printf("could not collect blob %s: %v", b.Hash, err)
+			continue
+		}
+		if removed {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *Server) collectBlob(hash string, before time.Time) (bool, error) {
+	unlock := s.blobLocks.Lock(hash)
+	defer unlock()
+
+	// the row is deleted first and only if nothing touched it meanwhile,
+	// after that no upload can reference the hash without re-creating it
+	deleted, err := s.persist.DeleteUnreferencedBlob(hash, before)
+	if err != nil || !deleted {
+		return false, err
+	}
+	return true, s.blobs.Remove(hash)
+}
+
+// legacyOwner finds which of userIds stored the content of fileId, or
+// returns os.ErrNotExist.
+func legacyOwner(legacy storage.LegacyStore, fileId string, userIds []int) (int, error) {
+	for _, uid := range userIds {
+		r, err := legacy.OpenLegacy(uid, fileId)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.Close()
+		return uid, nil
+	}
+	return 0, os.ErrNotExist
+}
+
+// MigrateLegacyBlobs moves content stored per file, before blobs were content
+// addressed, into the blob store.
+func (s *Server) MigrateLegacyBlobs() error {
+	legacy, ok := s.blobs.(storage.LegacyStore)
+	if !ok {
+		return nil
+	}
+
+	files, err := s.persist.ListFilesWithoutBlob()
+	if err != nil {
+		return err
+	}
+
+	var userIds []int
+	for _, f := range files {
+		// files at the top level predate owners, whoever's directory holds
+		// their content owns them
+		if f.OwnerId == 0 {
+			if userIds == nil {
+				if userIds, err = s.persist.ListUserIds(); err != nil {
+					return err
+				}
+			}
+			owner, err := legacyOwner(legacy, f.ID, userIds)
+			if errors.Is(err, os.ErrNotExist) {
+				log.Printf("no content found for file %s", f.ID)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := s.persist.SetFileOwner(f.ID, owner); err != nil {
+				return err
+			}
+			f.OwnerId = owner
+		}
+
+		r, err := legacy.OpenLegacy(f.OwnerId, f.ID)
+		if errors.Is(err, os.ErrNotExist) {
+			log.Printf("no content found for file %s", f.ID)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		staged, err := s.blobs.Stage(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		if err := s.commitBlob(staged); err != nil {
+			return err
+		}
+		if err := s.persist.SetFileBlob(f.ID, staged.Hash(), staged.Size()); err != nil {
+			return err
+		}
+		if err := legacy.RemoveLegacy(f.OwnerId, f.ID); err != nil {
+			log.Printf("could not remove legacy content of file %s: %v", f.ID, err)
+		}
+	}
+	if len(files) > 0 {
+		log.Printf("migrated %d files to content addressed storage", len(files))
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"avenue/backend/persist"
+	"avenue/backend/shared"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CHANGERETENTION is how long changes are kept, 0 keeps them forever.
+// Clients with an older cursor have to list everything again.
+var CHANGERETENTION = shared.GetEnvDuration("CHANGE_RETENTION", 90*24*time.Hour)
+
+const (
+	defaultChangeLimit = 500
+	maxChangeLimit     = 1000
+)
+
+type ChangesResponse struct {
+	Changes []persist.Change `json:"changes"`
+	// Cursor is where to continue from next time.
+	Cursor  string `json:"cursor"`
+	HasMore bool   `json:"has_more"`
+}
+
+// ListChanges returns what changed after ?cursor= in the caller's files and
+// the folders shared with them, oldest first, up to ?limit= at a time.
+// Without a cursor only the current cursor is returned, to follow changes
+// from after a full listing. A cursor older than the changes kept is 410
+// Gone, and the client has to list everything again.
+func (s *Server) ListChanges(c *gin.Context) {
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	limit := defaultChangeLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxChangeLimit {
+			c.JSON(http.StatusBadRequest, Response{
+				Message: "invalid limit",
+				Error:   "limit must be between 1 and " + strconv.Itoa(maxChangeLimit),
+			})
+			return
+		}
+		limit = n
+	}
+
+	// read first: every change up to newest is committed by now
+	oldest, newest, err := s.persist.ChangeRange()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not list changes",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if c.Query("cursor") == "" {
+		c.JSON(http.StatusOK, ChangesResponse{Changes: []persist.Change{}, Cursor: strconv.FormatInt(newest, 10)})
+		return
+	}
+	cursor, err := strconv.ParseInt(c.Query("cursor"), 10, 64)
+	if err != nil || cursor < 0 {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "invalid cursor",
+			Error:   "cursor must come from an earlier response",
+		})
+		return
+	}
+	if cursor+1 < oldest {
+		c.JSON(http.StatusGone, Response{
+			Message: "cursor expired",
+			Error:   "the changes after the cursor are no longer kept, list everything again",
+		})
+		return
+	}
+
+	sharedFolders, err := s.persist.SharedFolderTree(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not list shared folders",
+			Error:   err.Error(),
+		})
+		return
+	}
+	changes, err := s.persist.ListChanges(uid, sharedFolders, cursor, limit+1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not list changes",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if changes == nil {
+		changes = []persist.Change{}
+	}
+	res := ChangesResponse{Changes: changes, HasMore: len(changes) > limit}
+	if res.HasMore {
+		res.Changes = changes[:limit]
+		cursor = res.Changes[limit-1].ID
+	} else {
+		// nothing the caller may see up to newest, don't look again
+		cursor = max(cursor, newest)
+		if len(changes) > 0 {
+			cursor = max(cursor, changes[len(changes)-1].ID)
+		}
+	}
+	res.Cursor = strconv.FormatInt(cursor, 10)
+	c.JSON(http.StatusOK, res)
+}
+
+// JanitorChanges deletes changes older than retention, all but the newest,
+// checking every interval until ctx is done.
+func (s *Server) JanitorChanges(ctx context.Context, interval, retention time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n, err := s.persist.PruneChanges(time.Now().Add(-retention))
+			if err != nil {
+				log.Printf("could not prune changes: %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("pruned %d changes", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"avenue/backend/persist"
+	"avenue/backend/shared"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/webdav"
+)
+
+// DAVPREFIX is where the WebDAV tree is mounted.
+const DAVPREFIX = "/dav"
+
+// davMethods are the methods routed to DAV.
+var davMethods = []string{
+	http.MethodOptions, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete,
+	"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK",
+}
+
+// davWrites are the WebDAV methods that change something. LOCK is one as
+// locking a missing path creates an empty file there.
+var davWrites = map[string]bool{
+	http.MethodPut:    true,
+	http.MethodDelete: true,
+	"PROPPATCH":       true,
+	"MKCOL":           true,
+	"COPY":            true,
+	"MOVE":            true,
+	"LOCK":            true,
+	"UNLOCK":          true,
+}
+
+// davLengthKey carries the Content-Length of a PUT to davUpload, so a body
+// cut short isn't stored as the whole file.
+type davLengthKey struct{}
+
+// davOpenedKey carries a *davOpened for a GET, so the file it resolves to
+// can be audited.
+type davOpenedKey struct{}
+
+type davOpened struct {
+	file *persist.File
+}
+
+// DAV serves the caller's files over WebDAV, e.g. for mounting with davfs2
+// or rclone. Clients sign in with HTTP Basic, their email and either an app
+// password or their account password.
+func (s *Server) DAV(c *gin.Context) {
+	user, ok := s.davUser(c)
+	if !ok {
+		c.Header("WWW-Authenticate", `Basic realm="Avenue", charset="UTF-8"`)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	uid := int(user.ID)
+
+	ctx := context.WithValue(c.Request.Context(), shared.USERCOOKIENAME, strconv.Itoa(uid))
+	ctx = context.WithValue(ctx, shared.USERROLENAME, user.Role)
+	if c.Request.Method == http.MethodPut {
+		ctx = context.WithValue(ctx, davLengthKey{}, c.Request.ContentLength)
+	}
+	if c.Request.Method == http.MethodGet {
+		opened := &davOpened{}
+		ctx = context.WithValue(ctx, davOpenedKey{}, opened)
+		defer func() {
+			if opened.file != nil {
+				s.audit(c, persist.AuditEvent{
+					Action:     "file.download",
+					TargetType: "file",
+					TargetID:   opened.file.ID,
+					Detail:     "dav " + strings.TrimPrefix(c.Request.URL.Path, DAVPREFIX),
+				})
+			}
+		}()
+	}
+	c.Request = c.Request.WithContext(ctx)
+
+	write := davWrites[c.Request.Method]
+	if write {
+		defer s.audit(c, persist.AuditEvent{
+			Action:     "dav." + strings.ToLower(c.Request.Method),
+			TargetType: "path",
+			TargetID:   strings.TrimPrefix(c.Request.URL.Path, DAVPREFIX),
+		})
+	}
+	if write && user.Role == persist.UserRoleReadOnly {
+		c.AbortWithStatusJSON(http.StatusForbidden, Response{
+			Message: "read-only users can't make changes",
+		})
+		return
+	}
+
+	h := webdav.Handler{
+		Prefix:     DAVPREFIX,
+		FileSystem: &davFS{s: s, uid: uid},
+		LockSystem: s.davLocks.forUser(uid),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Printf("webdav %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	h.ServeHTTP(c.Writer, c.Request)
+}
+
+// davUser authenticates a WebDAV request.
+func (s *Server) davUser(c *gin.Context) (persist.User, bool) {
+	email, password, ok := c.Request.BasicAuth()
+	if !ok {
+		return persist.User{}, false
+	}
+	u, err := s.persist.GetUserByEmail(email)
+	if err != nil || !u.CanLogin {
+		return u, false
+	}
+
+	appPassword, err := s.persist.UseAppPassword(u.ID, password)
+	if err != nil {
+		log.Printf("could not check app passwords of user %d: %v", u.ID, err)
+		return u, false
+	}
+	if appPassword || s.davLogins.ok(davLoginKey(email, password, u.Password)) {
+		return u, true
+	}
+
+	u, err = s.authorize(email, password)
+	if err != nil {
+		return u, false
+	}
+	s.davLogins.add(davLoginKey(email, password, u.Password))
+	return u, true
+}
+
+// davLocks keeps a lock system per user, paths are only unique within the
+// tree of one user.
+type davLocks struct {
+	mu     sync.Mutex
+	byUser map[int]webdav.LockSystem
+}
+
+func (l *davLocks) forUser(uid int) webdav.LockSystem {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.byUser == nil {
+		l.byUser = map[int]webdav.LockSystem{}
+	}
+	ls, ok := l.byUser[uid]
+	if !ok {
+		ls = webdav.NewMemLS()
+		l.byUser[uid] = ls
+	}
+	return ls
+}
+
+// loginCacheTTL is how long a verified password is remembered.
+const loginCacheTTL = 5 * time.Minute
+
+// loginCache remembers recently verified passwords. WebDAV clients send the
+// account password with every request, share link clients the link's, and
+// checking them is deliberately slow.
+type loginCache struct {
+	mu    sync.Mutex
+	until map[[32]byte]time.Time
+}
+
+// davLoginKey identifies a login. It includes the stored password hash, so
+// changing the password forgets it.
+func davLoginKey(email, password, stored string) [32]byte {
+	return sha256.Sum256([]byte(email + "\x00" + password + "\x00" + stored))
+}
+
+func (l *loginCache) ok(key [32]byte) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return time.Now().Before(l.until[key])
+}
+
+func (l *loginCache) add(key [32]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.until == nil {
+		l.until = map[[32]byte]time.Time{}
+	}
+	for k, t := range l.until {
+		if now.After(t) {
+			delete(l.until, k)
+		}
+	}
+	l.until[key] = now.Add(loginCacheTTL)
+}
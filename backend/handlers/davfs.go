@@ -0,0 +1,405 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"time"
+
+	"avenue/backend/persist"
+	"avenue/backend/storage"
+
+	"golang.org/x/net/webdav"
+)
+
+// davFS is the tree of one user's own folders and files as a WebDAV file
+// system. Deleting moves things into the trash, like the rest of the API.
+// Folders shared with the user aren't part of it.
+type davFS struct {
+	s   *Server
+	uid int
+}
+
+// resolveNew finds the folder the last of parts goes in, making sure nothing
+// is there yet.
+func (fs *davFS) resolveNew(parts []string) (parent string, err error) {
+	if len(parts) == 0 {
+		return "", os.ErrExist
+	}
+	dir, err := fs.s.resolvePath(fs.uid, parts[:len(parts)-1])
+	if err != nil {
+		return "", err
+	}
+	if !dir.isDir() {
+		return "", os.ErrNotExist
+	}
+	if _, err := fs.s.resolvePath(fs.uid, parts); err == nil {
+		return "", os.ErrExist
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	return dir.folderID(), nil
+}
+
+func (fs *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	parts := splitPath(name)
+	parent, err := fs.resolveNew(parts)
+	if err != nil {
+		return err
+	}
+	_, err = fs.s.persist.CreateFolder(&persist.Folder{
+		Name:    parts[len(parts)-1],
+		Parent:  parent,
+		OwnerId: fs.uid,
+	})
+	return err
+}
+
+// OpenFile opens folders and files for reading, and files for writing them
+// whole. What is written becomes a new version of an existing file.
+func (fs *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	parts := splitPath(name)
+	n, err := fs.s.resolvePath(fs.uid, parts)
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		if err != nil {
+			return nil, err
+		}
+		if opened, ok := ctx.Value(davOpenedKey{}).(*davOpened); ok && !n.isDir() {
+			opened.file = n.file
+		}
+		return &davFile{fs: fs, node: n}, nil
+	}
+
+	switch {
+	case err == nil && n.isDir():
+		return nil, fmt.Errorf("%s is a folder: %w", name, os.ErrInvalid)
+	case err == nil && flag&os.O_EXCL != 0:
+		return nil, os.ErrExist
+	case err == nil && (flag&os.O_TRUNC == 0 || flag&os.O_APPEND != 0):
+		return nil, fmt.Errorf("files can only be written whole: %w", os.ErrInvalid)
+	case errors.Is(err, os.ErrNotExist) && flag&os.O_CREATE == 0:
+		return nil, err
+	case err == nil:
+		return fs.upload(ctx, n.file.Parent, n.file.Name, n.file)
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+
+	parent, err := fs.resolveNew(parts)
+	if err != nil {
+		return nil, err
+	}
+	return fs.upload(ctx, parent, parts[len(parts)-1], nil)
+}
+
+func (fs *davFS) RemoveAll(ctx context.Context, name string) error {
+	parts := splitPath(name)
+	if len(parts) == 0 {
+		return os.ErrPermission
+	}
+	n, err := fs.s.resolvePath(fs.uid, parts)
+	if err != nil {
+		return err
+	}
+	if n.isDir() {
+		return davError(fs.s.persist.TrashFolder(fs.uid, n.folderID()))
+	}
+	return davError(fs.s.persist.TrashFile(fs.uid, n.file.ID))
+}
+
+// Rename moves and/or renames a folder or file. The destination must not
+// exist, the WebDAV handler removes it first when overwriting.
+func (fs *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	from, to := splitPath(oldName), splitPath(newName)
+	if len(from) == 0 {
+		return os.ErrPermission
+	}
+	n, err := fs.s.resolvePath(fs.uid, from)
+	if err != nil {
+		return err
+	}
+	parent, err := fs.resolveNew(to)
+	if err != nil {
+		return err
+	}
+
+	name := to[len(to)-1]
+	if n.isDir() {
+		_, err = fs.s.persist.UpdateFolder(fs.uid, n.folderID(), &name, &parent)
+	} else {
+		_, err = fs.s.persist.UpdateOwnedFile(fs.uid, n.file.ID, &name, &parent)
+	}
+	return davError(err)
+}
+
+func (fs *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	n, err := fs.s.resolvePath(fs.uid, splitPath(name))
+	if err != nil {
+		return nil, err
+	}
+	return davInfo{n}, nil
+}
+
+// davInfo describes a node. It implements webdav.ContentTyper and
+// webdav.ETager, so listings don't read any content.
+type davInfo struct {
+	treeNode
+}
+
+func (i davInfo) Name() string {
+	switch {
+	case i.file != nil:
+		return i.file.Name
+	case i.folder != nil:
+		return i.folder.Name
+	}
+	return "/"
+}
+
+func (i davInfo) Size() int64 {
+	if i.file == nil {
+		return 0
+	}
+	return int64(i.file.FileSize)
+}
+
+func (i davInfo) Mode() os.FileMode {
+	if i.isDir() {
+		return os.ModeDir | 0o755
+	}
+	return 0o644
+}
+
+// ModTime is zero for folders, which don't record one.
+func (i davInfo) ModTime() time.Time {
+	if i.file == nil {
+		return time.Time{}
+	}
+	return fileModTime(i.file)
+}
+
+func (i davInfo) IsDir() bool {
+	return i.isDir()
+}
+
+func (i davInfo) Sys() any {
+	return nil
+}
+
+func (i davInfo) ContentType(ctx context.Context) (string, error) {
+	if i.file == nil {
+		return "", webdav.ErrNotImplemented
+	}
+	if ct := mime.TypeByExtension("." + i.file.Extension); ct != "" && i.file.Extension != "" {
+		return ct, nil
+	}
+	return "application/octet-stream", nil
+}
+
+// ETag matches the one GetFile sends.
+func (i davInfo) ETag(ctx context.Context) (string, error) {
+	if i.file == nil || i.file.Sha256 == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return fmt.Sprintf("%q", i.file.Sha256), nil
+}
+
+// davFile is a folder or file opened for reading. The content of files is
+// only opened once it is read, as clients open files just to look at them.
+type davFile struct {
+	fs      *davFS
+	node    treeNode
+	content io.ReadSeekCloser
+	// children of a folder, loaded by the first Readdir
+	children []os.FileInfo
+	listed   bool
+}
+
+func (f *davFile) open() error {
+	if f.node.isDir() {
+		return fmt.Errorf("%s is a folder: %w", davInfo{f.node}.Name(), os.ErrInvalid)
+	}
+	if f.content != nil {
+		return nil
+	}
+	content, err := f.fs.s.blobs.Open(f.node.file.Sha256)
+	if err != nil {
+		return err
+	}
+	f.content = content
+	return nil
+}
+
+func (f *davFile) Read(p []byte) (int, error) {
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	return f.content.Read(p)
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	return f.content.Seek(offset, whence)
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// Readdir lists a folder. As with os.File, a count above 0 returns at most
+// that many entries per call.
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.node.isDir() {
+		return nil, fmt.Errorf("%s is not a folder: %w", f.node.file.Name, os.ErrInvalid)
+	}
+	if !f.listed {
+		// the top level is "-1" to the listing queries
+		id := f.node.folderID()
+		if id == "" {
+			id = "-1"
+		}
+		folders, err := f.fs.s.persist.ListChildFolder(f.fs.uid, id)
+		if err != nil {
+			return nil, err
+		}
+		files, err := f.fs.s.persist.ListChildFile(f.fs.uid, id)
+		if err != nil {
+			return nil, err
+		}
+		for i := range folders {
+			f.children = append(f.children, davInfo{treeNode{folder: &folders[i]}})
+		}
+		for i := range files {
+			f.children = append(f.children, davInfo{treeNode{file: &files[i]}})
+		}
+		f.listed = true
+	}
+
+	if count <= 0 {
+		children := f.children
+		f.children = nil
+		return children, nil
+	}
+	if len(f.children) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(f.children))
+	children := f.children[:n]
+	f.children = f.children[n:]
+	return children, nil
+}
+
+func (f *davFile) Stat() (os.FileInfo, error) {
+	return davInfo{f.node}, nil
+}
+
+func (f *davFile) Close() error {
+	if f.content == nil {
+		return nil
+	}
+	return f.content.Close()
+}
+
+// davUpload is a file opened for writing. What is written is staged as it
+// arrives, and only stored on Close, as a new file or a new version of the
+// one it replaces.
+type davUpload struct {
+	fs       *davFS
+	parent   string
+	name     string
+	replaces *persist.File
+	// expected is the Content-Length of the PUT, or -1 if unknown
+	expected int64
+	written  int64
+	pw       *io.PipeWriter
+	done     chan struct{}
+	staged   storage.StagedBlob
+	err      error
+	closed   bool
+}
+
+func (fs *davFS) upload(ctx context.Context, parent, name string, replaces *persist.File) (*davUpload, error) {
+	remaining, limited, err := fs.s.remainingQuota(fs.uid)
+	if err != nil {
+		return nil, err
+	}
+	expected, ok := ctx.Value(davLengthKey{}).(int64)
+	if !ok {
+		expected = -1
+	}
+
+	pr, pw := io.Pipe()
+	u := &davUpload{
+		fs:       fs,
+		parent:   parent,
+		name:     name,
+		replaces: replaces,
+		expected: expected,
+		pw:       pw,
+		done:     make(chan struct{}),
+	}
+	var r io.Reader = pr
+	if limited {
+		r = &quotaReader{r: pr, remaining: remaining}
+	}
+	go func() {
+		defer close(u.done)
+		u.staged, u.err = fs.s.blobs.Stage(r)
+		// writes fail from here on instead of blocking
+		pr.CloseWithError(u.err)
+	}()
+	return u, nil
+}
+
+func (u *davUpload) Write(p []byte) (int, error) {
+	if u.written+int64(len(p)) > MAXUPLOADSIZE {
+		u.pw.CloseWithError(ErrQuotaExceeded)
+		return 0, fmt.Errorf("file is larger than %d bytes", MAXUPLOADSIZE)
+	}
+	n, err := u.pw.Write(p)
+	u.written += int64(n)
+	return n, err
+}
+
+// Close stores what was written, unless less arrived than the PUT announced.
+func (u *davUpload) Close() error {
+	if u.closed {
+		return os.ErrClosed
+	}
+	u.closed = true
+	u.pw.Close()
+	<-u.done
+	if u.err != nil {
+		return u.err
+	}
+	defer u.staged.Discard()
+	if u.expected >= 0 && u.written != u.expected {
+		return fmt.Errorf("got %d of %d bytes: %w", u.written, u.expected, io.ErrUnexpectedEOF)
+	}
+
+	_, err := u.fs.s.saveContent(u.staged, u.fs.uid, u.fs.uid, u.parent, u.name, u.replaces)
+	return davError(err)
+}
+
+func (u *davUpload) Read(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (u *davUpload) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrPermission
+}
+
+func (u *davUpload) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+// Stat describes the file as written so far.
+func (u *davUpload) Stat() (os.FileInfo, error) {
+	f := persist.File{Name: u.name, FileSize: int(u.written), UpdatedAt: time.Now()}
+	return davInfo{treeNode{file: &f}}, nil
+}
@@ -0,0 +1,542 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"avenue/backend/persist"
+	"avenue/backend/shared"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+var (
+	// EVENTSLISTEN wakes every instance with Postgres LISTEN/NOTIFY when
+	// changes are recorded. Without it changes made by other instances are
+	// only seen every EVENTSPOLL.
+	EVENTSLISTEN, _ = strconv.ParseBool(shared.GetEnv("EVENTS_LISTEN", "false"))
+	EVENTSPOLL      = shared.GetEnvDuration("EVENTS_POLL", 5*time.Second)
+	// EVENTTICKETTTL is how long a ticket from EventTicket opens streams.
+	EVENTTICKETTTL = shared.GetEnvDuration("EVENT_TICKET_TTL", time.Minute)
+)
+
+const (
+	// eventBuffer is how many events a stream may fall behind before it is
+	// closed. The client reconnects with the last id it saw.
+	eventBuffer = 256
+	// eventHeartbeat keeps idle streams from being cut by proxies.
+	eventHeartbeat = 25 * time.Second
+)
+
+// eventBroker hands the changes recorded in the journal to the streams
+// subscribed to them.
+type eventBroker struct {
+	mu   sync.Mutex
+	subs map[*eventSub]struct{}
+}
+
+// eventSub is one stream. shared is only touched by RunEvents once the sub
+// is added.
+type eventSub struct {
+	uid    int
+	shared map[string]bool
+	ch     chan persist.Change
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{subs: map[*eventSub]struct{}{}}
+}
+
+func (b *eventBroker) subscribe(uid int, sharedFolders []string) *eventSub {
+	sub := &eventSub{uid: uid, ch: make(chan persist.Change, eventBuffer)}
+	sub.setShared(sharedFolders)
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub
+}
+
+func (b *eventBroker) unsubscribe(sub *eventSub) {
+	b.mu.Lock()
+	delete(b.subs, sub)
+	b.mu.Unlock()
+}
+
+// drop closes the stream of a sub that fell too far behind.
+func (b *eventBroker) drop(sub *eventSub) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		close(sub.ch)
+	}
+}
+
+func (b *eventBroker) list() []*eventSub {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	subs := make([]*eventSub, 0, len(b.subs))
+	for sub := range b.subs {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+func (sub *eventSub) setShared(folders []string) {
+	sub.shared = make(map[string]bool, len(folders))
+	for _, id := range folders {
+		sub.shared[id] = true
+	}
+}
+
+// sees reports whether c is in, or is, a folder shared with the sub.
+func (sub *eventSub) sees(c persist.Change) bool {
+	return sub.shared[c.ItemID] || sub.shared[c.Parent] || c.OldParent != "" && sub.shared[c.OldParent]
+}
+
+// publish hands c to every sub that may see it. Subs keep their shared
+// folders current as folders come and go, and look them up again when their
+// own grants change.
+func (s *Server) publish(c persist.Change) {
+	granted := s.grantees(c)
+	for _, sub := range s.events.list() {
+		if sub.uid != c.OwnerId {
+			if granted[sub.uid] {
+				s.refreshShared(sub)
+			} else {
+				s.followFolders(sub, c)
+			}
+		}
+		if sub.uid != c.OwnerId && !granted[sub.uid] && !sub.sees(c) {
+			continue
+		}
+		select {
+		case sub.ch <- c:
+		default:
+			s.events.drop(sub)
+		}
+	}
+}
+
+// grantees returns the users a share or unshare gave or took access.
+func (s *Server) grantees(c persist.Change) map[int]bool {
+	if c.Action != persist.ChangeShare && c.Action != persist.ChangeUnshare {
+		return nil
+	}
+	if c.GranteeId != nil {
+		return map[int]bool{*c.GranteeId: true}
+	}
+	if c.GranteeGroup == nil {
+		return nil
+	}
+	members, err := s.persist.ListGroupMembers(*c.GranteeGroup)
+	if err != nil {
+		log.Printf("could not list members of group %s: %v", *c.GranteeGroup, err)
+		return nil
+	}
+	users := make(map[int]bool, len(members))
+	for _, m := range members {
+		users[m.UserID] = true
+	}
+	return users
+}
+
+// followFolders updates the shared folders of sub for a folder made, moved or
+// restored. Only when a whole tree comes or goes are they looked up again.
+func (s *Server) followFolders(sub *eventSub, c persist.Change) {
+	if c.Kind != persist.ChangeKindFolder {
+		return
+	}
+	switch c.Action {
+	case persist.ChangeCreate:
+		if sub.shared[c.Parent] {
+			sub.shared[c.ItemID] = true
+		}
+	case persist.ChangeMove:
+		if sub.shared[c.Parent] != sub.shared[c.ItemID] {
+			s.refreshShared(sub)
+		}
+	case persist.ChangeRestore:
+		if sub.shared[c.Parent] && !sub.shared[c.ItemID] {
+			s.refreshShared(sub)
+		}
+	}
+}
+
+func (s *Server) refreshShared(sub *eventSub) {
+	folders, err := s.persist.SharedFolderTree(sub.uid)
+	if err != nil {
+		log.Printf("could not list folders shared with %d: %v", sub.uid, err)
+		return
+	}
+	sub.setShared(folders)
+}
+
+// RunEvents follows the change journal and publishes new changes until ctx
+// is done. It looks when this process records changes, when another one
+// does if listen is set, and every poll.
+func (s *Server) RunEvents(ctx context.Context, listen bool, poll time.Duration) {
+	wake := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+	if listen {
+		go func() {
+			for ctx.Err() == nil {
+				err := s.persist.ListenChanges(ctx, notify)
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("could not listen for changes: %v", err)
+				time.Sleep(poll)
+				// changes may have been missed while not listening
+				notify()
+			}
+		}()
+	}
+
+	changed := s.persist.Changed()
+	t := time.NewTicker(poll)
+	defer t.Stop()
+	last := int64(-1)
+	for {
+		if last < 0 {
+			// start from now, streams catch up on their own when subscribing
+			_, newest, err := s.persist.ChangeRange()
+			if err != nil {
+				log.Printf("could not read the change journal: %v", err)
+			} else {
+				last = newest
+			}
+		}
+		for last >= 0 {
+			changes, err := s.persist.ListChangesAfter(last, maxChangeLimit)
+			if err != nil {
+				log.Printf("could not read the change journal: %v", err)
+				break
+			}
+			for _, c := range changes {
+				s.publish(c)
+				last = c.ID
+			}
+			if len(changes) < maxChangeLimit {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-wake:
+		case <-changed:
+		}
+	}
+}
+
+// eventStream sends events to one client.
+type eventStream interface {
+	send(c persist.Change) error
+	heartbeat() error
+}
+
+type sseStream struct {
+	c *gin.Context
+}
+
+func (st sseStream) send(ch persist.Change) error {
+	err := sse.Encode(st.c.Writer, sse.Event{
+		Id:    strconv.FormatInt(ch.ID, 10),
+		Event: eventName(ch),
+		Data:  ch,
+	})
+	st.c.Writer.Flush()
+	return err
+}
+
+func (st sseStream) heartbeat() error {
+	_, err := st.c.Writer.WriteString(": ping\n\n")
+	st.c.Writer.Flush()
+	return err
+}
+
+type wsStream struct {
+	ws *websocket.Conn
+}
+
+// wsEvent is an event sent over a WebSocket.
+type wsEvent struct {
+	Type   string          `json:"type"`
+	Change *persist.Change `json:"change,omitempty"`
+}
+
+func (st wsStream) send(c persist.Change) error {
+	return websocket.JSON.Send(st.ws, wsEvent{Type: eventName(c), Change: &c})
+}
+
+func (st wsStream) heartbeat() error {
+	return websocket.JSON.Send(st.ws, wsEvent{Type: "ping"})
+}
+
+// eventName is the type of the event for c, like "file.create".
+func eventName(c persist.Change) string {
+	return c.Kind + "." + c.Action
+}
+
+// Events streams what happens to the caller's files and folders, and to
+// those shared with them, as they change. It speaks Server-Sent Events, or
+// WebSocket when asked to upgrade. Each event is a change of the journal, so
+// a client that reconnects with Last-Event-ID or ?cursor= gets what it
+// missed first, like ListChanges would return it. Browsers, which can't set
+// headers on either, authenticate with a ticket from EventTicket.
+func (s *Server) Events(c *gin.Context) {
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	cursor := int64(-1)
+	v := c.GetHeader("Last-Event-ID")
+	if v == "" {
+		v = c.Query("cursor")
+	}
+	if v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, Response{
+				Message: "invalid cursor",
+				Error:   "cursor must be the id of an earlier event",
+			})
+			return
+		}
+		cursor = n
+	}
+	if cursor >= 0 {
+		oldest, _, err := s.persist.ChangeRange()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, Response{
+				Message: "could not list changes",
+				Error:   err.Error(),
+			})
+			return
+		}
+		if cursor+1 < oldest {
+			c.JSON(http.StatusGone, Response{
+				Message: "cursor expired",
+				Error:   "the changes after the cursor are no longer kept, list everything again",
+			})
+			return
+		}
+	}
+
+	sharedFolders, err := s.persist.SharedFolderTree(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not list shared folders",
+			Error:   err.Error(),
+		})
+		return
+	}
+	// subscribed before catching up, so nothing falls in between
+	sub := s.events.subscribe(uid, sharedFolders)
+	defer s.events.unsubscribe(sub)
+
+	follow := func(ctx context.Context, st eventStream) {
+		if err := s.followEvents(ctx, st, sub, sharedFolders, cursor); err != nil && ctx.Err() == nil {
+			log.Printf("event stream for %d ended: %v", uid, err)
+		}
+	}
+
+	if strings.EqualFold(c.GetHeader("Upgrade"), "websocket") {
+		websocket.Server{
+			Handshake: eventsHandshake,
+			Handler: func(ws *websocket.Conn) {
+				ctx, cancel := context.WithCancel(c.Request.Context())
+				defer cancel()
+				// nothing is expected from the client, reading notices it leaving
+				go func() {
+					var msg string
+					for websocket.Message.Receive(ws, &msg) == nil {
+					}
+					cancel()
+				}()
+				follow(ctx, wsStream{ws})
+			},
+		}.ServeHTTP(c.Writer, c.Request)
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	// tell nginx not to buffer the stream
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+	follow(c.Request.Context(), sseStream{c})
+}
+
+// followEvents sends the changes after cursor from the journal, then those
+// published to sub, until ctx is done or the stream fails. A negative cursor
+// only follows new changes.
+func (s *Server) followEvents(ctx context.Context, st eventStream, sub *eventSub, sharedFolders []string, cursor int64) error {
+	for cursor >= 0 {
+		changes, err := s.persist.ListChanges(sub.uid, sharedFolders, cursor, maxChangeLimit)
+		if err != nil {
+			return err
+		}
+		for _, ch := range changes {
+			if err := st.send(ch); err != nil {
+				return err
+			}
+			cursor = ch.ID
+		}
+		if len(changes) < maxChangeLimit {
+			break
+		}
+	}
+
+	t := time.NewTicker(eventHeartbeat)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			if err := st.heartbeat(); err != nil {
+				return err
+			}
+		case ch, ok := <-sub.ch:
+			if !ok {
+				return errors.New("stream fell too far behind")
+			}
+			if ch.ID <= cursor {
+				continue
+			}
+			if err := st.send(ch); err != nil {
+				return err
+			}
+			cursor = ch.ID
+		}
+	}
+}
+
+type EventTicketResponse struct {
+	Ticket    string    `json:"ticket"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// EventTicket hands out a ticket that opens event streams as ?ticket=, for
+// EventSource and WebSocket clients that can't send the Authorization
+// header. It is tied to the session, and only lasts EVENTTICKETTTL, so ask
+// for a new one when reconnecting.
+func (s *Server) EventTicket(c *gin.Context) {
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	sessId, _ := c.Request.Context().Value(shared.SESSIONCOOKIENAME).(string)
+	if sessId == "" {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "could not make a ticket",
+			Error:   "tickets are only handed out to sessions",
+		})
+		return
+	}
+	expires := time.Now().Add(EVENTTICKETTTL).Truncate(time.Second)
+	c.JSON(http.StatusOK, EventTicketResponse{
+		Ticket:    eventTicket(uid, sessId, expires),
+		ExpiresAt: expires,
+	})
+}
+
+// eventTicket signs that the session sessId of uid may open streams until
+// expires.
+func eventTicket(uid int, sessId string, expires time.Time) string {
+	v := strconv.Itoa(uid) + "." + sessId + "." + strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, SIGNINGKEY)
+	mac.Write([]byte("events\x00" + v))
+	return v + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseEventTicket returns the user and session a ticket was handed to, if it
+// is valid at now.
+func parseEventTicket(ticket string, now time.Time) (int, string, bool) {
+	parts := strings.Split(ticket, ".")
+	if len(parts) != 4 {
+		return 0, "", false
+	}
+	uid, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", false
+	}
+	n, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	expires := time.Unix(n, 0)
+	if !now.Before(expires) || !hmac.Equal([]byte(ticket), []byte(eventTicket(uid, parts[1], expires))) {
+		return 0, "", false
+	}
+	return uid, parts[1], true
+}
+
+// streamCheck authenticates the event stream with a ?ticket= from
+// EventTicket, or like any other route.
+func (s *Server) streamCheck(c *gin.Context) {
+	ticket := c.Query("ticket")
+	if ticket == "" {
+		s.sessionCheck(c)
+		return
+	}
+	uid, sessId, ok := parseEventTicket(ticket, time.Now())
+	if !ok {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	// the session may have been revoked since
+	sessions, err := s.sessions.ListActive(uint(uid), time.Now())
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	for i := range sessions {
+		if sessions[i].ID == sessId {
+			s.useSession(c, &sessions[i])
+			return
+		}
+	}
+	c.AbortWithStatus(http.StatusUnauthorized)
+}
+
+// eventsHandshake refuses WebSockets opened by pages from other origins,
+// which would otherwise ride on the session cookie.
+func eventsHandshake(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	if u.Host != r.Host && !slices.Contains(allowOrigins(), origin) {
+		return errors.New("origin not allowed")
+	}
+	config.Origin = u
+	return nil
+}
@@ -3,18 +3,17 @@ package handlers
 import (
 	"avenue/backend/persist"
 	"avenue/backend/shared"
-	"bufio"
+	"avenue/backend/storage"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"mime"
 	"net/http"
-	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/spf13/afero"
 )
 
 type UploadReq struct {
@@ -28,123 +27,270 @@ type Response struct {
 	Error   string `json:"error"`
 }
 
-func (s *Server) Upload(c *gin.Context) {
+var (
+	// MAXUPLOADSIZE is the largest request body accepted by Upload, in bytes.
+	MAXUPLOADSIZE = shared.GetEnvInt64("MAX_UPLOAD_SIZE", 10<<30)
+)
+
+// multipartOverhead is how much larger than its file a multipart upload may
+// be, before the file is known to be too large from Content-Length alone.
+const multipartOverhead = 64 << 10
+
+// multipartUpload is a multipart request whose "file" part has been staged.
+type multipartUpload struct {
+	staged   storage.StagedBlob
+	filename string
+	fields   map[string]string
+}
 
-	// TODO: stream file uploads
-	// TODO: file size
-	userId, err := shared.GetUserIdFromContext(c.Request.Context())
+// discard drops the staged content unless it was committed.
+func (u *multipartUpload) discard() {
+	_ = u.staged.Discard()
+}
+
+// readMultipartUpload streams the "file" part of a multipart request into the
+// blob store's staging area, enforcing MAXUPLOADSIZE and uid's quota. Other
+// parts are collected as small form fields. If it fails an error response
+// has already been written and ok is false.
+func (s *Server) readMultipartUpload(c *gin.Context, uid int) (up *multipartUpload, ok bool) {
+	remaining, limited, err := s.remainingQuota(uid)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, Response{
-			Message: "could not get user id",
+			Message: "could not check quota",
 			Error:   err.Error(),
 		})
-		return
+		return nil, false
+	}
+	// the body is a little larger than the file, for the multipart framing
+	// and form fields
+	size := c.Request.ContentLength - multipartOverhead
+	if c.Request.ContentLength > MAXUPLOADSIZE {
+		c.JSON(http.StatusRequestEntityTooLarge, Response{
+			Message: "file is too large",
+		})
+		return nil, false
+	}
+	if limited && (remaining == 0 || size > remaining) {
+		c.JSON(http.StatusRequestEntityTooLarge, Response{
+			Message: "file is too large",
+			Error:   ErrQuotaExceeded.Error(),
+		})
+		return nil, false
 	}
 
-	// Get uploaded file from multipart form
-	file, err := c.FormFile("file")
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, MAXUPLOADSIZE)
+	mr, err := c.Request.MultipartReader()
 	if err != nil {
-		log.Printf("error gettting file from form: %v", err)
-		c.JSON(http.StatusTeapot, Response{
-			Message: "could not get file from form",
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "expected a multipart upload",
 			Error:   err.Error(),
 		})
-		return
+		return nil, false
 	}
 
-	// Get parent folder ID from form (optional)
-	parent := c.PostForm("parent")
+	up = &multipartUpload{fields: map[string]string{}}
+	defer func() {
+		if !ok && up.staged != nil {
+			up.discard()
+		}
+	}()
 
-	// Extract filename and extension
-	filename := file.Filename
-	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			uploadError(c, "could not read multipart upload", bodyError{err})
+			return up, false
+		}
 
-	// Open uploaded file
-	src, err := file.Open()
-	if err != nil {
-		log.Printf("it was the other one: %v", err)
+		switch part.FormName() {
+		case "file":
+			if up.staged != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Message: "only one file may be uploaded at a time",
+				})
+				return up, false
+			}
+			up.filename = filepath.Base(part.FileName())
+			var r io.Reader = bodyReader{part}
+			if limited {
+				r = &quotaReader{r: r, remaining: remaining}
+			}
+			up.staged, err = s.blobs.Stage(r)
+			if err != nil {
+				uploadError(c, "could not write to file", err)
+				return up, false
+			}
+		default:
+			b, err := io.ReadAll(io.LimitReader(part, 1024))
+			if err != nil {
+				uploadError(c, "could not read "+part.FormName(), bodyError{err})
+				return up, false
+			}
+			up.fields[part.FormName()] = string(b)
+		}
+		part.Close()
+	}
+
+	if up.staged == nil {
 		c.JSON(http.StatusBadRequest, Response{
-			Message: "could not open uploaded file",
-			Error:   err.Error(),
+			Message: "could not get file from form",
+			Error:   "missing file part",
 		})
+		return up, false
+	}
+	return up, true
+}
+
+// Upload streams a multipart upload straight into the blob store. The "file"
+// part is staged while its size and sha256 are computed, and only once it is
+// complete is it stored under its hash and recorded in the db.
+func (s *Server) Upload(c *gin.Context) {
+	var fileId string
+	defer func() {
+		s.audit(c, persist.AuditEvent{Action: "file.upload", TargetType: "file", TargetID: fileId})
+	}()
+
+	uid, ok := requestUserId(c)
+	if !ok {
 		return
 	}
-	defer src.Close()
 
-	// Create file record in database
-	fileId, err := s.persist.CreateFile(&persist.File{
-		Name:      filename,
-		Extension: ext,
-		Parent:    parent,
-	})
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, Response{
-			Message: "could not create file record",
-			Error:   err.Error(),
-		})
+	up, ok := s.readMultipartUpload(c, uid)
+	if !ok {
+		return
+	}
+	defer up.discard()
+
+	// Get parent folder ID from form (optional)
+	parent := up.fields["parent"]
+	if parent == "-1" {
+		parent = ""
+	}
+	// uploads into a shared folder count against its owner's quota
+	owner, ok := s.authorizeParent(c, uid, parent)
+	if !ok {
 		return
 	}
 
-	// Ensure user directory exists
-	exists, err := afero.DirExists(s.fs, fmt.Sprintf("/%s", userId))
+	f, err := s.saveContent(up.staged, owner, uid, parent, up.filename, nil)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, Response{
-			Message: "error checking user directory",
-			Error:   err.Error(),
-		})
+		saveError(c, err)
 		return
 	}
-	if !exists {
-		err := s.fs.Mkdir(fmt.Sprintf("/%s", userId), os.ModePerm)
+	fileId = f.ID
+
+	c.Status(http.StatusCreated)
+}
+
+// saveContent stores staged content as a new file of ownerId called name in
+// the folder parent, or as a new version of replaces when it is set. It
+// fails with ErrQuotaExceeded if it doesn't fit in the owner's quota.
+func (s *Server) saveContent(staged storage.StagedBlob, ownerId, uploaderId int, parent, name string, replaces *persist.File) (*persist.File, error) {
+	// checked again now the size is known, others may have taken the room
+	unlock, err := s.lockQuota(ownerId, staged.Size())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := s.commitBlob(staged); err != nil {
+		return nil, err
+	}
+
+	var f *persist.File
+	if replaces != nil {
+		var err error
+		f, err = s.persist.AddFileVersion(ownerId, replaces.ID, uploaderId, staged.Hash(), staged.Size())
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, Response{
-				Message: "error could not make dir",
-				Error:   err.Error(),
-			})
-			return
+			return nil, err
+		}
+		s.pruneVersions(ownerId, f.ID)
+	} else {
+		f = &persist.File{
+			Name:       name,
+			Extension:  strings.ToLower(strings.TrimPrefix(filepath.Ext(name), ".")),
+			FileSize:   int(staged.Size()),
+			Sha256:     staged.Hash(),
+			Parent:     parent,
+			OwnerId:    ownerId,
+			UploaderId: uploaderId,
+		}
+		if _, err := s.persist.CreateFile(f); err != nil {
+			return nil, err
 		}
 	}
 
-	// Create destination file
-	dstPath := fmt.Sprintf("/%s/%s", userId, fileId)
-	dst, err := s.fs.Create(dstPath)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, Response{
-			Message: "could not create file",
-			Error:   err.Error(),
-		})
-		return
+	s.refreshUsage(ownerId)
+	go s.indexContent(f.Sha256, f.Extension)
+	s.queueThumbnail(f.Sha256, f.Extension)
+	return f, nil
+}
+
+// bodyError is a failure to read the request body, as opposed to one storing
+// what was read.
+type bodyError struct {
+	err error
+}
+
+func (e bodyError) Error() string { return e.err.Error() }
+func (e bodyError) Unwrap() error { return e.err }
+
+// bodyReader wraps the errors reading the request body in bodyError.
+type bodyReader struct {
+	r io.Reader
+}
+
+func (b bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = bodyError{err}
 	}
-	defer dst.Close()
+	return n, err
+}
 
-	// Copy file data
-	size, err := io.Copy(dst, src)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, Response{
-			Message: "could not write to file",
+// uploadError answers a failed upload: a 413 if the body went over
+// MAXUPLOADSIZE or the quota, a 400 if the body couldn't be read, and a 500
+// if what was read couldn't be stored.
+func uploadError(c *gin.Context, msg string, err error) {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) || errors.Is(err, ErrQuotaExceeded) {
+		c.JSON(http.StatusRequestEntityTooLarge, Response{
+			Message: "file is too large",
 			Error:   err.Error(),
 		})
 		return
 	}
+	status := http.StatusInternalServerError
+	if errors.As(err, &bodyError{}) {
+		status = http.StatusBadRequest
+	}
+	c.JSON(status, Response{
+		Message: msg,
+		Error:   err.Error(),
+	})
+}
 
-	// Update file size in database
-	err = s.persist.UpdateFile(persist.File{
-		ID:       fileId,
-		FileSize: int(size),
-	}, []string{"file_size"})
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, Response{
-			Message: "could not update file size",
+// saveError answers a failed saveContent.
+func saveError(c *gin.Context, err error) {
+	if errors.Is(err, ErrQuotaExceeded) {
+		c.JSON(http.StatusRequestEntityTooLarge, Response{
+			Message: "file is too large",
 			Error:   err.Error(),
 		})
 		return
 	}
-
-	c.Status(http.StatusCreated)
+	lookupError(c, "file", err)
 }
 
 func (s *Server) ListFiles(c *gin.Context) {
-	files, err := s.persist.ListFiles()
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	files, err := s.persist.ListFiles(uid)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, Response{
 			Message: "could not list files",
@@ -155,33 +301,24 @@ func (s *Server) ListFiles(c *gin.Context) {
 	c.JSON(http.StatusOK, files)
 }
 
+// GetFile serves the raw bytes of a file. Range, If-None-Match and
+// If-Modified-Since are handled by http.ServeContent. Pass ?inline=true to get
+// an inline Content-Disposition, e.g. for playing video in the browser.
 func (s *Server) GetFile(c *gin.Context) {
-	userId, err := shared.GetUserIdFromContext(c.Request.Context())
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, Response{
-			Message: "could not get user id",
-			Error:   err.Error(),
-		})
+	if c.Request.Method == http.MethodGet {
+		defer s.audit(c, persist.AuditEvent{Action: "file.download", TargetType: "file", TargetID: c.Param("fileID")})
+	}
+
+	uid, ok := requestUserId(c)
+	if !ok {
 		return
 	}
-	log.Printf("user id: %s", c.Param("fileID"))
-	file, err := s.persist.GetFileByID(c.Param("fileID"))
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, Response{
-			Message: "could not get file",
-			Error:   err.Error(),
-		})
+	file, ok := s.authorizeFile(c, uid, c.Param("fileID"), persist.PermissionView)
+	if !ok {
 		return
 	}
 
-	c.Header("Content-Type", "text/event-stream")
-	c.Header("Cache-Control", "no-cache")
-	c.Header("Connection", "keep-alive")
-	c.Header("Transfer-Encoding", "chunked")
-
-	filePath := fmt.Sprintf("/%s/%s", userId, file.ID)
-	log.Printf("getting file: %v", filePath)
-	fileData, err := s.fs.Open(filePath)
+	fileData, err := s.blobs.Open(file.Sha256)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, Response{
 			Message: "could not read file",
@@ -191,57 +328,94 @@ func (s *Server) GetFile(c *gin.Context) {
 	}
 	defer fileData.Close()
 
-	f := bufio.NewReader(fileData)
-	b := make([]byte, 4096)
-	for {
-		n, err := f.Read(b)
-		if n > 0 {
-			c.SSEvent("data", b)
-		}
-		if errors.Is(err, io.EOF) {
-			break
-		} else if err != nil {
-			c.JSON(http.StatusInternalServerError, Response{
-				Message: "error reading bufio",
-				Error:   err.Error(),
-			})
-			return
-		}
+	serveFile(c, file, fileData)
+}
+
+// serveFile writes content as the body of a download of f.
+func serveFile(c *gin.Context, f *persist.File, content io.ReadSeeker) {
+	disposition := "attachment"
+	if inline, _ := strconv.ParseBool(c.Query("inline")); inline {
+		disposition = "inline"
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": f.Name}))
+
+	// leaving Content-Type unset lets ServeContent sniff it from the content
+	if ct := mime.TypeByExtension("." + f.Extension); ct != "" && f.Extension != "" {
+		c.Header("Content-Type", ct)
+	}
+	if f.Sha256 != "" {
+		c.Header("ETag", fmt.Sprintf("%q", f.Sha256))
 	}
+	c.Header("Cache-Control", "private, no-cache")
 
-	c.JSON(http.StatusOK, file)
+	http.ServeContent(c.Writer, c.Request, f.Name, fileModTime(f), content)
 }
 
-func (s *Server) DeleteFile(c *gin.Context) {
-	userId, err := shared.GetUserIdFromContext(c.Request.Context())
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, Response{
-			Message: "could not get user id",
-			Error:   err.Error(),
-		})
+type UpdateFileReq struct {
+	Name   *string `json:"name" validate:"omitempty,min=1,max=255"`
+	Parent *string `json:"parent"`
+}
+
+// UpdateFile renames a file and/or moves it into another folder.
+func (s *Server) UpdateFile(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "file.update", TargetType: "file", TargetID: c.Param("fileID")})
+
+	uid, ok := requestUserId(c)
+	if !ok {
 		return
 	}
-	f, err := s.persist.GetFileByID(c.Param("fileID"))
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, Response{
-			Message: "error getting file",
+	var req UpdateFileReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "could not marshal all data to json",
 			Error:   err.Error(),
 		})
 		return
 	}
-	if err = s.fs.Remove(fmt.Sprintf("/%s/%s", userId, f.ID)); err != nil {
-		c.JSON(http.StatusInternalServerError, Response{
-			Message: "error deleting file from file system",
+	if err := validate.Struct(req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "invalid file update",
 			Error:   err.Error(),
 		})
 		return
 	}
+	file, ok := s.authorizeFile(c, uid, c.Param("fileID"), persist.PermissionEdit)
+	if !ok {
+		return
+	}
+	if req.Parent != nil {
+		if *req.Parent == "-1" {
+			*req.Parent = ""
+		}
+		if !s.authorizeMove(c, uid, file.OwnerId, *req.Parent) {
+			return
+		}
+	}
+
+	f, err := s.persist.UpdateOwnedFile(file.OwnerId, file.ID, req.Name, req.Parent)
+	if err != nil {
+		lookupError(c, "file", err)
+		return
+	}
 
-	if err = s.persist.DeleteFile(c.Param("fileID")); err != nil {
-		c.JSON(http.StatusInternalServerError, Response{
-			Message: "error deleting file from db",
-			Error:   err.Error(),
-		})
+	c.JSON(http.StatusOK, f)
+}
+
+// DeleteFile moves a file into the trash. It is only removed for good once the
+// trash is emptied or the janitor purges it.
+func (s *Server) DeleteFile(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "file.delete", TargetType: "file", TargetID: c.Param("fileID")})
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	file, ok := s.authorizeFile(c, uid, c.Param("fileID"), persist.PermissionEdit)
+	if !ok {
+		return
+	}
+	if err := s.persist.TrashFile(file.OwnerId, file.ID); err != nil {
+		lookupError(c, "file", err)
 		return
 	}
 
@@ -2,7 +2,7 @@ package handlers
 
 import (
 	"avenue/backend/persist"
-	"avenue/backend/shared"
+	"errors"
 	"net/http"
 	"strconv"
 
@@ -24,12 +24,13 @@ type CreateFolderReq struct {
 }
 
 func (s *Server) CreateFolder(c *gin.Context) {
-	userId, err := shared.GetUserIdFromContext(c.Request.Context())
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, Response{
-			Message: "could not get user id",
-			Error:   err.Error(),
-		})
+	var folderId string
+	defer func() {
+		s.audit(c, persist.AuditEvent{Action: "folder.create", TargetType: "folder", TargetID: folderId})
+	}()
+
+	uid, ok := requestUserId(c)
+	if !ok {
 		return
 	}
 	var req CreateFolderReq
@@ -40,26 +41,18 @@ func (s *Server) CreateFolder(c *gin.Context) {
 		})
 		return
 	}
-	uid, err := strconv.Atoi(userId)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, Response{
-			Message: "user id not an int",
-			Error:   err.Error(),
-		})
-		return
+	// top level folders have an empty parent
+	if req.Parent == "-1" {
+		req.Parent = ""
 	}
-	_, err = s.persist.GetFolder(req.Parent)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, Response{
-			Message: "parent folder must exist",
-			Error:   err.Error(),
-		})
+	owner, ok := s.authorizeParent(c, uid, req.Parent)
+	if !ok {
 		return
 	}
 
-	_, err = s.persist.CreateFolder(&persist.Folder{
+	folderId, err := s.persist.CreateFolder(&persist.Folder{
 		Name:    req.Name,
-		OwnerId: uid,
+		OwnerId: owner,
 		Parent:  req.Parent,
 	})
 	if err != nil {
@@ -73,8 +66,20 @@ func (s *Server) CreateFolder(c *gin.Context) {
 }
 
 func (s *Server) ListFolderContents(c *gin.Context) {
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
 	folderID := c.Param("folderID")
-	folds, err := s.persist.ListChildFolder(folderID)
+	owner := uid
+	if folderID != "-1" {
+		f, ok := s.authorizeFolder(c, uid, folderID, persist.PermissionView)
+		if !ok {
+			return
+		}
+		owner = f.OwnerId
+	}
+	folds, err := s.persist.ListChildFolder(owner, folderID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, Response{
 			Message: "Internal server error",
@@ -82,7 +87,7 @@ func (s *Server) ListFolderContents(c *gin.Context) {
 		})
 		return
 	}
-	files, err := s.persist.ListChildFile(folderID)
+	files, err := s.persist.ListChildFile(owner, folderID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, Response{
 			Message: "Internal server error",
@@ -101,6 +106,102 @@ func (s *Server) ListFolderContents(c *gin.Context) {
 	c.JSON(http.StatusOK, x)
 }
 
+type UpdateFolderReq struct {
+	Name   *string `json:"name" validate:"omitempty,min=1,max=255"`
+	Parent *string `json:"parent"`
+}
+
+// UpdateFolder renames a folder and/or moves it under a new parent.
+func (s *Server) UpdateFolder(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "folder.update", TargetType: "folder", TargetID: c.Param("folderID")})
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	var req UpdateFolderReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "could not marshal all data to json",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "invalid folder update",
+			Error:   err.Error(),
+		})
+		return
+	}
+	folder, ok := s.authorizeFolder(c, uid, c.Param("folderID"), persist.PermissionEdit)
+	if !ok {
+		return
+	}
+	if req.Parent != nil {
+		if *req.Parent == "-1" {
+			*req.Parent = ""
+		}
+		if !s.authorizeMove(c, uid, folder.OwnerId, *req.Parent) {
+			return
+		}
+	}
+
+	f, err := s.persist.UpdateFolder(folder.OwnerId, folder.FolderID, req.Name, req.Parent)
+	if errors.Is(err, persist.ErrFolderCycle) {
+		c.JSON(http.StatusConflict, Response{
+			Message: "could not move folder",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		lookupError(c, "folder", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, f)
+}
+
+// DeleteFolder moves a folder and everything in it into its owner's trash.
+// With ?permanent=true the whole tree is deleted right away, which takes a
+// co-owner.
+func (s *Server) DeleteFolder(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "folder.delete", TargetType: "folder", TargetID: c.Param("folderID")})
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+
+	permanent, _ := strconv.ParseBool(c.Query("permanent"))
+	need := persist.PermissionEdit
+	if permanent {
+		need = persist.PermissionManage
+	}
+	folder, ok := s.authorizeFolder(c, uid, c.Param("folderID"), need)
+	if !ok {
+		return
+	}
+
+	if permanent {
+		if _, err := s.persist.DeleteFolderTree(folder.OwnerId, folder.FolderID); err != nil {
+			lookupError(c, "folder", err)
+			return
+		}
+		s.refreshUsage(folder.OwnerId)
+		c.Status(http.StatusOK)
+		return
+	}
+
+	if err := s.persist.TrashFolder(folder.OwnerId, folder.FolderID); err != nil {
+		lookupError(c, "folder", err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
 // func mustSet(json, key string, val interface{}) string {
 // 	ret, err := sjson.Set(json, key, val)
 // 	if err != nil {
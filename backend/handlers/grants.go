@@ -0,0 +1,345 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"avenue/backend/persist"
+
+	"github.com/gin-gonic/gin"
+)
+
+type CreateGrantReq struct {
+	// Exactly one of Email and GroupID says who the folder is shared with.
+	Email   string `json:"email" validate:"omitempty,email"`
+	GroupID string `json:"group_id"`
+	Role    string `json:"role" validate:"required,oneof=viewer editor co-owner"`
+}
+
+// CreateFolderGrant shares a folder, and everything below it, with a user or
+// group. It takes a co-owner.
+func (s *Server) CreateFolderGrant(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "folder.grant.create", TargetType: "folder", TargetID: c.Param("folderID")})
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	var req CreateGrantReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "could not marshal all data to json",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "invalid grant",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if (req.Email == "") == (req.GroupID == "") {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "invalid grant",
+			Error:   "exactly one of email and group_id is required",
+		})
+		return
+	}
+
+	folder, ok := s.authorizeFolder(c, uid, c.Param("folderID"), persist.PermissionManage)
+	if !ok {
+		return
+	}
+
+	grant := &persist.FolderGrant{
+		FolderID:  folder.FolderID,
+		OwnerId:   folder.OwnerId,
+		Role:      req.Role,
+		CreatedBy: uid,
+	}
+	if req.Email != "" {
+		u, err := s.persist.GetUserByEmail(req.Email)
+		if err != nil {
+			lookupError(c, "user", err)
+			return
+		}
+		grantee := int(u.ID)
+		if grantee == folder.OwnerId {
+			c.JSON(http.StatusBadRequest, Response{
+				Message: "invalid grant",
+				Error:   "the owner already has full access",
+			})
+			return
+		}
+		grant.UserID = &grantee
+	} else {
+		// only groups the caller can see, others may be full of strangers
+		g, err := s.persist.GetVisibleGroup(uid, req.GroupID)
+		if err != nil {
+			lookupError(c, "group", err)
+			return
+		}
+		grant.GroupID = &g.ID
+	}
+
+	if _, err := s.persist.CreateFolderGrant(grant); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not share folder",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, grant)
+}
+
+func (s *Server) ListFolderGrants(c *gin.Context) {
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	folder, ok := s.authorizeFolder(c, uid, c.Param("folderID"), persist.PermissionManage)
+	if !ok {
+		return
+	}
+
+	grants, err := s.persist.ListFolderGrants(folder.FolderID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not list grants",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, grants)
+}
+
+func (s *Server) DeleteFolderGrant(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "folder.grant.delete", TargetType: "folder", TargetID: c.Param("folderID"), Detail: "grant " + c.Param("grantID")})
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	folder, ok := s.authorizeFolder(c, uid, c.Param("folderID"), persist.PermissionManage)
+	if !ok {
+		return
+	}
+
+	if err := s.persist.DeleteFolderGrant(folder.FolderID, c.Param("grantID")); err != nil {
+		lookupError(c, "grant", err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// ListSharedWithMe lists the folders other users shared with the caller.
+func (s *Server) ListSharedWithMe(c *gin.Context) {
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+
+	folders, err := s.persist.ListSharedWithUser(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not list shared folders",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, folders)
+}
+
+type CreateGroupReq struct {
+	Name string `json:"name" validate:"required,min=1,max=255"`
+}
+
+func (s *Server) CreateGroup(c *gin.Context) {
+	var groupId string
+	defer func() {
+		s.audit(c, persist.AuditEvent{Action: "group.create", TargetType: "group", TargetID: groupId})
+	}()
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	var req CreateGroupReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "could not marshal all data to json",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "invalid group",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	g := &persist.Group{Name: req.Name, OwnerId: uid}
+	groupId, err := s.persist.CreateGroup(g)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not create group",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, g)
+}
+
+// ListGroups lists the groups the caller owns or belongs to.
+func (s *Server) ListGroups(c *gin.Context) {
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+
+	groups, err := s.persist.ListGroups(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not list groups",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, groups)
+}
+
+func (s *Server) DeleteGroup(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "group.delete", TargetType: "group", TargetID: c.Param("groupID")})
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+
+	if err := s.persist.DeleteGroup(uid, c.Param("groupID")); err != nil {
+		lookupError(c, "group", err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) ListGroupMembers(c *gin.Context) {
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	g, err := s.persist.GetOwnedGroup(uid, c.Param("groupID"))
+	if err != nil {
+		lookupError(c, "group", err)
+		return
+	}
+
+	members, err := s.persist.ListGroupMembers(g.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not list group members",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, members)
+}
+
+type AddGroupMemberReq struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+func (s *Server) AddGroupMember(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "group.member.add", TargetType: "group", TargetID: c.Param("groupID")})
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	var req AddGroupMemberReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "could not marshal all data to json",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "invalid group member",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	g, err := s.persist.GetOwnedGroup(uid, c.Param("groupID"))
+	if err != nil {
+		lookupError(c, "group", err)
+		return
+	}
+	u, err := s.persist.GetUserByEmail(req.Email)
+	if err != nil {
+		lookupError(c, "user", err)
+		return
+	}
+
+	err = s.persist.AddGroupMember(g.ID, int(u.ID))
+	if errors.Is(err, persist.ErrAlreadyMember) {
+		c.JSON(http.StatusConflict, Response{
+			Message: "could not add group member",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not add group member",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.Status(http.StatusCreated)
+}
+
+func (s *Server) RemoveGroupMember(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "group.member.remove", TargetType: "group", TargetID: c.Param("groupID"), Detail: "user " + c.Param("userID")})
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	memberId, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "user id not an int",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	g, err := s.persist.GetOwnedGroup(uid, c.Param("groupID"))
+	if err != nil {
+		lookupError(c, "group", err)
+		return
+	}
+	if err := s.persist.RemoveGroupMember(g.ID, memberId); err != nil {
+		lookupError(c, "group member", err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -2,6 +2,8 @@ package handlers
 
 import (
 	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -11,6 +13,7 @@ import (
 
 	"avenue/backend/persist"
 	"avenue/backend/shared"
+	"avenue/backend/storage"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -20,20 +23,47 @@ import (
 // Server holds dependencies for the HTTP server.
 type Server struct {
 	// Add dependencies here, e.g., a database connection
-	router  *gin.Engine
-	persist *persist.Persist
-	fs      afero.Fs
+	router   *gin.Engine
+	persist  *persist.Persist
+	sessions persist.SessionStore
+	blobs    storage.BlobStore
+	// fs is scratch space for uploads that are still in progress
+	fs          afero.Fs
+	uploadLocks *keyedMutex
+	blobLocks   *keyedMutex
+	// thumbnailWake tells RunThumbnails a job was queued
+	thumbnailWake chan struct{}
+	davLocks      *davLocks
+	davLogins     *loginCache
+	shareLogins   *loginCache
+	// shareAttempts throttles guessing share link passwords
+	shareAttempts *attemptLimiter
+	events        *eventBroker
+	// webhookWake tells RunWebhooks a delivery was queued
+	webhookWake chan struct{}
 }
 
 // setupRouter creates and configures the Gin router.
-func SetupServer(p *persist.Persist) Server {
+func SetupServer(p *persist.Persist, sessions persist.SessionStore, blobs storage.BlobStore) Server {
 	r := gin.Default()
 	fs := afero.NewOsFs()
-	jailedFs := afero.NewBasePathFs(fs, "./avenuectl/temp/")
+	jailedFs := afero.NewBasePathFs(fs, shared.GetEnv("UPLOAD_STAGING_DIR", "./avenuectl/temp/"))
 	return Server{
-		fs:      jailedFs,
-		router:  r,
-		persist: p,
+		fs:          jailedFs,
+		router:      r,
+		persist:     p,
+		sessions:    sessions,
+		blobs:       blobs,
+		uploadLocks: &keyedMutex{},
+		blobLocks:   &keyedMutex{},
+
+		thumbnailWake: make(chan struct{}, 1),
+		davLocks:      &davLocks{},
+		davLogins:     &loginCache{},
+		shareLogins:   &loginCache{},
+		shareAttempts: &attemptLimiter{},
+		events:        newEventBroker(),
+		webhookWake:   make(chan struct{}, 1),
 	}
 }
 
@@ -42,35 +72,83 @@ var (
 	AUTHHEADER       = "Authorization"
 	AUTHKEY          = shared.GetEnv("AUTH_KEY", "MY-AUTH-VAL")
 	USERIDHEADER     = shared.GetEnv("USER_HEADER", "user-id")
+	// SIGNINGKEY signs the short-lived tokens handed out for share links and
+	// event streams. Instances behind the same address need the same key,
+	// without one every start makes its own.
+	SIGNINGKEY = signingKey(shared.GetEnv("SIGNING_KEY", ""))
 )
 
-func (s *Server) UserIDExists(userID string) bool {
-	// todo do a lookup in the db and see if the user exists
-	i, err := strconv.Atoi(userID)
+func signingKey(v string) []byte {
+	if v != "" {
+		return []byte(v)
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("could not make a signing key: %v", err))
+	}
+	return b
+}
+
+// requestUserId returns the authenticated caller's id. If it is missing an
+// error response has already been written and ok is false.
+func requestUserId(c *gin.Context) (int, bool) {
+	userId, err := shared.GetUserIdFromContext(c.Request.Context())
 	if err != nil {
-		log.Print(err)
-		return false
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not get user id",
+			Error:   err.Error(),
+		})
+		return 0, false
+	}
+	uid, err := strconv.Atoi(userId)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "user id not an int",
+			Error:   err.Error(),
+		})
+		return 0, false
 	}
+	return uid, true
+}
 
-	_, err = s.persist.GetUserById(i)
+// lookupError answers a failed persist lookup. Missing records, including ones
+// owned by someone else, are always a 404 so ids can't be enumerated.
+func lookupError(c *gin.Context, what string, err error) {
+	if errors.Is(err, persist.ErrNotFound) {
+		c.JSON(http.StatusNotFound, Response{
+			Message: what + " not found",
+			Error:   err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, Response{
+		Message: "could not get " + what,
+		Error:   err.Error(),
+	})
+}
+
+// activeUser returns the user with userID if they exist and may log in.
+func (s *Server) activeUser(userID string) (persist.User, bool) {
+	u, err := s.persist.GetUserByIdStr(userID)
 	if err != nil {
 		log.Print(err)
-		return false
+		return u, false
 	}
 
-	return true
+	return u, u.CanLogin
 }
 
 func (s *Server) sessionCheck(c *gin.Context) {
 	// if the auth header is present with the needed fields, we can allow them to bypass the cookie check :)
 	if h := c.GetHeader(MASTERAUTHHEADER); h != "" {
-		if u := c.GetHeader(USERIDHEADER); u != "" {
-			if h == AUTHKEY && s.UserIDExists(u) {
+		if u := c.GetHeader(USERIDHEADER); u != "" && h == AUTHKEY {
+			if user, ok := s.activeUser(u); ok {
 
 				rc := c.Request.Context()
 
 				// Add a new value to the context
 				newCtx := context.WithValue(rc, shared.USERCOOKIENAME, u)
+				newCtx = context.WithValue(newCtx, shared.USERROLENAME, user.Role)
 
 				// Update the request with the new context
 				c.Request = c.Request.WithContext(newCtx)
@@ -94,56 +172,80 @@ func (s *Server) sessionCheck(c *gin.Context) {
 		return
 	}
 
-	v, exists := Sessions[parts[1]]
-	if !exists {
+	sess, err := s.sessions.GetByToken(parts[1])
+	if err != nil {
 		c.AbortWithStatus(http.StatusUnauthorized)
 		return
 	}
 
-	if v.ExpiresAt.Unix() < time.Now().Unix() {
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
-	}
+	s.useSession(c, sess)
+}
 
-	if !v.IsValid {
+// useSession lets the request through as the user of sess, if it is still
+// active.
+func (s *Server) useSession(c *gin.Context, sess *persist.Session) {
+	now := time.Now()
+	if !sess.IsActive(now) {
 		c.AbortWithStatus(http.StatusUnauthorized)
 		return
 	}
 
-	userIdStr := fmt.Sprint(v.UserId)
+	userIdStr := fmt.Sprint(sess.UserID)
 
-	if !s.UserIDExists(userIdStr) {
+	user, ok := s.activeUser(userIdStr)
+	if !ok {
 		c.AbortWithStatus(http.StatusUnauthorized)
 		return
 	}
 
+	// slide the expiry forward, but don't write on every single request.
+	// Impersonation sessions keep their short fixed lifetime.
+	if now.Sub(sess.LastSeenAt) > sessionTouchInterval {
+		expires := now.Add(SESSIONTTL)
+		if sess.ImpersonatorID != nil {
+			expires = sess.ExpiresAt
+		}
+		if err := s.sessions.Touch(sess.ID, now, expires); err != nil {
+			log.Printf("could not touch session: %v", err)
+		}
+	}
+
 	rc := c.Request.Context()
 
 	// Add a new value to the context
 	newCtx := context.WithValue(rc, shared.USERCOOKIENAME, userIdStr)
-	// put the session data into the context
-	newCtx = context.WithValue(newCtx, shared.SESSIONCOOKIENAME, h)
+	// put the session id into the context
+	newCtx = context.WithValue(newCtx, shared.SESSIONCOOKIENAME, sess.ID)
+	newCtx = context.WithValue(newCtx, shared.USERROLENAME, user.Role)
+	if sess.ImpersonatorID != nil {
+		newCtx = context.WithValue(newCtx, shared.IMPERSONATORNAME, int(*sess.ImpersonatorID))
+	}
 
 	// Update the request with the new context
 	c.Request = c.Request.WithContext(newCtx)
 
-	log.Printf("set new ctx: %s", c.Request.Context())
 	c.Next()
 }
 
+// allowOrigins are the origins of the web app allowed to call the API.
+func allowOrigins() []string {
+	return []string{shared.GetEnv("ALLOW_ORIGIN", "http://localhost:5173"), "http://localhost:8080"}
+}
+
 func (s *Server) SetupRoutes() {
 	c := cors.Config{
-		AllowOrigins:     []string{shared.GetEnv("ALLOW_ORIGIN", "http://localhost:5173"), "http://localhost:8080"},
+		AllowOrigins:     allowOrigins(),
 		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "content-type", "Accept", "Authorization", "authorization"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "content-type", "Accept", "Authorization", "authorization", "Tus-Resumable", "Upload-Length", "Upload-Metadata", "Upload-Offset", "Range", "If-None-Match", "If-Modified-Since", "If-Range", SHAREPASSWORDHEADER, SHARETOKENHEADER},
 		AllowCredentials: false,
-		ExposeHeaders:    []string{"Content-Length"},
+		ExposeHeaders:    []string{"Content-Length", "Content-Disposition", "Content-Range", "Accept-Ranges", "ETag", "Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size", "Upload-Length", "Upload-Offset", "Upload-Expires", "Retry-After"},
 		MaxAge:           12 * time.Hour,
 	}
 
 	log.Printf("cors: %+v", c)
 
 	s.router.Use(cors.New(c))
+	s.router.Use(s.auditRequests)
 
 	unsecuredRouter := s.router.Group("")
 
@@ -151,26 +253,125 @@ func (s *Server) SetupRoutes() {
 	unsecuredRouter.POST("/login", s.Login)
 	unsecuredRouter.POST("/register", s.Register)
 
+	// -- public share link routes -- //
+	shareRouter := unsecuredRouter.Group("/s/:token", s.shareCheck)
+	unsecuredRouter.POST("/s/:token/unlock", s.UnlockShare)
+	shareRouter.GET("", s.GetShare)
+	shareRouter.GET("/download", s.DownloadShare)
+	shareRouter.GET("/folder/:folderID", s.ListSharedFolder)
+	shareRouter.GET("/folder/:folderID/download", s.DownloadSharedFolder)
+	shareRouter.GET("/file/:fileID", s.GetSharedFile)
+	shareRouter.POST("/upload", s.UploadToShare)
+
+	// -- WebDAV, authenticated with Basic auth -- //
+	for _, m := range davMethods {
+		s.router.Handle(m, DAVPREFIX, s.DAV)
+		s.router.Handle(m, DAVPREFIX+"/*path", s.DAV)
+	}
+
 	securedRouterV1 := s.router.Group("/v1")
-	securedRouterV1.Use(s.sessionCheck)
+	securedRouterV1.Use(s.sessionCheck, s.roleCheck)
 
 	securedRouterV1.GET("/ping", s.pingHandler)
+	securedRouterV1.GET("/search", s.Search)
 
 	// -- file routes -- //
 	securedRouterV1.POST("/file", s.Upload)
 	securedRouterV1.GET("/file/list", s.ListFiles)
 	securedRouterV1.GET("/file/:fileID", s.GetFile)
+	securedRouterV1.HEAD("/file/:fileID", s.GetFile)
+	securedRouterV1.PATCH("/file/:fileID", s.UpdateFile)
+	securedRouterV1.GET("/file/:fileID/thumbnail", s.GetThumbnail)
+	securedRouterV1.GET("/file/:fileID/versions", s.ListFileVersions)
+	securedRouterV1.POST("/file/:fileID/versions", s.UploadFileVersion)
+	securedRouterV1.GET("/file/:fileID/versions/:versionID", s.GetFileVersion)
+	securedRouterV1.POST("/file/:fileID/versions/:versionID/restore", s.RestoreFileVersion)
 	securedRouterV1.DELETE("/file/:fileID", s.DeleteFile)
+	securedRouterV1.POST("/file/:fileID/share", s.ShareFile)
+
+	// -- resumable upload routes -- //
+	uploads := securedRouterV1.Group("/uploads", tusHeaders)
+	uploads.OPTIONS("", s.TusOptions)
+	uploads.POST("", s.CreateUpload)
+	uploads.HEAD("/:uploadID", s.HeadUpload)
+	uploads.PATCH("/:uploadID", s.PatchUpload)
+	uploads.DELETE("/:uploadID", s.TerminateUpload)
 
 	// -- folder routes -- //
 	securedRouterV1.POST("/folder", s.CreateFolder)
 	securedRouterV1.GET("/folder/list/:folderID", s.ListFolderContents)
+	securedRouterV1.PATCH("/folder/:folderID", s.UpdateFolder)
+	securedRouterV1.DELETE("/folder/:folderID", s.DeleteFolder)
+	securedRouterV1.GET("/folder/:folderID/archive", s.DownloadFolder)
+	securedRouterV1.POST("/folder/:folderID/import", s.ImportArchive)
+	securedRouterV1.GET("/archive", s.DownloadArchive)
+	securedRouterV1.POST("/folder/:folderID/share", s.ShareFolder)
+	securedRouterV1.GET("/folder/:folderID/grants", s.ListFolderGrants)
+	securedRouterV1.POST("/folder/:folderID/grants", s.CreateFolderGrant)
+	securedRouterV1.DELETE("/folder/:folderID/grants/:grantID", s.DeleteFolderGrant)
+	securedRouterV1.GET("/shared", s.ListSharedWithMe)
+
+	// -- change routes -- //
+	securedRouterV1.GET("/changes", s.ListChanges)
+	securedRouterV1.POST("/events/ticket", s.EventTicket)
+	// the event stream is opened by browsers, which can't set headers on it
+	s.router.GET("/v1/events", s.streamCheck, s.roleCheck, s.Events)
+
+	// -- webhook routes -- //
+	securedRouterV1.POST("/webhooks", s.CreateWebhook)
+	securedRouterV1.GET("/webhooks", s.ListWebhooks)
+	securedRouterV1.GET("/webhooks/:webhookID", s.GetWebhook)
+	securedRouterV1.PATCH("/webhooks/:webhookID", s.UpdateWebhook)
+	securedRouterV1.DELETE("/webhooks/:webhookID", s.DeleteWebhook)
+	securedRouterV1.GET("/webhooks/:webhookID/deliveries", s.ListWebhookDeliveries)
+	securedRouterV1.POST("/webhooks/:webhookID/test", s.TestWebhook)
+
+	// -- group routes -- //
+	securedRouterV1.GET("/groups", s.ListGroups)
+	securedRouterV1.POST("/groups", s.CreateGroup)
+	securedRouterV1.DELETE("/groups/:groupID", s.DeleteGroup)
+	securedRouterV1.GET("/groups/:groupID/members", s.ListGroupMembers)
+	securedRouterV1.POST("/groups/:groupID/members", s.AddGroupMember)
+	securedRouterV1.DELETE("/groups/:groupID/members/:userID", s.RemoveGroupMember)
+
+	// -- share link routes -- //
+	securedRouterV1.GET("/shares", s.ListShares)
+	securedRouterV1.DELETE("/shares/:shareID", s.RevokeShare)
+
+	// -- trash routes -- //
+	securedRouterV1.GET("/trash", s.ListTrash)
+	securedRouterV1.DELETE("/trash", s.EmptyTrash)
+	securedRouterV1.POST("/trash/:itemID/restore", s.RestoreTrash)
+	securedRouterV1.DELETE("/trash/:itemID", s.PurgeTrashItem)
 
 	// --- users routes --- //
 	securedRouterV1.POST("/logout", s.Logout)
 	securedRouterV1.GET("/user/profile", s.GetProfile)
 	securedRouterV1.PUT("/user/profile", s.UpdateProfile)
 	securedRouterV1.PATCH("/user/password", s.UpdatePassword)
+	securedRouterV1.GET("/user/usage", s.GetUsage)
+	securedRouterV1.PUT("/user/versioning", s.UpdateVersioning)
+	securedRouterV1.GET("/user/sessions", s.ListSessions)
+	securedRouterV1.DELETE("/user/sessions/:sessionID", s.RevokeSession)
+	securedRouterV1.GET("/user/app-passwords", s.ListAppPasswords)
+	securedRouterV1.POST("/user/app-passwords", s.CreateAppPassword)
+	securedRouterV1.DELETE("/user/app-passwords/:appPasswordID", s.DeleteAppPassword)
+	securedRouterV1.GET("/user/access-keys", s.ListAccessKeys)
+	securedRouterV1.POST("/user/access-keys", s.CreateAccessKey)
+	securedRouterV1.DELETE("/user/access-keys/:accessKeyID", s.DeleteAccessKey)
+
+	// --- admin routes --- //
+	admin := securedRouterV1.Group("/admin", s.adminCheck)
+	admin.GET("/users", s.AdminListUsers)
+	admin.GET("/users/:userID", s.AdminGetUser)
+	admin.PATCH("/users/:userID", s.AdminUpdateUser)
+	admin.DELETE("/users/:userID", s.AdminDeleteUser)
+	admin.PUT("/users/:userID/quota", s.AdminSetQuota)
+	admin.POST("/users/:userID/password", s.AdminResetPassword)
+	admin.POST("/users/:userID/restore", s.AdminRestoreUser)
+	admin.POST("/users/:userID/impersonate", s.AdminImpersonate)
+	admin.GET("/audit", s.AdminListAudit)
+	admin.GET("/audit/export", s.AdminExportAudit)
 }
 
 func (s *Server) Run(address string) error {
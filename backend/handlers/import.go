@@ -0,0 +1,530 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"avenue/backend/persist"
+	"avenue/backend/shared"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/spf13/afero"
+)
+
+var (
+	// IMPORTMAXENTRIES is the most entries an imported archive may have.
+	IMPORTMAXENTRIES = shared.GetEnvInt64("IMPORT_MAX_ENTRIES", 10000)
+	// IMPORTMAXSIZE is the most bytes an imported archive may expand to.
+	IMPORTMAXSIZE = shared.GetEnvInt64("IMPORT_MAX_SIZE", 10<<30)
+	// IMPORTMAXRATIO is how many times its own size an imported archive may
+	// expand to, which stops zip bombs long before IMPORTMAXSIZE.
+	IMPORTMAXRATIO = shared.GetEnvInt64("IMPORT_MAX_RATIO", 200)
+)
+
+// maxImportDepth is how deep folders in an imported archive may be nested.
+const maxImportDepth = 64
+
+var (
+	ErrImportTooLarge = errors.New("archive expands to more than allowed")
+	ErrImportTooMany  = errors.New("archive has too many entries")
+)
+
+// errImportBlocked is an entry failing because a file is where it needs a
+// folder, or the other way around.
+var errImportBlocked = errors.New("a file or folder of the same name is in the way")
+
+// importConflicts are the ways ?conflict= can handle files that already
+// exist: keep both by numbering the new one, skip it, or store it as a new
+// version of the existing file.
+var importConflicts = map[string]bool{"rename": true, "skip": true, "overwrite": true}
+
+// Statuses of an imported entry.
+const (
+	ImportCreated  = "created"
+	ImportRenamed  = "renamed"
+	ImportReplaced = "replaced"
+	ImportSkipped  = "skipped"
+	ImportFailed   = "failed"
+)
+
+// ImportEntry reports what happened to one entry of an imported archive.
+type ImportEntry struct {
+	Path     string `json:"path"`
+	Status   string `json:"status"`
+	Name     string `json:"name,omitempty"`
+	FileID   string `json:"file_id,omitempty"`
+	FolderID string `json:"folder_id,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type ImportResponse struct {
+	Files   int           `json:"files"`
+	Folders int           `json:"folders"`
+	Skipped int           `json:"skipped"`
+	Failed  int           `json:"failed"`
+	Entries []ImportEntry `json:"entries"`
+	// Error is why the import stopped early. What came before it stays.
+	Error string `json:"error,omitempty"`
+}
+
+// ImportArchive expands a zip, tar or tar.gz archive sent as the request
+// body into the folder, making its folders and files. ?format= names the
+// format if it can't be told from the content, and ?conflict= is rename,
+// skip or overwrite for files that exist already. Folders that exist are
+// merged into. Folder "-1" is the caller's top level.
+func (s *Server) ImportArchive(c *gin.Context) {
+	folderID := c.Param("folderID")
+	var res ImportResponse
+	defer func() {
+		s.audit(c, persist.AuditEvent{
+			Action:     "folder.import",
+			TargetType: "folder",
+			TargetID:   folderID,
+			Detail:     fmt.Sprintf("%d files, %d folders, %d failed", res.Files, res.Folders, res.Failed),
+		})
+	}()
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	conflict := c.DefaultQuery("conflict", "rename")
+	if !importConflicts[conflict] {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "invalid conflict policy",
+			Error:   "conflict must be rename, skip or overwrite",
+		})
+		return
+	}
+	format := c.Query("format")
+	if format != "" && format != "zip" && format != "tar" && format != "tar.gz" {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "unknown archive format",
+			Error:   "format must be zip, tar or tar.gz",
+		})
+		return
+	}
+	root := folderID
+	if root == "-1" {
+		root = ""
+	}
+	owner, ok := s.authorizeParent(c, uid, root)
+	if !ok {
+		return
+	}
+	remaining, limited, err := s.remainingQuota(owner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not check quota",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	// zip needs random access, so the archive is kept in scratch space
+	f, size, ok := s.stageArchive(c, uid)
+	if !ok {
+		return
+	}
+	defer func() {
+		f.Close()
+		_ = s.fs.Remove(f.Name())
+	}()
+	if format == "" {
+		format = sniffArchive(f)
+	}
+
+	im := &importer{
+		s:        s,
+		uid:      uid,
+		owner:    owner,
+		root:     root,
+		conflict: conflict,
+		folders:  map[string]string{},
+		budget:   min(IMPORTMAXSIZE, size*IMPORTMAXRATIO),
+		quota:    remaining,
+		limited:  limited,
+	}
+	switch format {
+	case "zip":
+		err = im.zip(f, size)
+	case "tar":
+		err = im.tar(f)
+	case "tar.gz":
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(f); err == nil {
+			err = im.tar(gz)
+		}
+	default:
+		err = errors.New("the archive is not zip, tar or tar.gz")
+	}
+	res = im.res
+	if res.Entries == nil {
+		res.Entries = []ImportEntry{}
+	}
+
+	status := http.StatusOK
+	var maxErr *http.MaxBytesError
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrImportTooLarge), errors.Is(err, ErrImportTooMany), errors.Is(err, ErrQuotaExceeded), errors.As(err, &maxErr):
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, errImportInternal):
+		status = http.StatusInternalServerError
+	default:
+		status = http.StatusBadRequest
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	c.JSON(status, res)
+}
+
+// stageArchive writes the request body to scratch space. If that fails an
+// error response has already been written and ok is false.
+func (s *Server) stageArchive(c *gin.Context, uid int) (f afero.File, size int64, ok bool) {
+	if err := s.fs.MkdirAll(fmt.Sprintf("/%d", uid), os.ModePerm); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "error could not make dir",
+			Error:   err.Error(),
+		})
+		return nil, 0, false
+	}
+	f, err := s.fs.Create(fmt.Sprintf("/%d/.import-%s", uid, uuid.NewString()))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not create file",
+			Error:   err.Error(),
+		})
+		return nil, 0, false
+	}
+	size, err = io.Copy(f, bodyReader{http.MaxBytesReader(c.Writer, c.Request.Body, MAXUPLOADSIZE)})
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		_ = s.fs.Remove(f.Name())
+		uploadError(c, "could not read archive", err)
+		return nil, 0, false
+	}
+	return f, size, true
+}
+
+// sniffArchive tells the format of an archive from its first bytes, and
+// rewinds it.
+func sniffArchive(f afero.File) string {
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return ""
+	}
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return "zip"
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return "tar.gz"
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return "tar"
+	}
+	return ""
+}
+
+// importPath splits the name of an archive entry into the names of its
+// folders and itself. Names that would end up outside the target folder,
+// absolute ones or ones with "..", aren't ok.
+func importPath(name string) ([]string, bool) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") || len(name) > 1 && name[1] == ':' {
+		return nil, false
+	}
+	var parts []string
+	for _, p := range strings.Split(name, "/") {
+		switch p {
+		case "", ".":
+			continue
+		case "..":
+			return nil, false
+		}
+		parts = append(parts, p)
+	}
+	return parts, len(parts) > 0 && len(parts) <= maxImportDepth
+}
+
+// errImportInternal wraps errors of the server, not of the archive.
+var errImportInternal = errors.New("internal error")
+
+// importer expands one archive.
+type importer struct {
+	s          *Server
+	uid, owner int
+	// root is the id of the folder the archive is expanded into
+	root     string
+	conflict string
+	// folders are the ids of the folders made or found so far, by path
+	folders map[string]string
+	entries int64
+	// budget is how many more bytes the archive may expand to, quota how
+	// many more the owner may store if limited
+	budget  int64
+	quota   int64
+	limited bool
+	res     ImportResponse
+}
+
+// importEntry is an entry of an archive. Entries that are neither a file
+// nor a folder, like links and devices, are other.
+type importEntry struct {
+	name  string
+	dir   bool
+	other bool
+	open  func() (io.ReadCloser, error)
+}
+
+func (im *importer) zip(f afero.File, size int64) error {
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return err
+	}
+	if int64(len(zr.File)) > IMPORTMAXENTRIES {
+		return ErrImportTooMany
+	}
+	for _, zf := range zr.File {
+		mode := zf.Mode()
+		err := im.add(importEntry{
+			name:  zf.Name,
+			dir:   mode.IsDir(),
+			other: !mode.IsDir() && !mode.IsRegular(),
+			open:  zf.Open,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (im *importer) tar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = im.add(importEntry{
+			name:  h.Name,
+			dir:   h.Typeflag == tar.TypeDir,
+			other: h.Typeflag != tar.TypeDir && h.Typeflag != tar.TypeReg,
+			open: func() (io.ReadCloser, error) {
+				return io.NopCloser(tr), nil
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// add imports one entry and reports it. Only errors that stop the whole
+// import are returned.
+func (im *importer) add(e importEntry) error {
+	im.entries++
+	if im.entries > IMPORTMAXENTRIES {
+		return ErrImportTooMany
+	}
+	r := ImportEntry{Path: e.name}
+	parts, ok := importPath(e.name)
+	switch {
+	case !ok:
+		r.Status, r.Error = ImportFailed, "unsafe path"
+	case parts[0] == "__MACOSX" || parts[len(parts)-1] == ".DS_Store":
+		r.Status = ImportSkipped
+	case e.other:
+		r.Status, r.Error = ImportSkipped, "not a file or folder"
+	case e.dir:
+		id, err := im.mkdir(parts)
+		if err != nil && !errors.Is(err, errImportBlocked) {
+			return err
+		}
+		r.Status, r.FolderID = ImportCreated, id
+		if err != nil {
+			r.Status, r.Error = ImportFailed, err.Error()
+		}
+	default:
+		if err := im.file(e, parts, &r); err != nil {
+			return err
+		}
+	}
+
+	switch r.Status {
+	case ImportSkipped:
+		im.res.Skipped++
+	case ImportFailed:
+		im.res.Failed++
+	}
+	im.res.Entries = append(im.res.Entries, r)
+	return nil
+}
+
+// mkdir finds or makes the folders parts names and returns the id of the
+// last.
+func (im *importer) mkdir(parts []string) (string, error) {
+	id := im.root
+	for i, name := range parts {
+		key := strings.Join(parts[:i+1], "/")
+		if known, ok := im.folders[key]; ok {
+			id = known
+			continue
+		}
+		f, err := im.s.persist.GetFolderByName(im.owner, id, name)
+		if errors.Is(err, persist.ErrNotFound) {
+			if _, err := im.s.persist.GetFileByName(im.owner, id, name); err == nil {
+				return "", errImportBlocked
+			} else if !errors.Is(err, persist.ErrNotFound) {
+				return "", fmt.Errorf("%w: %v", errImportInternal, err)
+			}
+			f = &persist.Folder{Name: name, Parent: id, OwnerId: im.owner}
+			if _, err := im.s.persist.CreateFolder(f); err != nil {
+				return "", fmt.Errorf("%w: %v", errImportInternal, err)
+			}
+			im.res.Folders++
+		} else if err != nil {
+			return "", fmt.Errorf("%w: %v", errImportInternal, err)
+		}
+		im.folders[key] = f.FolderID
+		id = f.FolderID
+	}
+	return id, nil
+}
+
+// file imports a file entry, reporting to r.
+func (im *importer) file(e importEntry, parts []string, r *ImportEntry) error {
+	parent, err := im.mkdir(parts[:len(parts)-1])
+	if errors.Is(err, errImportBlocked) {
+		r.Status, r.Error = ImportFailed, err.Error()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	name := parts[len(parts)-1]
+	existing, err := im.s.persist.GetFileByName(im.owner, parent, name)
+	if errors.Is(err, persist.ErrNotFound) {
+		existing = nil
+	} else if err != nil {
+		return fmt.Errorf("%w: %v", errImportInternal, err)
+	}
+	taken := existing != nil
+	if !taken {
+		_, err := im.s.persist.GetFolderByName(im.owner, parent, name)
+		if err != nil && !errors.Is(err, persist.ErrNotFound) {
+			return fmt.Errorf("%w: %v", errImportInternal, err)
+		}
+		taken = err == nil
+	}
+
+	r.Status = ImportCreated
+	var replaces *persist.File
+	if taken {
+		switch im.conflict {
+		case "skip":
+			r.Status = ImportSkipped
+			return nil
+		case "rename":
+			if name, err = im.freeName(parent, name); err != nil {
+				return err
+			}
+			r.Status, r.Name = ImportRenamed, name
+		case "overwrite":
+			if existing == nil {
+				r.Status, r.Error = ImportFailed, errImportBlocked.Error()
+				return nil
+			}
+			r.Status, replaces = ImportReplaced, existing
+		}
+	}
+
+	content, err := e.open()
+	if err != nil {
+		r.Status, r.Error = ImportFailed, err.Error()
+		return nil
+	}
+	defer content.Close()
+	staged, err := im.s.blobs.Stage(&importReader{r: content, im: im})
+	if errors.Is(err, ErrImportTooLarge) || errors.Is(err, ErrQuotaExceeded) {
+		return err
+	}
+	if err != nil {
+		r.Status, r.Error = ImportFailed, err.Error()
+		return nil
+	}
+	defer staged.Discard()
+
+	f, err := im.s.saveContent(staged, im.owner, im.uid, parent, name, replaces)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errImportInternal, err)
+	}
+	r.FileID = f.ID
+	im.res.Files++
+	return nil
+}
+
+// freeName numbers name until no file or folder in parent has it.
+func (im *importer) freeName(parent, name string) (string, error) {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		_, err := im.s.persist.GetFileByName(im.owner, parent, candidate)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, persist.ErrNotFound) {
+			return "", fmt.Errorf("%w: %v", errImportInternal, err)
+		}
+		_, err = im.s.persist.GetFolderByName(im.owner, parent, candidate)
+		if errors.Is(err, persist.ErrNotFound) {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", errImportInternal, err)
+		}
+	}
+}
+
+// importReader counts what is read from an entry against the budget of the
+// archive and the quota of its owner, and against MAXUPLOADSIZE.
+type importReader struct {
+	r  io.Reader
+	im *importer
+	n  int64
+}
+
+func (r *importReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	r.im.budget -= int64(n)
+	r.im.quota -= int64(n)
+	switch {
+	case r.im.budget < 0 || r.n > MAXUPLOADSIZE:
+		return n, ErrImportTooLarge
+	case r.im.limited && r.im.quota < 0:
+		return n, ErrQuotaExceeded
+	}
+	return n, err
+}
@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestImportPath(t *testing.T) {
+	deep := strings.Repeat("d/", maxImportDepth) + "f"
+	for _, tc := range []struct {
+		name string
+		want []string
+		ok   bool
+	}{
+		{name: "a.txt", want: []string{"a.txt"}, ok: true},
+		{name: "docs/a.txt", want: []string{"docs", "a.txt"}, ok: true},
+		{name: "docs/", want: []string{"docs"}, ok: true},
+		{name: "./docs//./a.txt", want: []string{"docs", "a.txt"}, ok: true},
+		{name: `docs\a.txt`, want: []string{"docs", "a.txt"}, ok: true},
+		{name: "a..b/c", want: []string{"a..b", "c"}, ok: true},
+		{name: strings.Repeat("d/", maxImportDepth-1) + "f", ok: true},
+		{name: ""},
+		{name: "./"},
+		{name: "../x"},
+		{name: "/x"},
+		{name: `C:\x`},
+		{name: "C:x"},
+		{name: `\\server\share\x`},
+		{name: "a/../../b"},
+		{name: "a/.."},
+		{name: `a\..\..\b`},
+		{name: deep},
+	} {
+		parts, ok := importPath(tc.name)
+		if ok != tc.ok {
+			t.Errorf("importPath(%q) ok = %v, want %v", tc.name, ok, tc.ok)
+			continue
+		}
+		if ok && tc.want != nil && !slices.Equal(parts, tc.want) {
+			t.Errorf("importPath(%q) = %q, want %q", tc.name, parts, tc.want)
+		}
+	}
+}
+
+// testZip makes a zip of files, by name.
+func testZip(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// memFile puts b in an in memory file, the way stageArchive leaves it.
+func memFile(t *testing.T, b []byte) afero.File {
+	t.Helper()
+	fs := afero.NewMemMapFs()
+	if err := afero.WriteFile(fs, "/archive", b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Open("/archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestImportTooManyEntries(t *testing.T) {
+	defer func(n int64) { IMPORTMAXENTRIES = n }(IMPORTMAXENTRIES)
+	IMPORTMAXENTRIES = 2
+
+	// a zip says how many entries it has, so it is refused before any is
+	// made
+	b := testZip(t, map[string]string{"a": "1", "b": "2", "c": "3"})
+	im := &importer{folders: map[string]string{}}
+	if err := im.zip(memFile(t, b), int64(len(b))); !errors.Is(err, ErrImportTooMany) {
+		t.Errorf("zip of 3 entries = %v, want ErrImportTooMany", err)
+	}
+	if len(im.res.Entries) != 0 {
+		t.Errorf("%d entries imported from a zip of too many", len(im.res.Entries))
+	}
+
+	// a tar is only counted as it is read. Unsafe names are reported
+	// without touching the database.
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"../a", "/b", "../c"} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	im = &importer{folders: map[string]string{}}
+	if err := im.tar(&buf); !errors.Is(err, ErrImportTooMany) {
+		t.Errorf("tar of 3 entries = %v, want ErrImportTooMany", err)
+	}
+	if im.res.Failed != 2 || len(im.res.Entries) != 2 {
+		t.Fatalf("tar of 3 entries reported %+v", im.res)
+	}
+	for _, e := range im.res.Entries {
+		if e.Status != ImportFailed || e.Error != "unsafe path" {
+			t.Errorf("entry %q: %s, %q", e.Path, e.Status, e.Error)
+		}
+	}
+}
+
+func TestImportZipBomb(t *testing.T) {
+	// a MiB of zeros compresses to about a KiB, far more than
+	// IMPORTMAXRATIO times that
+	b := testZip(t, map[string]string{"zeros": strings.Repeat("\x00", 1<<20)})
+	size := int64(len(b))
+	if size*IMPORTMAXRATIO >= 1<<20 {
+		t.Fatalf("the test archive is %d bytes, too large to be a bomb", size)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b), size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := zr.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	im := &importer{budget: min(IMPORTMAXSIZE, size*IMPORTMAXRATIO)}
+	n, err := io.Copy(io.Discard, &importReader{r: rc, im: im})
+	if !errors.Is(err, ErrImportTooLarge) {
+		t.Fatalf("expanding the bomb = %d bytes, %v, want ErrImportTooLarge", n, err)
+	}
+	if n > size*IMPORTMAXRATIO+32<<10 {
+		t.Errorf("read %d bytes before stopping, the budget was %d", n, size*IMPORTMAXRATIO)
+	}
+
+	// within the quota of a limited owner, but over the budget
+	im = &importer{budget: 4, quota: 100, limited: true}
+	if _, err := io.Copy(io.Discard, &importReader{r: strings.NewReader("hello"), im: im}); !errors.Is(err, ErrImportTooLarge) {
+		t.Errorf("over the budget = %v, want ErrImportTooLarge", err)
+	}
+	im = &importer{budget: 100, quota: 4, limited: true}
+	if _, err := io.Copy(io.Discard, &importReader{r: strings.NewReader("hello"), im: im}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("over the quota = %v, want ErrQuotaExceeded", err)
+	}
+	im = &importer{budget: 100, quota: 4}
+	if _, err := io.Copy(io.Discard, &importReader{r: strings.NewReader("hello"), im: im}); err != nil {
+		t.Errorf("over the quota of an unlimited owner = %v", err)
+	}
+}
+
+// importArchive imports b into folder as uid.
+func importArchive(t *testing.T, s *Server, uid int, folder, conflict string, b []byte) (int, ImportResponse) {
+	t.Helper()
+	w := serve(s, uid, http.MethodPost, "/v1/folder/"+folder+"/import?conflict="+conflict, bytes.NewReader(b))
+	var res ImportResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("import answered %d %s", w.Code, w.Body)
+	}
+	return w.Code, res
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestImportArchiveConflicts(t *testing.T) {
+	s := testServer(t)
+	uid := testUser(t, s)
+
+	code, res := importArchive(t, s, uid, "-1", "rename", testZip(t, map[string]string{"docs/a.txt": "one"}))
+	if code != http.StatusOK || res.Files != 1 || res.Folders != 1 {
+		t.Fatalf("first import = %d %+v", code, res)
+	}
+	docs, err := s.persist.GetFolderByName(uid, "", "docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		conflict string
+		status   string
+		// names and content of the files in docs afterwards
+		want map[string]string
+	}{
+		{"skip", ImportSkipped, map[string]string{"a.txt": "one"}},
+		{"rename", ImportRenamed, map[string]string{"a.txt": "one", "a (2).txt": "two"}},
+		{"overwrite", ImportReplaced, map[string]string{"a.txt": "two", "a (2).txt": "two"}},
+	} {
+		code, res := importArchive(t, s, uid, "-1", tc.conflict, testZip(t, map[string]string{"docs/a.txt": "two"}))
+		if code != http.StatusOK || res.Folders != 0 || len(res.Entries) != 1 {
+			t.Fatalf("conflict=%s: %d %+v", tc.conflict, code, res)
+		}
+		if e := res.Entries[0]; e.Status != tc.status {
+			t.Errorf("conflict=%s: entry %+v, want %s", tc.conflict, e, tc.status)
+		}
+
+		files, err := s.persist.ListChildFile(uid, docs.FolderID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]string{}
+		for _, f := range files {
+			got[f.Name] = f.Sha256
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("conflict=%s: docs has %v, want %v", tc.conflict, got, tc.want)
+		}
+		for name, content := range tc.want {
+			if got[name] != sha256Hex(content) {
+				t.Errorf("conflict=%s: %s is %q, want the hash of %q", tc.conflict, name, got[name], content)
+			}
+		}
+	}
+}
+
+func TestImportArchiveZipBomb(t *testing.T) {
+	s := testServer(t)
+	uid := testUser(t, s)
+
+	b := testZip(t, map[string]string{"small.txt": "fine", "zeros": strings.Repeat("\x00", 1<<20)})
+	code, res := importArchive(t, s, uid, "-1", "rename", b)
+	if code != http.StatusRequestEntityTooLarge || res.Error != ErrImportTooLarge.Error() {
+		t.Fatalf("importing a bomb = %d %+v", code, res)
+	}
+	files, err := s.persist.ListChildFile(uid, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if f.Name == "zeros" {
+			t.Error("the bomb was stored")
+		}
+	}
+}
@@ -0,0 +1,949 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"avenue/backend/persist"
+	"avenue/backend/shared"
+	"avenue/backend/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The S3 compatible API. Each of a user's top level folders is a bucket, and
+// the folders below it are the prefixes of its keys. Requests are signed
+// with SigV4 using an access key of the user, see CreateAccessKey.
+
+var (
+	// S3ADDR is the address the S3 compatible API listens on, it is off when
+	// empty.
+	S3ADDR = shared.GetEnv("S3_API_ADDR", "")
+	// S3REGION is the region reported to clients. Signatures made for any
+	// region are accepted.
+	S3REGION = shared.GetEnv("S3_API_REGION", "us-east-1")
+)
+
+const (
+	s3TimeFormat = "2006-01-02T15:04:05.000Z"
+	// s3MaxKeys is the most keys a listing returns at once.
+	s3MaxKeys = 1000
+	// s3MaxXML is the largest XML request body accepted.
+	s3MaxXML = 1 << 20
+	// s3EmptyETag is the ETag of folders, which have no content.
+	s3EmptyETag = `"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"`
+)
+
+// s3Subresources are query parameters selecting parts of S3 that aren't
+// supported. Ignoring them would e.g. overwrite an object with its ACL.
+var s3Subresources = []string{
+	"accelerate", "acl", "analytics", "attributes", "cors", "encryption",
+	"intelligent-tiering", "inventory", "legal-hold", "lifecycle", "logging",
+	"metrics", "notification", "object-lock", "ownershipControls", "policy",
+	"publicAccessBlock", "replication", "requestPayment", "restore",
+	"retention", "select", "tagging", "torrent", "versioning", "versions",
+	"website",
+}
+
+// RunS3 serves the S3 compatible API on addr.
+func (s *Server) RunS3(addr string) error {
+	return s.s3Router().Run(addr)
+}
+
+func (s *Server) s3Router() *gin.Engine {
+	r := gin.Default()
+	// keys are paths of their own, "a/" and "a" are different objects
+	r.RedirectTrailingSlash = false
+	r.RedirectFixedPath = false
+	r.Use(s.auditRequests, s.s3Auth)
+	for _, m := range []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPost, http.MethodDelete} {
+		r.Handle(m, "/", s.S3Service)
+		r.Handle(m, "/:bucket", s.S3Bucket)
+		r.Handle(m, "/:bucket/*key", s.S3Object)
+	}
+	r.NoRoute(func(c *gin.Context) {
+		s3Error(c, http.StatusMethodNotAllowed, "MethodNotAllowed", "the method is not allowed")
+	})
+	return r
+}
+
+// s3Err is an error as S3 reports it.
+type s3Err struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *s3Err) Error() string {
+	return e.message
+}
+
+var (
+	errS3IncompleteBody = &s3Err{http.StatusBadRequest, "IncompleteBody", "the body is not as long as announced"}
+	errS3BadDigest      = &s3Err{http.StatusBadRequest, "BadDigest", "the Content-MD5 does not match the body"}
+	errS3KeyConflict    = &s3Err{http.StatusConflict, "KeyConflict", "a file and a folder can't have the same name"}
+)
+
+type s3ErrorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string
+}
+
+// s3Error aborts the request with an S3 error response.
+func s3Error(c *gin.Context, status int, code, message string) {
+	c.Abort()
+	c.XML(status, s3ErrorResponse{Code: code, Message: message, Resource: c.Request.URL.Path})
+}
+
+// s3Fail answers a failed request with the S3 error err maps to.
+func s3Fail(c *gin.Context, err error) {
+	var s3e *s3Err
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &s3e):
+		s3Error(c, s3e.status, s3e.code, s3e.message)
+	case errors.As(err, &maxErr):
+		s3Error(c, http.StatusBadRequest, "EntityTooLarge", err.Error())
+	case errors.Is(err, ErrQuotaExceeded):
+		s3Error(c, http.StatusForbidden, "QuotaExceeded", err.Error())
+	case errors.Is(err, storage.ErrPayloadMismatch):
+		s3Error(c, http.StatusBadRequest, "XAmzContentSHA256Mismatch", err.Error())
+	case errors.Is(err, storage.ErrSignatureMismatch):
+		s3Error(c, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+	case errors.Is(err, storage.ErrMalformedSignature), errors.Is(err, io.ErrUnexpectedEOF):
+		s3Error(c, http.StatusBadRequest, "IncompleteBody", err.Error())
+	default:
+		log.Printf("s3 %s %s: %v", c.Request.Method, c.Request.URL.Path, err)
+		s3Error(c, http.StatusInternalServerError, "InternalError", err.Error())
+	}
+}
+
+// s3Auth checks the SigV4 signature of a request against the secret of the
+// access key it names. The body is checked as the handlers read it.
+func (s *Server) s3Auth(c *gin.Context) {
+	sr, err := storage.ParseSignedRequest(c.Request)
+	if errors.Is(err, storage.ErrNotSigned) {
+		s3Error(c, http.StatusForbidden, "AccessDenied", "requests must be signed")
+		return
+	}
+	if err != nil {
+		s3Error(c, http.StatusBadRequest, "AuthorizationHeaderMalformed", err.Error())
+		return
+	}
+	key, err := s.persist.GetAccessKey(sr.AccessKey)
+	if errors.Is(err, persist.ErrNotFound) {
+		s3Error(c, http.StatusForbidden, "InvalidAccessKeyId", "the access key does not exist")
+		return
+	}
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	user, ok := s.activeUser(strconv.Itoa(int(key.UserID)))
+	if !ok {
+		s3Error(c, http.StatusForbidden, "AccessDenied", "the account is disabled")
+		return
+	}
+
+	err = sr.Verify(c.Request, key.SecretKey, time.Now())
+	switch {
+	case errors.Is(err, storage.ErrSignatureExpired) && sr.Expires > 0:
+		s3Error(c, http.StatusForbidden, "AccessDenied", "the request has expired")
+		return
+	case errors.Is(err, storage.ErrSignatureExpired):
+		s3Error(c, http.StatusForbidden, "RequestTimeTooSkewed", "the request time is too far from the server time")
+		return
+	case err != nil:
+		s3Error(c, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+	body, err := sr.Body(c.Request.Body, key.SecretKey)
+	if err != nil {
+		s3Error(c, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
+	c.Request.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, c.Request.Body}
+
+	if err := s.persist.TouchAccessKey(key); err != nil {
+		log.Printf("could not record use of access key %s: %v", key.ID, err)
+	}
+	ctx := context.WithValue(c.Request.Context(), shared.USERCOOKIENAME, strconv.Itoa(int(user.ID)))
+	ctx = context.WithValue(ctx, shared.USERROLENAME, user.Role)
+	c.Request = c.Request.WithContext(ctx)
+
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead && user.Role == persist.UserRoleReadOnly {
+		s3Error(c, http.StatusForbidden, "AccessDenied", "read-only users can't make changes")
+		return
+	}
+	c.Next()
+}
+
+// s3Unsupported answers requests for parts of S3 that aren't supported.
+// ok is false if it did.
+func s3Unsupported(c *gin.Context) (ok bool) {
+	q := c.Request.URL.Query()
+	for _, sub := range s3Subresources {
+		if q.Has(sub) {
+			s3Error(c, http.StatusNotImplemented, "NotImplemented", "?"+sub+" is not supported")
+			return false
+		}
+	}
+	return true
+}
+
+type s3Owner struct {
+	ID          string
+	DisplayName string
+}
+
+type s3BucketInfo struct {
+	Name         string
+	CreationDate string
+}
+
+type s3ListBucketsResult struct {
+	XMLName xml.Name       `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Owner   s3Owner        `xml:"Owner"`
+	Buckets []s3BucketInfo `xml:"Buckets>Bucket"`
+}
+
+// S3Service lists the caller's buckets, their top level folders. Folders
+// don't record when they were made, so all have the same creation date.
+func (s *Server) S3Service(c *gin.Context) {
+	if c.Request.Method != http.MethodGet {
+		s3Error(c, http.StatusMethodNotAllowed, "MethodNotAllowed", "the method is not allowed")
+		return
+	}
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	u, err := s.persist.GetUserById(uid)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	folders, err := s.persist.ListChildFolder(uid, "-1")
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+
+	res := s3ListBucketsResult{Owner: s3Owner{ID: strconv.Itoa(uid), DisplayName: u.Email}}
+	for _, f := range folders {
+		res.Buckets = append(res.Buckets, s3BucketInfo{Name: f.Name, CreationDate: time.Time{}.Format(s3TimeFormat)})
+	}
+	c.XML(http.StatusOK, res)
+}
+
+// s3Bucket finds the top level folder called name. If there is none an error
+// response has already been written and ok is false.
+func (s *Server) s3Bucket(c *gin.Context, uid int, name string) (*persist.Folder, bool) {
+	f, err := s.persist.GetFolderByName(uid, "", name)
+	if errors.Is(err, persist.ErrNotFound) {
+		s3Error(c, http.StatusNotFound, "NoSuchBucket", "the bucket does not exist")
+		return nil, false
+	}
+	if err != nil {
+		s3Fail(c, err)
+		return nil, false
+	}
+	return f, true
+}
+
+// S3Bucket serves the requests on a bucket: listing it, creating and
+// deleting it, and deleting objects in bulk.
+func (s *Server) S3Bucket(c *gin.Context) {
+	name := c.Param("bucket")
+	q := c.Request.URL.Query()
+	var op string
+	switch c.Request.Method {
+	case http.MethodPut:
+		op = "create_bucket"
+	case http.MethodDelete:
+		op = "delete_bucket"
+	case http.MethodPost:
+		if !q.Has("delete") {
+			s3Error(c, http.StatusMethodNotAllowed, "MethodNotAllowed", "the method is not allowed")
+			return
+		}
+		op = "delete_objects"
+	}
+	if op != "" {
+		defer s.audit(c, persist.AuditEvent{Action: "s3." + op, TargetType: "bucket", TargetID: name})
+	}
+
+	if !s3Unsupported(c) {
+		return
+	}
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	if op == "create_bucket" {
+		s.s3CreateBucket(c, uid, name)
+		return
+	}
+	bucket, ok := s.s3Bucket(c, uid, name)
+	if !ok {
+		return
+	}
+
+	switch {
+	case op == "delete_bucket":
+		s.s3DeleteBucket(c, uid, bucket)
+	case op == "delete_objects":
+		s.s3DeleteObjects(c, uid, bucket)
+	case c.Request.Method == http.MethodHead:
+		c.Header("X-Amz-Bucket-Region", S3REGION)
+		c.Status(http.StatusOK)
+	case q.Has("location"):
+		c.XML(http.StatusOK, struct {
+			XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+			Region  string   `xml:",chardata"`
+		}{Region: S3REGION})
+	case q.Has("uploads"):
+		s3Error(c, http.StatusNotImplemented, "NotImplemented", "listing multipart uploads is not supported")
+	default:
+		s.s3ListObjects(c, uid, bucket)
+	}
+}
+
+func (s *Server) s3CreateBucket(c *gin.Context, uid int, name string) {
+	if name == "." || name == ".." {
+		s3Error(c, http.StatusBadRequest, "InvalidBucketName", "the bucket name is not valid")
+		return
+	}
+	unlock := s.uploadLocks.Lock("s3-mkdir-" + strconv.Itoa(uid))
+	defer unlock()
+
+	_, err := s.persist.GetFolderByName(uid, "", name)
+	if err == nil {
+		s3Error(c, http.StatusConflict, "BucketAlreadyOwnedByYou", "the bucket already exists")
+		return
+	}
+	if !errors.Is(err, persist.ErrNotFound) {
+		s3Fail(c, err)
+		return
+	}
+	if _, err := s.persist.CreateFolder(&persist.Folder{Name: name, OwnerId: uid}); err != nil {
+		s3Fail(c, err)
+		return
+	}
+	c.Header("Location", "/"+name)
+	c.Status(http.StatusOK)
+}
+
+// s3DeleteBucket moves a bucket to the trash, if it is empty.
+func (s *Server) s3DeleteBucket(c *gin.Context, uid int, bucket *persist.Folder) {
+	empty, err := s.folderEmpty(uid, bucket.FolderID)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	if !empty {
+		s3Error(c, http.StatusConflict, "BucketNotEmpty", "the bucket is not empty")
+		return
+	}
+	if err := s.persist.TrashFolder(uid, bucket.FolderID); err != nil {
+		s3Fail(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) folderEmpty(uid int, id string) (bool, error) {
+	folders, err := s.persist.ListChildFolder(uid, id)
+	if err != nil || len(folders) > 0 {
+		return false, err
+	}
+	files, err := s.persist.ListChildFile(uid, id)
+	return len(files) == 0, err
+}
+
+// s3Entry is an object in a bucket: a file, or an empty folder listed as a
+// key ending in "/".
+type s3Entry struct {
+	key  string
+	file *persist.File
+}
+
+// s3Entries lists the objects in the bucket by key.
+func (s *Server) s3Entries(uid int, bucket *persist.Folder) ([]s3Entry, error) {
+	folders, files, err := s.persist.ListFolderTree(uid, bucket.FolderID)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[string]*persist.Folder{}
+	used := map[string]bool{}
+	for i := range folders {
+		byID[folders[i].FolderID] = &folders[i]
+		used[folders[i].Parent] = true
+	}
+	prefixes := map[string]string{bucket.FolderID: ""}
+	var prefix func(id string) string
+	prefix = func(id string) string {
+		if p, ok := prefixes[id]; ok {
+			return p
+		}
+		p := prefix(byID[id].Parent) + byID[id].Name + "/"
+		prefixes[id] = p
+		return p
+	}
+
+	entries := make([]s3Entry, 0, len(files))
+	for i := range files {
+		used[files[i].Parent] = true
+		entries = append(entries, s3Entry{key: prefix(files[i].Parent) + files[i].Name, file: &files[i]})
+	}
+	for _, f := range folders {
+		if !used[f.FolderID] {
+			entries = append(entries, s3Entry{key: prefix(f.FolderID)})
+		}
+	}
+	slices.SortFunc(entries, func(a, b s3Entry) int {
+		return strings.Compare(a.key, b.key)
+	})
+	return entries, nil
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3Prefix struct {
+	Prefix string
+}
+
+type s3ListObjectsResult struct {
+	XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	MaxKeys               int
+	KeyCount              int
+	IsTruncated           bool
+	ContinuationToken     string     `xml:",omitempty"`
+	NextContinuationToken string     `xml:",omitempty"`
+	StartAfter            string     `xml:",omitempty"`
+	Marker                string     `xml:",omitempty"`
+	NextMarker            string     `xml:",omitempty"`
+	Contents              []s3Object `xml:"Contents"`
+	CommonPrefixes        []s3Prefix `xml:"CommonPrefixes"`
+}
+
+// s3ListObjects lists the objects in a bucket as ListObjectsV2 does. The
+// older ListObjects gets the same answer, with markers for paging.
+func (s *Server) s3ListObjects(c *gin.Context, uid int, bucket *persist.Folder) {
+	q := c.Request.URL.Query()
+	v2 := q.Get("list-type") == "2"
+	res := s3ListObjectsResult{
+		Name:      bucket.Name,
+		Prefix:    q.Get("prefix"),
+		Delimiter: q.Get("delimiter"),
+		MaxKeys:   s3MaxKeys,
+	}
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			s3Error(c, http.StatusBadRequest, "InvalidArgument", "max-keys must be a number")
+			return
+		}
+		res.MaxKeys = min(n, s3MaxKeys)
+	}
+	var after string
+	if v2 {
+		res.StartAfter = q.Get("start-after")
+		res.ContinuationToken = q.Get("continuation-token")
+		after = res.StartAfter
+		if res.ContinuationToken != "" {
+			b, err := base64.RawURLEncoding.DecodeString(res.ContinuationToken)
+			if err != nil {
+				s3Error(c, http.StatusBadRequest, "InvalidArgument", "the continuation token is not valid")
+				return
+			}
+			after = string(b)
+		}
+	} else {
+		res.Marker = q.Get("marker")
+		after = res.Marker
+	}
+
+	entries, err := s.s3Entries(uid, bucket)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	var last string
+	for _, e := range entries {
+		if !strings.HasPrefix(e.key, res.Prefix) || e.key <= after {
+			continue
+		}
+		// keys with the delimiter after the prefix roll up into one prefix
+		item, common := e.key, false
+		if res.Delimiter != "" {
+			if i := strings.Index(e.key[len(res.Prefix):], res.Delimiter); i >= 0 {
+				item, common = e.key[:len(res.Prefix)+i+len(res.Delimiter)], true
+			}
+		}
+		if item <= after || item == last {
+			continue
+		}
+		if res.KeyCount == res.MaxKeys {
+			res.IsTruncated = res.MaxKeys > 0
+			break
+		}
+
+		res.KeyCount++
+		last = item
+		if common {
+			res.CommonPrefixes = append(res.CommonPrefixes, s3Prefix{Prefix: item})
+			continue
+		}
+		obj := s3Object{
+			Key:          e.key,
+			LastModified: time.Time{}.Format(s3TimeFormat),
+			ETag:         s3EmptyETag,
+			StorageClass: "STANDARD",
+		}
+		if e.file != nil {
+			obj.LastModified = fileModTime(e.file).UTC().Format(s3TimeFormat)
+			obj.ETag = s3ETag(e.file)
+			obj.Size = int64(e.file.FileSize)
+		}
+		res.Contents = append(res.Contents, obj)
+	}
+	if res.IsTruncated && v2 {
+		res.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+	} else if res.IsTruncated {
+		res.NextMarker = last
+	}
+	c.XML(http.StatusOK, res)
+}
+
+// s3ETag is the ETag of a file, the same as GetFile sends.
+func s3ETag(f *persist.File) string {
+	return `"` + f.Sha256 + `"`
+}
+
+// s3Key splits key into the names of the folders and file it maps to. A
+// key ending in "/" names a folder. Keys with empty names, "." or ".." can't
+// be mapped and ok is false.
+func s3Key(key string) (parts []string, dir bool, ok bool) {
+	dir = strings.HasSuffix(key, "/")
+	parts = strings.Split(strings.TrimSuffix(key, "/"), "/")
+	for _, p := range parts {
+		if p == "" || p == "." || p == ".." {
+			return nil, dir, false
+		}
+	}
+	return parts, dir, true
+}
+
+// S3Object serves the requests on an object, including multipart uploads.
+func (s *Server) S3Object(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	if key == "" {
+		s.S3Bucket(c)
+		return
+	}
+	name := c.Param("bucket")
+	q := c.Request.URL.Query()
+	var op string
+	switch c.Request.Method {
+	case http.MethodPut:
+		op = "put_object"
+		if q.Has("uploadId") {
+			op = "upload_part"
+		}
+	case http.MethodPost:
+		switch {
+		case q.Has("uploads"):
+			op = "create_multipart_upload"
+		case q.Has("uploadId"):
+			op = "complete_multipart_upload"
+		default:
+			s3Error(c, http.StatusMethodNotAllowed, "MethodNotAllowed", "the method is not allowed")
+			return
+		}
+	case http.MethodDelete:
+		op = "delete_object"
+		if q.Has("uploadId") {
+			op = "abort_multipart_upload"
+		}
+	}
+	if op != "" {
+		defer s.audit(c, persist.AuditEvent{Action: "s3." + op, TargetType: "object", TargetID: name + "/" + key})
+	}
+
+	if !s3Unsupported(c) {
+		return
+	}
+	switch {
+	case q.Has("uploadId") && c.Request.Method == http.MethodGet:
+		s3Error(c, http.StatusNotImplemented, "NotImplemented", "listing parts is not supported")
+		return
+	case c.GetHeader("X-Amz-Copy-Source") != "":
+		s3Error(c, http.StatusNotImplemented, "NotImplemented", "copying objects is not supported")
+		return
+	}
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	bucket, ok := s.s3Bucket(c, uid, name)
+	if !ok {
+		return
+	}
+	parts, dir, ok := s3Key(key)
+	if !ok {
+		s3Error(c, http.StatusBadRequest, "InvalidArgument", "keys can't have empty names, . or .. between slashes")
+		return
+	}
+
+	switch op {
+	case "put_object":
+		s.s3PutObject(c, uid, bucket, parts, dir)
+	case "upload_part":
+		s.s3UploadPart(c, uid, bucket, key)
+	case "create_multipart_upload":
+		s.s3CreateMultipartUpload(c, uid, bucket, key, dir)
+	case "complete_multipart_upload":
+		s.s3CompleteMultipartUpload(c, uid, bucket, key, parts)
+	case "abort_multipart_upload":
+		s.s3AbortMultipartUpload(c, uid, bucket, key)
+	case "delete_object":
+		if err := s.s3Delete(uid, bucket, parts, dir); err != nil {
+			s3Fail(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	default:
+		s.s3GetObject(c, uid, bucket, parts, dir)
+	}
+}
+
+// s3GetObject serves GET and HEAD of an object. Ranges and conditional
+// requests are handled by http.ServeContent.
+func (s *Server) s3GetObject(c *gin.Context, uid int, bucket *persist.Folder, parts []string, dir bool) {
+	n, err := s.resolvePath(uid, append([]string{bucket.Name}, parts...))
+	if errors.Is(err, os.ErrNotExist) || err == nil && n.isDir() != dir {
+		s3Error(c, http.StatusNotFound, "NoSuchKey", "the key does not exist")
+		return
+	}
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	if dir {
+		c.Header("ETag", s3EmptyETag)
+		c.Header("Content-Type", "application/x-directory")
+		http.ServeContent(c.Writer, c.Request, "", time.Time{}, bytes.NewReader(nil))
+		return
+	}
+
+	if c.Request.Method == http.MethodGet {
+		defer s.audit(c, persist.AuditEvent{Action: "file.download", TargetType: "file", TargetID: n.file.ID, Detail: "s3 " + bucket.Name + "/" + strings.Join(parts, "/")})
+	}
+	content, err := s.blobs.Open(n.file.Sha256)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	defer content.Close()
+	ct := mime.TypeByExtension("." + n.file.Extension)
+	if ct == "" || n.file.Extension == "" {
+		ct = "application/octet-stream"
+	}
+	c.Header("ETag", s3ETag(n.file))
+	c.Header("Content-Type", ct)
+	http.ServeContent(c.Writer, c.Request, n.file.Name, fileModTime(n.file), content)
+}
+
+// s3Mkdir makes the folders named by parts in the folder parent, where they
+// are missing, and returns the id of the last. S3 has no step for it, keys
+// are just put.
+func (s *Server) s3Mkdir(uid int, parent string, parts []string) (string, error) {
+	// parallel uploads to a new prefix would each make its folders
+	unlock := s.uploadLocks.Lock("s3-mkdir-" + strconv.Itoa(uid))
+	defer unlock()
+
+	for _, name := range parts {
+		f, err := s.persist.GetFolderByName(uid, parent, name)
+		if errors.Is(err, persist.ErrNotFound) {
+			if _, err := s.persist.GetFileByName(uid, parent, name); err == nil {
+				return "", errS3KeyConflict
+			} else if !errors.Is(err, persist.ErrNotFound) {
+				return "", err
+			}
+			f = &persist.Folder{Name: name, Parent: parent, OwnerId: uid}
+			if _, err := s.persist.CreateFolder(f); err != nil {
+				return "", err
+			}
+		} else if err != nil {
+			return "", err
+		}
+		parent = f.FolderID
+	}
+	return parent, nil
+}
+
+// s3Save stores staged content under the key parts names in bucket, as a new
+// version of the file if there is one already.
+func (s *Server) s3Save(uid int, bucket *persist.Folder, parts []string, staged storage.StagedBlob) (*persist.File, error) {
+	parent, err := s.s3Mkdir(uid, bucket.FolderID, parts[:len(parts)-1])
+	if err != nil {
+		return nil, err
+	}
+	name := parts[len(parts)-1]
+	unlock := s.uploadLocks.Lock("s3-" + parent + "/" + name)
+	defer unlock()
+
+	if _, err := s.persist.GetFolderByName(uid, parent, name); err == nil {
+		return nil, errS3KeyConflict
+	} else if !errors.Is(err, persist.ErrNotFound) {
+		return nil, err
+	}
+	replaces, err := s.persist.GetFileByName(uid, parent, name)
+	if err != nil && !errors.Is(err, persist.ErrNotFound) {
+		return nil, err
+	}
+	return s.saveContent(staged, uid, uid, parent, name, replaces)
+}
+
+// s3Body is the body of a PUT, limited to MAXUPLOADSIZE and the quota of
+// its uploader.
+type s3Body struct {
+	r io.Reader
+	// size is the length the client announced, or -1
+	size int64
+	n    int64
+	md5  hash.Hash
+	// wantMD5 is the Content-MD5 the client sent, if any
+	wantMD5 []byte
+}
+
+// s3Body reads the body of a PUT by uid, who already uses reserved bytes of
+// their quota for it elsewhere. If the request is malformed an error
+// response has already been written and ok is false.
+func (s *Server) s3Body(c *gin.Context, uid int, reserved int64) (*s3Body, bool) {
+	b := &s3Body{size: c.Request.ContentLength}
+	// streaming payloads announce the size of the content separately
+	if v := c.GetHeader("X-Amz-Decoded-Content-Length"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			s3Error(c, http.StatusBadRequest, "InvalidArgument", "x-amz-decoded-content-length must be a number")
+			return nil, false
+		}
+		b.size = size
+	}
+	if b.size > MAXUPLOADSIZE {
+		s3Error(c, http.StatusBadRequest, "EntityTooLarge", "the object is larger than "+strconv.FormatInt(MAXUPLOADSIZE, 10)+" bytes")
+		return nil, false
+	}
+	if v := c.GetHeader("Content-MD5"); v != "" {
+		sum, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(sum) != md5.Size {
+			s3Error(c, http.StatusBadRequest, "InvalidDigest", "the Content-MD5 is not valid")
+			return nil, false
+		}
+		b.md5, b.wantMD5 = md5.New(), sum
+	}
+
+	remaining, limited, err := s.remainingQuota(uid)
+	if err != nil {
+		s3Fail(c, err)
+		return nil, false
+	}
+	b.r = http.MaxBytesReader(c.Writer, c.Request.Body, MAXUPLOADSIZE)
+	if limited {
+		b.r = &quotaReader{r: b.r, remaining: remaining - reserved}
+	}
+	return b, true
+}
+
+func (b *s3Body) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	if b.md5 != nil {
+		b.md5.Write(p[:n])
+	}
+	return n, err
+}
+
+// check verifies the body arrived whole, once all of it was read.
+func (b *s3Body) check() error {
+	if b.size >= 0 && b.n != b.size {
+		return errS3IncompleteBody
+	}
+	if b.md5 != nil && !bytes.Equal(b.md5.Sum(nil), b.wantMD5) {
+		return errS3BadDigest
+	}
+	return nil
+}
+
+// s3PutObject stores an object. A key ending in "/" makes a folder.
+func (s *Server) s3PutObject(c *gin.Context, uid int, bucket *persist.Folder, parts []string, dir bool) {
+	if dir {
+		if _, err := s.s3Mkdir(uid, bucket.FolderID, parts); err != nil {
+			s3Fail(c, err)
+			return
+		}
+		c.Header("ETag", s3EmptyETag)
+		c.Status(http.StatusOK)
+		return
+	}
+
+	body, ok := s.s3Body(c, uid, 0)
+	if !ok {
+		return
+	}
+	staged, err := s.blobs.Stage(body)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	defer staged.Discard()
+	if err := body.check(); err != nil {
+		s3Fail(c, err)
+		return
+	}
+
+	f, err := s.s3Save(uid, bucket, parts, staged)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	c.Header("ETag", s3ETag(f))
+	c.Status(http.StatusOK)
+}
+
+// s3Delete moves the file key parts names to the trash. Like S3 it succeeds
+// if there is none. A key ending in "/" only removes its folder if it is
+// empty, S3 would leave the keys below it too.
+func (s *Server) s3Delete(uid int, bucket *persist.Folder, parts []string, dir bool) error {
+	n, err := s.resolvePath(uid, append([]string{bucket.Name}, parts...))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil || n.isDir() != dir {
+		return err
+	}
+
+	if !dir {
+		err = s.persist.TrashFile(uid, n.file.ID)
+	} else if empty, eerr := s.folderEmpty(uid, n.folderID()); eerr != nil || !empty {
+		return eerr
+	} else {
+		err = s.persist.TrashFolder(uid, n.folderID())
+	}
+	if errors.Is(err, persist.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// s3ReadXML decodes the XML body of a request into v. If that fails an
+// error response has already been written and ok is false.
+func s3ReadXML(c *gin.Context, v any) (ok bool) {
+	// read all of it, so its signed hash is checked
+	b, err := io.ReadAll(io.LimitReader(c.Request.Body, s3MaxXML+1))
+	if err != nil {
+		s3Fail(c, err)
+		return false
+	}
+	if len(b) > s3MaxXML {
+		s3Error(c, http.StatusBadRequest, "MaxMessageLengthExceeded", "the request body is too long")
+		return false
+	}
+	if err := xml.Unmarshal(b, v); err != nil {
+		s3Error(c, http.StatusBadRequest, "MalformedXML", err.Error())
+		return false
+	}
+	return true
+}
+
+type s3DeleteRequest struct {
+	Quiet   bool
+	Objects []struct {
+		Key string
+	} `xml:"Object"`
+}
+
+type s3Deleted struct {
+	Key string
+}
+
+type s3DeleteError struct {
+	Key     string
+	Code    string
+	Message string
+}
+
+type s3DeleteResult struct {
+	XMLName xml.Name        `xml:"http://s3.amazonaws.com/doc/2006-03-01/ DeleteResult"`
+	Deleted []s3Deleted     `xml:"Deleted"`
+	Errors  []s3DeleteError `xml:"Error"`
+}
+
+// s3DeleteObjects deletes up to 1000 keys at once, reporting each.
+func (s *Server) s3DeleteObjects(c *gin.Context, uid int, bucket *persist.Folder) {
+	var req s3DeleteRequest
+	if !s3ReadXML(c, &req) {
+		return
+	}
+	if len(req.Objects) > s3MaxKeys {
+		s3Error(c, http.StatusBadRequest, "MalformedXML", "at most 1000 keys can be deleted at once")
+		return
+	}
+
+	var res s3DeleteResult
+	for _, o := range req.Objects {
+		parts, dir, ok := s3Key(o.Key)
+		err := error(&s3Err{http.StatusBadRequest, "InvalidArgument", "the key is not valid"})
+		if ok {
+			err = s.s3Delete(uid, bucket, parts, dir)
+		}
+		switch {
+		case err == nil && !req.Quiet:
+			res.Deleted = append(res.Deleted, s3Deleted{Key: o.Key})
+		case err != nil:
+			code := "InternalError"
+			var s3e *s3Err
+			if errors.As(err, &s3e) {
+				code = s3e.code
+			}
+			res.Errors = append(res.Errors, s3DeleteError{Key: o.Key, Code: code, Message: err.Error()})
+		}
+	}
+	c.XML(http.StatusOK, res)
+}
+
+// s3Location is the Location of an object in responses.
+func s3Location(bucket *persist.Folder, key string) string {
+	return "/" + url.PathEscape(bucket.Name) + "/" + (&url.URL{Path: key}).EscapedPath()
+}
@@ -0,0 +1,311 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"avenue/backend/persist"
+	"avenue/backend/shared"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// s3MaxParts is the highest part number of a multipart upload.
+const s3MaxParts = 10000
+
+var (
+	// S3MULTIPARTLIMIT is how many bytes of parts a user may have staged for
+	// unfinished multipart uploads, whatever their quota.
+	S3MULTIPARTLIMIT = shared.GetEnvInt64("S3_MULTIPART_LIMIT", MAXUPLOADSIZE)
+	// S3MULTIPARTTTL is how long a multipart upload may take before it is
+	// aborted.
+	S3MULTIPARTTTL = shared.GetEnvDuration("S3_MULTIPART_TTL", 7*24*time.Hour)
+)
+
+// s3PartPath is where a part of a multipart upload is kept until the upload
+// is completed.
+func s3PartPath(u *persist.MultipartUpload, n int) string {
+	return fmt.Sprintf("/%d/.s3-%s-%d", u.OwnerId, u.ID, n)
+}
+
+type s3InitiateResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+func (s *Server) s3CreateMultipartUpload(c *gin.Context, uid int, bucket *persist.Folder, key string, dir bool) {
+	if dir {
+		s3Error(c, http.StatusBadRequest, "InvalidArgument", "keys ending in / are folders")
+		return
+	}
+	if err := s.fs.MkdirAll(fmt.Sprintf("/%d", uid), os.ModePerm); err != nil {
+		s3Fail(c, err)
+		return
+	}
+	u := persist.MultipartUpload{OwnerId: uid, Bucket: bucket.FolderID, Key: key}
+	if err := s.persist.CreateMultipartUpload(&u); err != nil {
+		s3Fail(c, err)
+		return
+	}
+	c.XML(http.StatusOK, s3InitiateResult{Bucket: bucket.Name, Key: key, UploadId: u.ID})
+}
+
+// s3Upload finds the multipart upload to key the uploadId query names. If
+// there is none an error response has already been written and ok is false.
+func (s *Server) s3Upload(c *gin.Context, uid int, bucket *persist.Folder, key string) (*persist.MultipartUpload, bool) {
+	id := c.Query("uploadId")
+	if _, err := uuid.Parse(id); err != nil {
+		s3Error(c, http.StatusNotFound, "NoSuchUpload", "the upload does not exist")
+		return nil, false
+	}
+	u, err := s.persist.GetOwnedMultipartUpload(uid, id)
+	if errors.Is(err, persist.ErrNotFound) || err == nil && (u.Bucket != bucket.FolderID || u.Key != key) {
+		s3Error(c, http.StatusNotFound, "NoSuchUpload", "the upload does not exist")
+		return nil, false
+	}
+	if err != nil {
+		s3Fail(c, err)
+		return nil, false
+	}
+	return u, true
+}
+
+// s3UploadPart stores a part of a multipart upload in the staging area. The
+// parts of all of the user's unfinished uploads count against their quota,
+// and against S3MULTIPARTLIMIT.
+func (s *Server) s3UploadPart(c *gin.Context, uid int, bucket *persist.Folder, key string) {
+	n, err := strconv.Atoi(c.Query("partNumber"))
+	if err != nil || n < 1 || n > s3MaxParts {
+		s3Error(c, http.StatusBadRequest, "InvalidArgument", "partNumber must be between 1 and 10000")
+		return
+	}
+	u, ok := s.s3Upload(c, uid, bucket, key)
+	if !ok {
+		return
+	}
+	// a part uploaded again replaces the old one
+	reserved, err := s.persist.MultipartBytes(uid, u.ID, n)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	body, ok := s.s3Body(c, uid, reserved)
+	if !ok {
+		return
+	}
+	if body.size > S3MULTIPARTLIMIT-reserved {
+		s3Fail(c, ErrQuotaExceeded)
+		return
+	}
+	body.r = &quotaReader{r: body.r, remaining: S3MULTIPARTLIMIT - reserved}
+
+	path := s3PartPath(u, n)
+	unlock := s.uploadLocks.Lock(path)
+	defer unlock()
+
+	// written next to the part, so a failed upload leaves the old one
+	f, err := s.fs.Create(path + ".tmp")
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = body.check()
+	}
+	if err == nil {
+		err = s.fs.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		_ = s.fs.Remove(path + ".tmp")
+		s3Fail(c, err)
+		return
+	}
+
+	part := persist.MultipartPart{UploadID: u.ID, PartNumber: n, Size: body.n, Sha256: hex.EncodeToString(h.Sum(nil))}
+	if err := s.persist.SaveMultipartPart(&part); err != nil {
+		s3Fail(c, err)
+		return
+	}
+	c.Header("ETag", `"`+part.Sha256+`"`)
+	c.Status(http.StatusOK)
+}
+
+type s3CompleteRequest struct {
+	Parts []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+type s3CompleteResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+// s3CompleteMultipartUpload joins the parts the client lists into the
+// object, in the order given.
+func (s *Server) s3CompleteMultipartUpload(c *gin.Context, uid int, bucket *persist.Folder, key string, keyParts []string) {
+	u, ok := s.s3Upload(c, uid, bucket, key)
+	if !ok {
+		return
+	}
+	var req s3CompleteRequest
+	if !s3ReadXML(c, &req) {
+		return
+	}
+	if len(req.Parts) == 0 {
+		s3Error(c, http.StatusBadRequest, "MalformedXML", "the upload has no parts")
+		return
+	}
+
+	unlock := s.uploadLocks.Lock("s3-" + u.ID)
+	defer unlock()
+
+	stored, err := s.persist.ListMultipartParts(u.ID)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	byNumber := map[int]persist.MultipartPart{}
+	for _, p := range stored {
+		byNumber[p.PartNumber] = p
+	}
+	var size int64
+	var readers []io.Reader
+	for i, p := range req.Parts {
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			s3Error(c, http.StatusBadRequest, "InvalidPartOrder", "parts must be listed in ascending order")
+			return
+		}
+		sp, ok := byNumber[p.PartNumber]
+		if !ok || strings.Trim(p.ETag, `"`) != sp.Sha256 {
+			s3Error(c, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("part %d was not uploaded or its ETag does not match", p.PartNumber))
+			return
+		}
+		f, err := s.fs.Open(s3PartPath(u, p.PartNumber))
+		if err != nil {
+			s3Fail(c, err)
+			return
+		}
+		defer f.Close()
+		readers = append(readers, f)
+		size += sp.Size
+	}
+
+	if size > MAXUPLOADSIZE {
+		s3Error(c, http.StatusBadRequest, "EntityTooLarge", "the object is larger than "+strconv.FormatInt(MAXUPLOADSIZE, 10)+" bytes")
+		return
+	}
+	remaining, limited, err := s.remainingQuota(uid)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	if limited && size > remaining {
+		s3Fail(c, ErrQuotaExceeded)
+		return
+	}
+	staged, err := s.blobs.Stage(io.MultiReader(readers...))
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	defer staged.Discard()
+
+	f, err := s.s3Save(uid, bucket, keyParts, staged)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	if err := s.s3RemoveUpload(u, stored); err != nil {
+		log.Printf("could not remove multipart upload %s: %v", u.ID, err)
+	}
+	c.XML(http.StatusOK, s3CompleteResult{
+		Location: s3Location(bucket, key),
+		Bucket:   bucket.Name,
+		Key:      key,
+		ETag:     s3ETag(f),
+	})
+}
+
+func (s *Server) s3AbortMultipartUpload(c *gin.Context, uid int, bucket *persist.Folder, key string) {
+	u, ok := s.s3Upload(c, uid, bucket, key)
+	if !ok {
+		return
+	}
+	if err := s.abortMultipartUpload(u); err != nil {
+		s3Fail(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// s3RemoveUpload frees the staged parts of an upload and forgets it.
+func (s *Server) s3RemoveUpload(u *persist.MultipartUpload, parts []persist.MultipartPart) error {
+	for _, p := range parts {
+		if err := s.fs.Remove(s3PartPath(u, p.PartNumber)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return s.persist.DeleteMultipartUpload(u.ID)
+}
+
+// JanitorMultipartUploads aborts multipart uploads started longer than ttl
+// ago, checking every interval until ctx is done.
+func (s *Server) JanitorMultipartUploads(ctx context.Context, interval, ttl time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			uploads, err := s.persist.ListMultipartUploadsBefore(time.Now().Add(-ttl))
+			if err != nil {
+				log.Printf("could not list expired multipart uploads: %v", err)
+				continue
+			}
+			for i := range uploads {
+				if err := s.abortMultipartUpload(&uploads[i]); err != nil {
+					log.Printf("could not abort multipart upload %s: %v", uploads[i].ID, err)
+				}
+			}
+			if len(uploads) > 0 {
+				log.Printf("aborted %d expired multipart uploads", len(uploads))
+			}
+		}
+	}
+}
+
+// abortMultipartUpload removes an upload, unless it is being completed.
+func (s *Server) abortMultipartUpload(u *persist.MultipartUpload) error {
+	unlock := s.uploadLocks.Lock("s3-" + u.ID)
+	defer unlock()
+	parts, err := s.persist.ListMultipartParts(u.ID)
+	if err != nil {
+		return err
+	}
+	return s.s3RemoveUpload(u, parts)
+}
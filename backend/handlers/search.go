@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"avenue/backend/extract"
+	"avenue/backend/persist"
+	"avenue/backend/shared"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// SEARCHCONTENT turns on indexing the text of plain text, Markdown and
+	// PDF uploads for ?content= searches.
+	SEARCHCONTENT, _ = strconv.ParseBool(shared.GetEnv("SEARCH_INDEX_CONTENT", "false"))
+	// SEARCHCONTENTLIMIT is how many bytes of text are indexed per file.
+	SEARCHCONTENTLIMIT = int(shared.GetEnvInt64("SEARCH_CONTENT_LIMIT", 512<<10))
+)
+
+type SearchResponse struct {
+	Files   []persist.File   `json:"files"`
+	Folders []persist.Folder `json:"folders"`
+}
+
+// Search finds files and folders the caller may see. Filters:
+//
+//	q              name contains
+//	prefix         name starts with
+//	ext            comma separated extensions
+//	min_size       bytes, inclusive
+//	max_size       bytes, inclusive
+//	created_after  RFC 3339
+//	created_before RFC 3339
+//	content        full-text query over indexed file text
+//	folder         only search below this folder
+//	type           "file" or "folder" to only return one kind
+//	limit, offset  paging, per kind
+//
+// The file-only filters leave folders out of the results.
+func (s *Server) Search(c *gin.Context) {
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+
+	q := persist.SearchQuery{
+		Name:    c.Query("q"),
+		Prefix:  c.Query("prefix"),
+		Content: c.Query("content"),
+		Limit:   50,
+	}
+	if ext := c.Query("ext"); ext != "" {
+		for _, e := range strings.Split(ext, ",") {
+			q.Extensions = append(q.Extensions, strings.ToLower(strings.TrimPrefix(strings.TrimSpace(e), ".")))
+		}
+	}
+	for _, p := range []struct {
+		name string
+		dst  **int64
+	}{{"min_size", &q.MinSize}, {"max_size", &q.MaxSize}} {
+		v := c.Query(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, Response{
+				Message: "invalid " + p.name,
+				Error:   err.Error(),
+			})
+			return
+		}
+		*p.dst = &n
+	}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"created_after", &q.CreatedAfter}, {"created_before", &q.CreatedBefore}} {
+		v := c.Query(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, Response{
+				Message: "invalid " + p.name,
+				Error:   err.Error(),
+			})
+			return
+		}
+		*p.dst = t
+	}
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 && l <= 200 {
+		q.Limit = l
+	}
+	if o, err := strconv.Atoi(c.Query("offset")); err == nil && o > 0 {
+		q.Offset = o
+	}
+
+	if !s.searchScope(c, uid, c.Query("folder"), &q) {
+		return
+	}
+
+	resp := SearchResponse{Files: []persist.File{}, Folders: []persist.Folder{}}
+	var err error
+	kind := c.Query("type")
+	if kind != "folder" {
+		resp.Files, err = s.persist.SearchFiles(q)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, Response{
+				Message: "could not search files",
+				Error:   err.Error(),
+			})
+			return
+		}
+	}
+	if kind != "file" && !q.FilesOnly() {
+		resp.Folders, err = s.persist.SearchFolders(q)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, Response{
+				Message: "could not search folders",
+				Error:   err.Error(),
+			})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// searchScope limits q to what uid may see: below folder if one is given,
+// otherwise their own things and everything in folders shared with them. If
+// it fails an error response has already been written and ok is false.
+func (s *Server) searchScope(c *gin.Context, uid int, folder string, q *persist.SearchQuery) bool {
+	if folder != "" && folder != "-1" {
+		f, ok := s.authorizeFolder(c, uid, folder, persist.PermissionView)
+		if !ok {
+			return false
+		}
+		ids, err := s.persist.SubtreeFolderIds(f.OwnerId, f.FolderID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, Response{
+				Message: "could not search folder",
+				Error:   err.Error(),
+			})
+			return false
+		}
+		q.FolderIds = ids
+		return true
+	}
+
+	q.OwnerId = uid
+	shared, err := s.persist.ListSharedWithUser(uid)
+	if err == nil {
+		for _, f := range shared {
+			var ids []string
+			ids, err = s.persist.SubtreeFolderIds(f.OwnerId, f.FolderID)
+			if err != nil {
+				break
+			}
+			q.FolderIds = append(q.FolderIds, ids...)
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not list shared folders",
+			Error:   err.Error(),
+		})
+		return false
+	}
+	return true
+}
+
+// indexContent stores the text of the blob hash for search, if content
+// indexing is on and ext is a type text can be extracted from. It is slow
+// for big files so callers run it in the background.
+func (s *Server) indexContent(hash, ext string) {
+	if !SEARCHCONTENT || !extract.Supported(ext) {
+		return
+	}
+	if done, err := s.persist.HasBlobText(hash); err != nil || done {
+		return
+	}
+
+	content, err := s.blobs.Open(hash)
+	if err != nil {
+		log.Printf("could not open blob %s for indexing: %v", hash, err)
+		return
+	}
+	defer content.Close()
+
+	// content text can't be read from is stored as empty, so it isn't
+	// tried again
+	text, err := extract.Text(ext, content, SEARCHCONTENTLIMIT)
+	if err != nil {
+		log.Printf("could not extract text of blob %s: %v", hash, err)
+		if !errors.Is(err, extract.ErrUnsupported) {
+			return
+		}
+	}
+	if err := s.persist.SaveBlobText(hash, text); err != nil {
+		log.Printf("could not save text of blob %s: %v", hash, err)
+	}
+}
+
+// IndexMissingContent indexes files uploaded before content indexing was
+// turned on.
+func (s *Server) IndexMissingContent() error {
+	if !SEARCHCONTENT {
+		return nil
+	}
+	files, err := s.persist.ListUnindexedFiles(extract.Extensions())
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		s.indexContent(f.Sha256, f.Extension)
+	}
+	if len(files) > 0 {
+		log.Printf("indexed the content of %d files", len(files))
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"avenue/backend/persist"
+	"avenue/backend/shared"
+	"avenue/backend/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/afero"
+)
+
+// testServer is a Server on the database at TEST_DB_HOST, keeping blobs and
+// scratch space in memory. Tests needing one are skipped without it.
+func testServer(t *testing.T) *Server {
+	t.Helper()
+	host := os.Getenv("TEST_DB_HOST")
+	if host == "" {
+		t.Skip("TEST_DB_HOST is not set")
+	}
+	p := persist.NewPersist(
+		host,
+		shared.GetEnv("TEST_DB_USER", "user"),
+		shared.GetEnv("TEST_DB_PASSWORD", "secret"),
+		shared.GetEnv("TEST_DB_DATABASE", "avenue"),
+	)
+	gin.SetMode(gin.TestMode)
+	s := SetupServer(p, persist.NewMemorySessionStore(), storage.NewMemoryStore())
+	s.fs = afero.NewMemMapFs()
+	s.SetupRoutes()
+	return &s
+}
+
+// testUser makes a user that is purged with everything they own when the
+// test ends.
+func testUser(t *testing.T, s *Server) int {
+	t.Helper()
+	u, err := s.persist.CreateUser(fmt.Sprintf("test-%d@example.com", time.Now().UnixNano()), "secret")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := s.persist.PurgeUser(int(u.ID)); err != nil {
+			t.Errorf("PurgeUser: %v", err)
+		}
+	})
+	return int(u.ID)
+}
+
+// serve sends a request as uid, the way a trusted proxy would.
+func serve(s *Server, uid int, method, target string, body io.Reader) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, body)
+	r.Header.Set(MASTERAUTHHEADER, AUTHKEY)
+	r.Header.Set(USERIDHEADER, strconv.Itoa(uid))
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, r)
+	return w
+}
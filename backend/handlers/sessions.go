@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"avenue/backend/persist"
+	"avenue/backend/shared"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// SESSIONTTL is how long a session lives without being used.
+	SESSIONTTL = shared.GetEnvDuration("SESSION_TTL", 12*time.Hour)
+	// sessionTouchInterval limits how often last-seen is written back.
+	sessionTouchInterval = time.Minute
+)
+
+// ReapSessions deletes expired and revoked sessions every interval until ctx is done.
+func (s *Server) ReapSessions(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n, err := s.sessions.DeleteExpired(time.Now())
+			if err != nil {
+				log.Printf("could not reap sessions: %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("reaped %d sessions", n)
+			}
+		}
+	}
+}
+
+type SessionResponse struct {
+	persist.Session
+	Current bool `json:"current"`
+}
+
+func (s *Server) ListSessions(c *gin.Context) {
+	ctx := c.Request.Context()
+	userId, err := shared.GetUserIdFromContext(ctx)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, Response{
+			Error: "User Id not found",
+		})
+		return
+	}
+
+	u, err := s.persist.GetUserByIdStr(userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, Response{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	sessions, err := s.sessions.ListActive(u.ID, time.Now())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, Response{
+			Message: "could not list sessions",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	current, _ := ctx.Value(shared.SESSIONCOOKIENAME).(string)
+	resp := make([]SessionResponse, 0, len(sessions))
+	for _, sess := range sessions {
+		resp = append(resp, SessionResponse{Session: sess, Current: sess.ID == current})
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) RevokeSession(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "user.session.revoke", TargetType: "session", TargetID: c.Param("sessionID")})
+
+	userId, err := shared.GetUserIdFromContext(c.Request.Context())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, Response{
+			Error: "User Id not found",
+		})
+		return
+	}
+
+	u, err := s.persist.GetUserByIdStr(userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, Response{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	err = s.sessions.Revoke(u.ID, c.Param("sessionID"))
+	if errors.Is(err, persist.ErrSessionNotFound) {
+		c.AbortWithStatusJSON(http.StatusNotFound, Response{
+			Message: "session not found",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, Response{
+			Message: "could not revoke session",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"avenue/backend/persist"
+)
+
+func TestReapSessions(t *testing.T) {
+	store := persist.NewMemorySessionStore()
+	s := SetupServer(nil, store, nil)
+
+	expired := persist.Session{UserID: 1, ExpiresAt: time.Now().Add(-time.Minute)}
+	active := persist.Session{UserID: 1, ExpiresAt: time.Now().Add(time.Hour)}
+	for _, sess := range []*persist.Session{&expired, &active} {
+		if err := store.Create(sess); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ReapSessions(ctx, 5*time.Millisecond)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := store.GetByToken(expired.Token)
+		if errors.Is(err, persist.ErrSessionNotFound) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expired session was never reaped")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := store.GetByToken(active.Token); err != nil {
+		t.Errorf("active session was reaped: %v", err)
+	}
+}
@@ -0,0 +1,709 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"avenue/backend/persist"
+	"avenue/backend/shared"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// SHAREPASSWORDHEADER carries the password of a protected share link.
+	// Browsers unlock the link once instead, see UnlockShare.
+	SHAREPASSWORDHEADER = "X-Share-Password"
+	// SHARETOKENHEADER carries a token returned by UnlockShare, for clients
+	// that don't keep the cookie.
+	SHARETOKENHEADER = "X-Share-Token"
+
+	shareContextKey      = "share"
+	shareOwnerContextKey = "share-owner"
+	shareCookieName      = "avenue_share"
+
+	// shareAttemptLimit wrong passwords per link and address are allowed
+	// every shareAttemptWindow.
+	shareAttemptLimit  = 10
+	shareAttemptWindow = 15 * time.Minute
+)
+
+var (
+	// SHAREUNLOCKTTL is how long an unlocked share link stays unlocked.
+	SHAREUNLOCKTTL = shared.GetEnvDuration("SHARE_UNLOCK_TTL", time.Hour)
+)
+
+type CreateShareReq struct {
+	ExpiresAt    *time.Time `json:"expires_at"`
+	Password     string     `json:"password" validate:"max=128"`
+	MaxDownloads int        `json:"max_downloads" validate:"min=0"`
+	// Mode is "read" (the default) or, for folders, "upload".
+	Mode string `json:"mode" validate:"omitempty,oneof=read upload"`
+}
+
+type ShareResponse struct {
+	Kind      string           `json:"kind"`
+	Mode      string           `json:"mode"`
+	ExpiresAt *time.Time       `json:"expires_at"`
+	File      *persist.File    `json:"file,omitempty"`
+	Folder    *persist.Folder  `json:"folder,omitempty"`
+	Files     []persist.File   `json:"files,omitempty"`
+	Folders   []persist.Folder `json:"folders,omitempty"`
+}
+
+// ShareFile creates a public link to a file. Co-owners may share what isn't
+// theirs.
+func (s *Server) ShareFile(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "share.create", TargetType: "file", TargetID: c.Param("fileID")})
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	f, ok := s.authorizeFile(c, uid, c.Param("fileID"), persist.PermissionManage)
+	if !ok {
+		return
+	}
+	s.createShare(c, uid, f.OwnerId, persist.ShareKindFile, f.ID)
+}
+
+// ShareFolder creates a public link to a folder and everything in it.
+// Co-owners may share what isn't theirs.
+func (s *Server) ShareFolder(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "share.create", TargetType: "folder", TargetID: c.Param("folderID")})
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	f, ok := s.authorizeFolder(c, uid, c.Param("folderID"), persist.PermissionManage)
+	if !ok {
+		return
+	}
+	s.createShare(c, uid, f.OwnerId, persist.ShareKindFolder, f.FolderID)
+}
+
+func (s *Server) createShare(c *gin.Context, uid, ownerId int, kind, targetId string) {
+	var req CreateShareReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "could not marshal all data to json",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "invalid share link",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = persist.ShareModeRead
+	}
+	if req.Mode == persist.ShareModeUpload && kind != persist.ShareKindFolder {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "invalid share link",
+			Error:   "only folders can be shared for upload",
+		})
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "invalid share link",
+			Error:   "expires_at must be in the future",
+		})
+		return
+	}
+
+	link := &persist.ShareLink{
+		OwnerId:      ownerId,
+		CreatedBy:    uid,
+		Kind:         kind,
+		TargetID:     targetId,
+		Mode:         req.Mode,
+		ExpiresAt:    req.ExpiresAt,
+		MaxDownloads: req.MaxDownloads,
+	}
+	if req.Password != "" {
+		hash, err := shared.HashPassword(req.Password)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, Response{
+				Message: "could not hash password",
+				Error:   err.Error(),
+			})
+			return
+		}
+		link.PasswordHash = hash
+	}
+
+	if _, err := s.persist.CreateShareLink(link); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not create share link",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, link)
+}
+
+func (s *Server) ListShares(c *gin.Context) {
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+
+	links, err := s.persist.ListShareLinks(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not list share links",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, links)
+}
+
+func (s *Server) RevokeShare(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "share.revoke", TargetType: "share", TargetID: c.Param("shareID")})
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+
+	if err := s.persist.RevokeShareLink(uid, c.Param("shareID")); err != nil {
+		lookupError(c, "share link", err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// shareLink resolves the :token of a public share route, checking that the
+// link is still usable: its owner must still be able to log in, and a
+// co-owner who made it must still manage what it shares.
+func (s *Server) shareLink(c *gin.Context) (*persist.ShareLink, bool) {
+	link, err := s.persist.GetShareLinkByToken(c.Param("token"))
+	if err != nil {
+		if errors.Is(err, persist.ErrNotFound) {
+			c.AbortWithStatusJSON(http.StatusNotFound, Response{
+				Message: "share link not found",
+			})
+			return nil, false
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, Response{
+			Message: "could not get share link",
+			Error:   err.Error(),
+		})
+		return nil, false
+	}
+	if !link.IsActive(time.Now()) {
+		c.AbortWithStatusJSON(http.StatusGone, Response{
+			Message: "share link has expired",
+		})
+		return nil, false
+	}
+
+	owner, ok := s.activeUser(strconv.Itoa(link.OwnerId))
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusGone, Response{
+			Message: "share link is no longer available",
+		})
+		return nil, false
+	}
+	if link.CreatedBy != 0 && link.CreatedBy != link.OwnerId {
+		perm := persist.PermissionNone
+		if _, ok := s.activeUser(strconv.Itoa(link.CreatedBy)); ok {
+			if link.Kind == persist.ShareKindFolder {
+				_, perm, err = s.persist.FolderPermission(link.CreatedBy, link.TargetID)
+			} else {
+				_, perm, err = s.persist.FilePermission(link.CreatedBy, link.TargetID)
+			}
+		}
+		if err != nil && !errors.Is(err, persist.ErrNotFound) {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, Response{
+				Message: "could not get share link",
+				Error:   err.Error(),
+			})
+			return nil, false
+		}
+		if perm < persist.PermissionManage {
+			c.AbortWithStatusJSON(http.StatusGone, Response{
+				Message: "share link is no longer available",
+			})
+			return nil, false
+		}
+	}
+	c.Set(shareOwnerContextKey, owner)
+	return link, true
+}
+
+// shareCheck resolves the link of a public share route. Protected links need
+// the password in SHAREPASSWORDHEADER, or a token from UnlockShare.
+func (s *Server) shareCheck(c *gin.Context) {
+	link, ok := s.shareLink(c)
+	if !ok {
+		return
+	}
+
+	if link.HasPassword() {
+		token := c.GetHeader(SHARETOKENHEADER)
+		if token == "" {
+			token, _ = c.Cookie(shareCookieName)
+		}
+		if !checkShareToken(link, token, time.Now()) {
+			pw := c.GetHeader(SHAREPASSWORDHEADER)
+			if pw == "" {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, Response{
+					Message: "share link needs a password",
+				})
+				return
+			}
+			if !s.checkSharePassword(c, link, pw) {
+				return
+			}
+		}
+	}
+
+	c.Set(shareContextKey, link)
+	c.Next()
+}
+
+type UnlockShareReq struct {
+	Password string `json:"password" validate:"required,max=128"`
+}
+
+type UnlockShareResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// UnlockShare trades the password of a protected link for a token that opens
+// it for SHAREUNLOCKTTL. The token is also set as a cookie, so browsers can
+// follow plain links to the share.
+func (s *Server) UnlockShare(c *gin.Context) {
+	link, ok := s.shareLink(c)
+	if !ok {
+		return
+	}
+	var req UnlockShareReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "could not marshal all data to json",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "invalid password",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if link.HasPassword() && !s.checkSharePassword(c, link, req.Password) {
+		return
+	}
+
+	expires := time.Now().Add(SHAREUNLOCKTTL).Truncate(time.Second)
+	token := shareToken(link, expires)
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     shareCookieName,
+		Value:    token,
+		Path:     "/s/" + link.Token,
+		Expires:  expires,
+		Secure:   c.Request.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	c.JSON(http.StatusOK, UnlockShareResponse{Token: token, ExpiresAt: expires})
+}
+
+// checkSharePassword checks pw is the password of link, throttling guesses.
+// If it isn't an error response has already been written.
+func (s *Server) checkSharePassword(c *gin.Context, link *persist.ShareLink, pw string) bool {
+	key := shareLoginKey(link, pw)
+	if s.shareLogins.ok(key) {
+		return true
+	}
+	attempt := link.ID + "\x00" + c.ClientIP()
+	if wait := s.shareAttempts.blocked(attempt, time.Now()); wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, Response{
+			Message: "too many wrong passwords, try again later",
+		})
+		return false
+	}
+	if ok, _, _ := shared.VerifyPassword(link.PasswordHash, pw); !ok {
+		s.shareAttempts.fail(attempt, time.Now())
+		c.AbortWithStatusJSON(http.StatusUnauthorized, Response{
+			Message: "share link needs a password",
+		})
+		return false
+	}
+	s.shareLogins.add(key)
+	return true
+}
+
+// shareLoginKey identifies a verified share password. It includes the stored
+// hash, so changing the password forgets it.
+func shareLoginKey(link *persist.ShareLink, pw string) [32]byte {
+	return sha256.Sum256([]byte(link.ID + "\x00" + pw + "\x00" + link.PasswordHash))
+}
+
+// shareToken signs that link is unlocked until expires. The password hash is
+// signed too, so changing the password locks the link again.
+func shareToken(link *persist.ShareLink, expires time.Time) string {
+	ts := strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, SIGNINGKEY)
+	mac.Write([]byte(link.ID + "\x00" + ts + "\x00" + link.PasswordHash))
+	return ts + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkShareToken reports whether token unlocks link at now.
+func checkShareToken(link *persist.ShareLink, token string, now time.Time) bool {
+	ts, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	n, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	expires := time.Unix(n, 0)
+	if !now.Before(expires) {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(shareToken(link, expires)))
+}
+
+// attemptLimiter counts failed attempts per key in fixed windows.
+type attemptLimiter struct {
+	mu    sync.Mutex
+	fails map[string]*attemptWindow
+}
+
+type attemptWindow struct {
+	count int
+	until time.Time
+}
+
+// blocked returns how long key has to wait before trying again, 0 if it
+// doesn't.
+func (l *attemptLimiter) blocked(key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w := l.fails[key]
+	if w == nil || !now.Before(w.until) || w.count < shareAttemptLimit {
+		return 0
+	}
+	return w.until.Sub(now)
+}
+
+func (l *attemptLimiter) fail(key string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.fails == nil {
+		l.fails = map[string]*attemptWindow{}
+	}
+	for k, w := range l.fails {
+		if !now.Before(w.until) {
+			delete(l.fails, k)
+		}
+	}
+	w := l.fails[key]
+	if w == nil {
+		w = &attemptWindow{until: now.Add(shareAttemptWindow)}
+		l.fails[key] = w
+	}
+	w.count++
+}
+
+// requestShare returns the link resolved by shareCheck if it allows mode. If
+// it doesn't an error response has already been written and ok is false.
+func requestShare(c *gin.Context, mode string) (*persist.ShareLink, bool) {
+	link := c.MustGet(shareContextKey).(*persist.ShareLink)
+	if link.Mode != mode {
+		c.JSON(http.StatusForbidden, Response{
+			Message: "share link does not allow this",
+		})
+		return nil, false
+	}
+	return link, true
+}
+
+// shareFolder returns folderId if it is inside the folder shared by link.
+func (s *Server) shareFolder(c *gin.Context, link *persist.ShareLink, folderId string) (*persist.Folder, bool) {
+	if link.Kind != persist.ShareKindFolder {
+		c.JSON(http.StatusNotFound, Response{Message: "folder not found"})
+		return nil, false
+	}
+	within, err := s.persist.IsFolderWithin(link.OwnerId, folderId, link.TargetID)
+	if err == nil && !within {
+		err = persist.ErrNotFound
+	}
+	if err != nil {
+		lookupError(c, "folder", err)
+		return nil, false
+	}
+	f, err := s.persist.GetOwnedFolder(link.OwnerId, folderId)
+	if err != nil {
+		lookupError(c, "folder", err)
+		return nil, false
+	}
+	return f, true
+}
+
+// countDownload uses up one download of link.
+func (s *Server) countDownload(c *gin.Context, link *persist.ShareLink) bool {
+	err := s.persist.CountShareDownload(link.ID)
+	if errors.Is(err, persist.ErrNotFound) {
+		c.JSON(http.StatusGone, Response{
+			Message: "share link has expired",
+		})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not count download",
+			Error:   err.Error(),
+		})
+		return false
+	}
+	return true
+}
+
+// GetShare describes what a link shares. For readable folder shares the
+// top level contents are included.
+func (s *Server) GetShare(c *gin.Context) {
+	link := c.MustGet(shareContextKey).(*persist.ShareLink)
+	resp := ShareResponse{Kind: link.Kind, Mode: link.Mode, ExpiresAt: link.ExpiresAt}
+
+	if link.Kind == persist.ShareKindFile {
+		f, err := s.persist.GetOwnedFile(link.OwnerId, link.TargetID)
+		if err != nil {
+			lookupError(c, "file", err)
+			return
+		}
+		resp.File = f
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	f, err := s.persist.GetOwnedFolder(link.OwnerId, link.TargetID)
+	if err != nil {
+		lookupError(c, "folder", err)
+		return
+	}
+	resp.Folder = f
+	if link.Mode == persist.ShareModeRead && !s.listShareFolder(c, link, f, &resp) {
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// ListSharedFolder lists a folder inside a folder share.
+func (s *Server) ListSharedFolder(c *gin.Context) {
+	link, ok := requestShare(c, persist.ShareModeRead)
+	if !ok {
+		return
+	}
+	f, ok := s.shareFolder(c, link, c.Param("folderID"))
+	if !ok {
+		return
+	}
+	resp := ShareResponse{Kind: link.Kind, Mode: link.Mode, ExpiresAt: link.ExpiresAt, Folder: f}
+	if !s.listShareFolder(c, link, f, &resp) {
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) listShareFolder(c *gin.Context, link *persist.ShareLink, f *persist.Folder, resp *ShareResponse) bool {
+	var err error
+	resp.Folders, err = s.persist.ListChildFolder(link.OwnerId, f.FolderID)
+	if err == nil {
+		resp.Files, err = s.persist.ListChildFile(link.OwnerId, f.FolderID)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not list folder",
+			Error:   err.Error(),
+		})
+		return false
+	}
+	return true
+}
+
+// DownloadShare downloads the shared file, or the shared folder as an
+// archive, see DownloadFolder.
+func (s *Server) DownloadShare(c *gin.Context) {
+	link, ok := requestShare(c, persist.ShareModeRead)
+	if !ok {
+		return
+	}
+
+	if link.Kind == persist.ShareKindFile {
+		f, err := s.persist.GetOwnedFile(link.OwnerId, link.TargetID)
+		if err != nil {
+			lookupError(c, "file", err)
+			return
+		}
+		s.serveSharedFile(c, link, f)
+		return
+	}
+
+	format, ok := archiveFormatQuery(c)
+	if !ok {
+		return
+	}
+	f, err := s.persist.GetOwnedFolder(link.OwnerId, link.TargetID)
+	if err != nil {
+		lookupError(c, "folder", err)
+		return
+	}
+	s.serveSharedArchive(c, link, f, format)
+}
+
+// DownloadSharedFolder downloads a folder inside a folder share as an
+// archive, see DownloadFolder.
+func (s *Server) DownloadSharedFolder(c *gin.Context) {
+	link, ok := requestShare(c, persist.ShareModeRead)
+	if !ok {
+		return
+	}
+	format, ok := archiveFormatQuery(c)
+	if !ok {
+		return
+	}
+	f, ok := s.shareFolder(c, link, c.Param("folderID"))
+	if !ok {
+		return
+	}
+	s.serveSharedArchive(c, link, f, format)
+}
+
+// GetSharedFile downloads a file inside a folder share.
+func (s *Server) GetSharedFile(c *gin.Context) {
+	link, ok := requestShare(c, persist.ShareModeRead)
+	if !ok {
+		return
+	}
+	f, err := s.persist.GetOwnedFile(link.OwnerId, c.Param("fileID"))
+	if err != nil {
+		lookupError(c, "file", err)
+		return
+	}
+	if _, ok := s.shareFolder(c, link, f.Parent); !ok {
+		return
+	}
+	s.serveSharedFile(c, link, f)
+}
+
+func (s *Server) serveSharedFile(c *gin.Context, link *persist.ShareLink, f *persist.File) {
+	defer s.audit(c, persist.AuditEvent{Action: "share.download", TargetType: "file", TargetID: f.ID, Detail: "share " + link.ID})
+
+	content, err := s.blobs.Open(f.Sha256)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not read file",
+			Error:   err.Error(),
+		})
+		return
+	}
+	defer content.Close()
+
+	// resuming, or revalidating a cached copy, isn't another download
+	if fullDownload(c.Request, f) && !s.countDownload(c, link) {
+		return
+	}
+	serveFile(c, f, content)
+}
+
+// fullDownload reports whether serveFile answers r with all of f, rather
+// than a range of it or 304 Not Modified.
+func fullDownload(r *http.Request, f *persist.File) bool {
+	etag := fmt.Sprintf("%q", f.Sha256)
+	modified := fileModTime(f).Truncate(time.Second)
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if f.Sha256 == "" {
+			return true
+		}
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+			if t == "*" || t == etag {
+				return false
+			}
+		}
+	} else if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		if !modified.After(ims) {
+			return false
+		}
+	}
+	if r.Header.Get("Range") == "" {
+		return true
+	}
+	// a stale If-Range asks for everything again
+	ir := r.Header.Get("If-Range")
+	if ir == "" || ir == etag {
+		return false
+	}
+	t, err := http.ParseTime(ir)
+	return err != nil || modified.After(t)
+}
+
+func (s *Server) serveSharedArchive(c *gin.Context, link *persist.ShareLink, f *persist.Folder, format archiveFormat) {
+	defer s.audit(c, persist.AuditEvent{Action: "share.download", TargetType: "folder", TargetID: f.FolderID, Detail: "share " + link.ID})
+
+	if !s.countDownload(c, link) {
+		return
+	}
+	serveArchive(c, format, f.Name, func(a archiveWriter) error {
+		return s.archiveFolder(a, link.OwnerId, f.FolderID, "")
+	})
+}
+
+// UploadToShare adds a file to the folder of an upload share. It counts
+// against the owner's quota.
+func (s *Server) UploadToShare(c *gin.Context) {
+	link, ok := requestShare(c, persist.ShareModeUpload)
+	if !ok {
+		return
+	}
+	// read-only owners can't add files themselves, nor through their links
+	if owner := c.MustGet(shareOwnerContextKey).(persist.User); owner.Role == persist.UserRoleReadOnly {
+		c.JSON(http.StatusForbidden, Response{
+			Message: "share link does not allow this",
+		})
+		return
+	}
+	if _, err := s.persist.GetOwnedFolder(link.OwnerId, link.TargetID); err != nil {
+		lookupError(c, "folder", err)
+		return
+	}
+
+	up, ok := s.readMultipartUpload(c, link.OwnerId)
+	if !ok {
+		return
+	}
+	defer up.discard()
+
+	if _, err := s.saveContent(up.staged, link.OwnerId, 0, link.TargetID, up.filename, nil); err != nil {
+		saveError(c, err)
+		return
+	}
+
+	c.Status(http.StatusCreated)
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"avenue/backend/persist"
+	"avenue/backend/shared"
+	"avenue/backend/thumbnail"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// THUMBNAILATTEMPTS is how many times rendering a thumbnail is tried
+	// before giving up on it.
+	THUMBNAILATTEMPTS = int(shared.GetEnvInt64("THUMBNAIL_MAX_ATTEMPTS", 5))
+	// thumbnailSizes are the sizes rendered for every file, smallest first.
+	thumbnailSizes = []int{128, 256, 512}
+)
+
+// thumbnailLease is how long a claimed job is left alone. If the worker dies
+// while rendering, the job is picked up again after it.
+const thumbnailLease = 10 * time.Minute
+
+// queueThumbnail queues thumbnails for the blob hash if files with extension
+// ext can have them. They are rendered by RunThumbnails, in the background.
+func (s *Server) queueThumbnail(hash, ext string) {
+	if hash == "" || !thumbnail.Supported(ext) {
+		return
+	}
+	if done, err := s.persist.HasThumbnails(hash); err != nil || done {
+		return
+	}
+	if err := s.persist.QueueThumbnail(hash, ext); err != nil {
+		log.Printf("could not queue thumbnail of blob %s: %v", hash, err)
+		return
+	}
+	select {
+	case s.thumbnailWake <- struct{}{}:
+	default:
+	}
+}
+
+// RunThumbnails renders queued thumbnails until ctx is done, whenever one is
+// queued and every interval for retries.
+func (s *Server) RunThumbnails(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		s.runThumbnailJobs()
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-s.thumbnailWake:
+		}
+	}
+}
+
+// runThumbnailJobs works through every job that is due.
+func (s *Server) runThumbnailJobs() {
+	for {
+		jobs, err := s.persist.ClaimThumbnailJobs(10, thumbnailLease)
+		if err != nil {
+			log.Printf("could not claim thumbnail jobs: %v", err)
+			return
+		}
+		if len(jobs) == 0 {
+			return
+		}
+		for _, j := range jobs {
+			s.runThumbnailJob(j)
+		}
+	}
+}
+
+// runThumbnailJob renders the thumbnails of one job. Failures are retried
+// with backoff, unless the content can't ever be previewed.
+func (s *Server) runThumbnailJob(j persist.ThumbnailJob) {
+	thumbs, err := s.renderThumbnails(j.Hash, j.Extension)
+	if err == nil {
+		err = s.persist.FinishThumbnailJob(j.Hash, thumbs)
+	}
+	if err == nil {
+		return
+	}
+
+	// Attempts was read before this attempt was counted
+	attempts := j.Attempts + 1
+	if errors.Is(err, thumbnail.ErrUnsupported) || attempts >= THUMBNAILATTEMPTS {
+		log.Printf("giving up on thumbnail of blob %s: %v", j.Hash, err)
+		err = s.persist.FailThumbnailJob(j.Hash, err.Error())
+	} else {
+		log.Printf("could not render thumbnail of blob %s, will retry: %v", j.Hash, err)
+		retry := min(time.Minute<<j.Attempts, time.Hour)
+		err = s.persist.RetryThumbnailJob(j.Hash, err.Error(), time.Now().Add(retry))
+	}
+	if err != nil {
+		log.Printf("could not update thumbnail job of blob %s: %v", j.Hash, err)
+	}
+}
+
+func (s *Server) renderThumbnails(hash, ext string) ([]persist.Thumbnail, error) {
+	content, err := s.blobs.Open(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	images, err := thumbnail.Generate(ext, content, thumbnailSizes)
+	if err != nil {
+		return nil, err
+	}
+	thumbs := make([]persist.Thumbnail, len(images))
+	for i, img := range images {
+		thumbs[i] = persist.Thumbnail{
+			Hash:        hash,
+			Size:        img.Size,
+			ContentType: img.ContentType,
+			Data:        img.Data,
+		}
+	}
+	return thumbs, nil
+}
+
+// GetThumbnail serves a preview of a file, of images scaled down and of text
+// files their first page. ?size= picks the smallest rendered size at least
+// that many pixels, 256 by default. While the preview is still being
+// rendered the answer is a 202 with Retry-After; files that can't have one
+// are a 404.
+func (s *Server) GetThumbnail(c *gin.Context) {
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	size := 256
+	if v := c.Query("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			c.JSON(http.StatusBadRequest, Response{
+				Message: "invalid size",
+				Error:   fmt.Sprintf("size must be a positive number of pixels, not %q", v),
+			})
+			return
+		}
+		size = thumbnailSizes[len(thumbnailSizes)-1]
+		for _, sz := range thumbnailSizes {
+			if sz >= n {
+				size = sz
+				break
+			}
+		}
+	}
+
+	file, ok := s.authorizeFile(c, uid, c.Param("fileID"), persist.PermissionView)
+	if !ok {
+		return
+	}
+	if file.Sha256 == "" || !thumbnail.Supported(file.Extension) {
+		c.JSON(http.StatusNotFound, Response{
+			Message: "file has no thumbnail",
+		})
+		return
+	}
+
+	thumb, err := s.persist.GetThumbnail(file.Sha256, size)
+	if errors.Is(err, persist.ErrNotFound) {
+		s.thumbnailPending(c, file)
+		return
+	}
+	if err != nil {
+		lookupError(c, "thumbnail", err)
+		return
+	}
+
+	// the content, and so the thumbnail, of a file changes with new versions
+	c.Header("Content-Type", thumb.ContentType)
+	c.Header("ETag", fmt.Sprintf(`"%s-%d"`, thumb.Hash, thumb.Size))
+	c.Header("Cache-Control", "private, max-age=300")
+	http.ServeContent(c.Writer, c.Request, "", thumb.CreatedAt, bytes.NewReader(thumb.Data))
+}
+
+// thumbnailPending answers a request for a thumbnail that isn't rendered
+// yet, queueing it for files uploaded before thumbnails were made.
+func (s *Server) thumbnailPending(c *gin.Context, file *persist.File) {
+	job, err := s.persist.GetThumbnailJob(file.Sha256)
+	switch {
+	case errors.Is(err, persist.ErrNotFound):
+		s.queueThumbnail(file.Sha256, file.Extension)
+	case err != nil:
+		lookupError(c, "thumbnail", err)
+		return
+	case job.Failed:
+		c.JSON(http.StatusNotFound, Response{
+			Message: "file has no thumbnail",
+			Error:   job.LastError,
+		})
+		return
+	}
+
+	c.Header("Retry-After", "5")
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusAccepted, Response{
+		Message: "thumbnail is being rendered",
+	})
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"avenue/backend/persist"
+	"avenue/backend/shared"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TRASHRETENTION is how long deleted items stay in the trash before the
+// janitor purges them.
+var TRASHRETENTION = shared.GetEnvDuration("TRASH_RETENTION", 30*24*time.Hour)
+
+func (s *Server) ListTrash(c *gin.Context) {
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+
+	items, err := s.persist.ListTrash(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not list trash",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, items)
+}
+
+func (s *Server) RestoreTrash(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "trash.restore", TargetType: "trash", TargetID: c.Param("itemID")})
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+
+	if err := s.persist.RestoreTrash(uid, c.Param("itemID")); err != nil {
+		lookupError(c, "trash item", err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func (s *Server) PurgeTrashItem(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "trash.purge", TargetType: "trash", TargetID: c.Param("itemID")})
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+
+	if err := s.purgeTrashItem(uid, c.Param("itemID")); err != nil {
+		lookupError(c, "trash item", err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) EmptyTrash(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "trash.empty"})
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+
+	items, err := s.persist.ListTrash(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not list trash",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	for _, item := range items {
+		if err := s.purgeTrashItem(uid, item.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, Response{
+				Message: "could not empty trash",
+				Error:   err.Error(),
+			})
+			return
+		}
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// purgeTrashItem permanently deletes a trashed item and everything that went
+// with it. Their content is left for the blob garbage collector.
+func (s *Server) purgeTrashItem(ownerId int, id string) error {
+	if _, err := s.persist.PurgeTrash(ownerId, id); err != nil {
+		return err
+	}
+	s.refreshUsage(ownerId)
+	return nil
+}
+
+// JanitorTrash purges items that have been in the trash longer than retention,
+// checking every interval until ctx is done.
+func (s *Server) JanitorTrash(ctx context.Context, interval, retention time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			items, err := s.persist.ListTrashBefore(time.Now().Add(-retention))
+			if err != nil {
+				log.Printf("could not list expired trash: %v", err)
+				continue
+			}
+			for _, item := range items {
+				if err := s.purgeTrashItem(item.OwnerId, item.ID); err != nil && !errors.Is(err, persist.ErrNotFound) {
+					log.Printf("could not purge %s %s: %v", item.Kind, item.ID, err)
+				}
+			}
+			if len(items) > 0 {
+				log.Printf("purged %d trash items", len(items))
+			}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+
+	"avenue/backend/persist"
+)
+
+// treeNode is what a path names: a folder, a file, or the top level when
+// both are nil.
+type treeNode struct {
+	folder *persist.Folder
+	file   *persist.File
+}
+
+func (n treeNode) isDir() bool {
+	return n.file == nil
+}
+
+// folderID is the id of a folder node, "" for the top level.
+func (n treeNode) folderID() string {
+	if n.folder == nil {
+		return ""
+	}
+	return n.folder.FolderID
+}
+
+// splitPath splits a slash separated path into its names, none for the top level.
+func splitPath(name string) []string {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+// davError turns persist.ErrNotFound into the error file systems report.
+func davError(err error) error {
+	if errors.Is(err, persist.ErrNotFound) {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+// resolvePath finds what the path parts name in the tree of uid.
+func (s *Server) resolvePath(uid int, parts []string) (treeNode, error) {
+	var n treeNode
+	for i, part := range parts {
+		folder, err := s.persist.GetFolderByName(uid, n.folderID(), part)
+		if err == nil {
+			n = treeNode{folder: folder}
+			continue
+		}
+		if !errors.Is(err, persist.ErrNotFound) {
+			return n, err
+		}
+		if i < len(parts)-1 {
+			return n, os.ErrNotExist
+		}
+		file, err := s.persist.GetFileByName(uid, n.folderID(), part)
+		if err != nil {
+			return n, davError(err)
+		}
+		return treeNode{file: file}, nil
+	}
+	return n, nil
+}
@@ -0,0 +1,541 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"avenue/backend/persist"
+	"avenue/backend/shared"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Resumable uploads implement the tus 1.0.0 core protocol with the creation,
+// termination and expiration extensions:
+// https://tus.io/protocols/resumable-upload
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+)
+
+// UPLOADTTL is how long a resumable upload is kept after the last byte
+// arrived before it is abandoned.
+var UPLOADTTL = shared.GetEnvDuration("UPLOAD_TTL", 24*time.Hour)
+
+// keyedMutex hands out one lock per key, so PATCHes to the same upload are
+// applied one at a time. Locks are dropped once nobody holds or waits on them.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*refMutex
+}
+
+type refMutex struct {
+	sync.Mutex
+	refs int
+}
+
+func (k *keyedMutex) Lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*refMutex)
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &refMutex{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+func uploadPartPath(u *persist.Upload) string {
+	return fmt.Sprintf("/%d/.tus-%s", u.OwnerId, u.ID)
+}
+
+func uploadExpires(u *persist.Upload) time.Time {
+	return u.UpdatedAt.Add(UPLOADTTL)
+}
+
+func setUploadExpires(c *gin.Context, u *persist.Upload) {
+	c.Header("Upload-Expires", uploadExpires(u).UTC().Format(http.TimeFormat))
+}
+
+// tusHeaders is middleware that checks the Tus-Resumable header and echoes it
+// on every response.
+func tusHeaders(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	if c.Request.Method == http.MethodOptions {
+		c.Next()
+		return
+	}
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.AbortWithStatus(http.StatusPreconditionFailed)
+		return
+	}
+	c.Next()
+}
+
+func (s *Server) TusOptions(c *gin.Context) {
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	c.Header("Tus-Max-Size", strconv.FormatInt(MAXUPLOADSIZE, 10))
+	c.Status(http.StatusNoContent)
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated
+// "key base64(value)" pairs, where the value may be omitted.
+func parseTusMetadata(h string) (map[string]string, error) {
+	md := make(map[string]string)
+	if strings.TrimSpace(h) == "" {
+		return md, nil
+	}
+	for _, pair := range strings.Split(h, ",") {
+		kv := strings.Fields(pair)
+		switch len(kv) {
+		case 1:
+			md[kv[0]] = ""
+		case 2:
+			v, err := base64.StdEncoding.DecodeString(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("metadata %q: %w", kv[0], err)
+			}
+			md[kv[0]] = string(v)
+		default:
+			return nil, fmt.Errorf("malformed metadata pair %q", pair)
+		}
+	}
+	return md, nil
+}
+
+// CreateUpload starts a resumable upload. The filename and optional parent
+// folder are taken from the "filename" and "parent" metadata keys.
+func (s *Server) CreateUpload(c *gin.Context) {
+	// an empty upload is a file right away
+	ev := persist.AuditEvent{Action: "upload.create", TargetType: "upload"}
+	defer func() {
+		s.audit(c, ev)
+	}()
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "Upload-Length must be a non-negative integer",
+		})
+		return
+	}
+	if length > MAXUPLOADSIZE {
+		c.JSON(http.StatusRequestEntityTooLarge, Response{
+			Message: "file is too large",
+		})
+		return
+	}
+
+	md, err := parseTusMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "could not parse Upload-Metadata",
+			Error:   err.Error(),
+		})
+		return
+	}
+	name := filepath.Base(md["filename"])
+	if md["filename"] == "" {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "filename metadata is required",
+		})
+		return
+	}
+
+	parent := md["parent"]
+	if parent == "-1" {
+		parent = ""
+	}
+	// uploads into a shared folder count against its owner's quota
+	owner, ok := s.authorizeParent(c, uid, parent)
+	if !ok {
+		return
+	}
+
+	remaining, limited, err := s.remainingQuota(owner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not check quota",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if limited && length > remaining {
+		c.JSON(http.StatusRequestEntityTooLarge, Response{
+			Message: "file is too large",
+			Error:   ErrQuotaExceeded.Error(),
+		})
+		return
+	}
+
+	if err := s.fs.MkdirAll(fmt.Sprintf("/%d", uid), os.ModePerm); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "error could not make dir",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	u := persist.Upload{
+		OwnerId:     uid,
+		FileOwnerId: owner,
+		Name:        name,
+		Parent:      parent,
+		Length:      length,
+	}
+	if _, err := s.persist.CreateUpload(&u); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not create upload",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	f, err := s.fs.Create(uploadPartPath(&u))
+	if err != nil {
+		_ = s.persist.DeleteUpload(u.ID)
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not create file",
+			Error:   err.Error(),
+		})
+		return
+	}
+	f.Close()
+
+	ev.TargetID = u.ID
+
+	// zero length uploads are complete as soon as they are created, their
+	// record is gone so there is nowhere to point Location
+	if length == 0 {
+		fileId, err := s.finishUpload(&u)
+		if errors.Is(err, ErrQuotaExceeded) {
+			saveError(c, err)
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, Response{
+				Message: "could not finish upload",
+				Error:   err.Error(),
+			})
+			return
+		}
+		ev = persist.AuditEvent{Action: "file.upload", TargetType: "file", TargetID: fileId, Detail: "upload " + u.ID}
+	} else {
+		c.Header("Location", fmt.Sprintf("/v1/uploads/%s", u.ID))
+		setUploadExpires(c, &u)
+	}
+
+	c.Header("Upload-Offset", "0")
+	c.Status(http.StatusCreated)
+}
+
+func (s *Server) HeadUpload(c *gin.Context) {
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+
+	u, err := s.persist.GetOwnedUpload(uid, c.Param("uploadID"))
+	if err != nil {
+		if errors.Is(err, persist.ErrNotFound) {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	if time.Now().After(uploadExpires(u)) {
+		c.Status(http.StatusGone)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(u.Length, 10))
+	setUploadExpires(c, u)
+	c.Status(http.StatusOK)
+}
+
+// PatchUpload appends the request body to an upload at Upload-Offset. When the
+// last byte arrives the upload is turned into a regular file.
+func (s *Server) PatchUpload(c *gin.Context) {
+	// the last part makes it a file
+	ev := persist.AuditEvent{Action: "upload.patch", TargetType: "upload", TargetID: c.Param("uploadID")}
+	defer func() {
+		s.audit(c, ev)
+	}()
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+
+	if c.ContentType() != "application/offset+octet-stream" {
+		c.JSON(http.StatusUnsupportedMediaType, Response{
+			Message: "Content-Type must be application/offset+octet-stream",
+		})
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "Upload-Offset must be a non-negative integer",
+		})
+		return
+	}
+
+	unlock := s.uploadLocks.Lock(c.Param("uploadID"))
+	defer unlock()
+
+	u, err := s.persist.GetOwnedUpload(uid, c.Param("uploadID"))
+	if err != nil {
+		lookupError(c, "upload", err)
+		return
+	}
+	if time.Now().After(uploadExpires(u)) {
+		c.JSON(http.StatusGone, Response{
+			Message: "upload expired",
+		})
+		return
+	}
+	if offset != u.Offset {
+		c.Header("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+		c.JSON(http.StatusConflict, Response{
+			Message: "Upload-Offset does not match the current offset",
+		})
+		return
+	}
+
+	f, err := s.fs.OpenFile(uploadPartPath(u), os.O_WRONLY, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not open upload",
+			Error:   err.Error(),
+		})
+		return
+	}
+	// anything past the offset is from an earlier PATCH that was cut off
+	// before its offset was saved
+	if err := f.Truncate(u.Offset); err != nil {
+		f.Close()
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not open upload",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if _, err := f.Seek(u.Offset, io.SeekStart); err != nil {
+		f.Close()
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not open upload",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	// keep whatever made it to disk even if the connection drops, that is
+	// the whole point of resuming
+	n, copyErr := io.Copy(f, io.LimitReader(c.Request.Body, u.Length-u.Offset))
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	u.Offset += n
+	if err := s.persist.UpdateUploadOffset(u.ID, u.Offset); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not save upload offset",
+			Error:   err.Error(),
+		})
+		return
+	}
+	// saving the offset counts as activity, pushing the expiry back
+	u.UpdatedAt = time.Now()
+	if copyErr != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not write to file",
+			Error:   copyErr.Error(),
+		})
+		return
+	}
+
+	if u.Offset == u.Length {
+		fileId, err := s.finishUpload(u)
+		if errors.Is(err, ErrQuotaExceeded) {
+			saveError(c, err)
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, Response{
+				Message: "could not finish upload",
+				Error:   err.Error(),
+			})
+			return
+		}
+		ev = persist.AuditEvent{Action: "file.upload", TargetType: "file", TargetID: fileId, Detail: "upload " + u.ID}
+	} else {
+		setUploadExpires(c, u)
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	c.Status(http.StatusNoContent)
+}
+
+// finishUpload moves a complete upload from staging into the blob store and
+// records it as a file.
+func (s *Server) finishUpload(u *persist.Upload) (string, error) {
+	partPath := uploadPartPath(u)
+	f, err := s.fs.Open(partPath)
+	if err != nil {
+		return "", err
+	}
+	staged, err := s.blobs.Stage(f)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+
+	// the parent may have gone away, or been unshared, while the upload was in
+	// progress, the file then lands in the uploader's top level
+	parent, owner := u.Parent, u.FileOwner()
+	if parent != "" {
+		folder, perm, err := s.persist.FolderPermission(u.OwnerId, parent)
+		if err != nil && !errors.Is(err, persist.ErrNotFound) {
+			_ = staged.Discard()
+			return "", err
+		}
+		if err != nil || perm < persist.PermissionEdit || folder.OwnerId != owner {
+			parent, owner = "", u.OwnerId
+		}
+	}
+
+	file, err := s.saveContent(staged, owner, u.OwnerId, parent, u.Name, nil)
+	if err != nil {
+		_ = staged.Discard()
+		return "", err
+	}
+
+	if err := s.fs.Remove(partPath); err != nil {
+		log.Printf("could not remove staged upload %s: %v", u.ID, err)
+	}
+	return file.ID, s.persist.DeleteUpload(u.ID)
+}
+
+// TerminateUpload abandons an upload and frees its space.
+func (s *Server) TerminateUpload(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "upload.terminate", TargetType: "upload", TargetID: c.Param("uploadID")})
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+
+	unlock := s.uploadLocks.Lock(c.Param("uploadID"))
+	defer unlock()
+
+	u, err := s.persist.GetOwnedUpload(uid, c.Param("uploadID"))
+	if err != nil {
+		lookupError(c, "upload", err)
+		return
+	}
+
+	if err := s.fs.Remove(uploadPartPath(u)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "error deleting upload from file system",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err := s.persist.DeleteUpload(u.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "error deleting upload from db",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// JanitorUploads abandons resumable uploads that saw no activity for longer
+// than ttl, checking every interval until ctx is done.
+func (s *Server) JanitorUploads(ctx context.Context, interval, ttl time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			uploads, err := s.persist.ListUploadsBefore(time.Now().Add(-ttl))
+			if err != nil {
+				log.Printf("could not list expired uploads: %v", err)
+				continue
+			}
+			expired := 0
+			for i := range uploads {
+				ok, err := s.expireUpload(&uploads[i], ttl)
+				if err != nil {
+					log.Printf("could not remove expired upload %s: %v", uploads[i].ID, err)
+				}
+				if ok {
+					expired++
+				}
+			}
+			if expired > 0 {
+				log.Printf("removed %d expired uploads", expired)
+			}
+		}
+	}
+}
+
+// expireUpload removes an upload and its staged bytes, unless a PATCH moved it
+// on since it was listed.
+func (s *Server) expireUpload(u *persist.Upload, ttl time.Duration) (bool, error) {
+	unlock := s.uploadLocks.Lock(u.ID)
+	defer unlock()
+	u, err := s.persist.GetOwnedUpload(u.OwnerId, u.ID)
+	if errors.Is(err, persist.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if time.Since(u.UpdatedAt) < ttl {
+		return false, nil
+	}
+	if err := s.fs.Remove(uploadPartPath(u)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	return true, s.persist.DeleteUpload(u.ID)
+}
@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"avenue/backend/persist"
+	"avenue/backend/shared"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DEFAULTQUOTA is the quota in bytes of users without their own, 0 means
+// unlimited.
+var DEFAULTQUOTA = shared.GetEnvInt64("DEFAULT_QUOTA_BYTES", 0)
+
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// quotaFor returns u's quota in bytes, 0 means unlimited.
+func quotaFor(u persist.User) int64 {
+	if u.QuotaBytes != nil {
+		return *u.QuotaBytes
+	}
+	return DEFAULTQUOTA
+}
+
+// remainingQuota returns how many more bytes uid may store. limited is false
+// if the user has no quota at all.
+func (s *Server) remainingQuota(uid int) (remaining int64, limited bool, err error) {
+	u, err := s.persist.GetUserById(uid)
+	if err != nil {
+		return 0, false, err
+	}
+	quota := quotaFor(u)
+	if quota <= 0 {
+		return 0, false, nil
+	}
+	return max(quota-u.UsedBytes, 0), true, nil
+}
+
+// checkQuota checks uid has room for size more bytes. If not an error
+// response has already been written and ok is false.
+func (s *Server) checkQuota(c *gin.Context, uid int, size int64) bool {
+	remaining, limited, err := s.remainingQuota(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not check quota",
+			Error:   err.Error(),
+		})
+		return false
+	}
+	if limited && size > remaining {
+		c.JSON(http.StatusRequestEntityTooLarge, Response{
+			Message: "file is too large",
+			Error:   ErrQuotaExceeded.Error(),
+		})
+		return false
+	}
+	return true
+}
+
+// lockQuota holds the quota of uid while size more bytes are committed, so
+// parallel uploads can't each take the same room. It fails with
+// ErrQuotaExceeded if they don't fit. Usage is refreshed before unlocking.
+func (s *Server) lockQuota(uid int, size int64) (unlock func(), err error) {
+	unlock = s.uploadLocks.Lock("quota-" + strconv.Itoa(uid))
+	remaining, limited, err := s.remainingQuota(uid)
+	if err == nil && limited && size > remaining {
+		err = ErrQuotaExceeded
+	}
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	return unlock, nil
+}
+
+// refreshUsage recomputes uid's cached usage after files were added or removed.
+func (s *Server) refreshUsage(uid int) {
+	if _, err := s.persist.RefreshUsage(uid); err != nil {
+		log.Printf("could not refresh usage for user %d: %v", uid, err)
+	}
+}
+
+// quotaReader fails with ErrQuotaExceeded once more than remaining bytes have
+// been read through it.
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	q.remaining -= int64(n)
+	if q.remaining < 0 {
+		return n, ErrQuotaExceeded
+	}
+	return n, err
+}
+
+type UsageResponse struct {
+	QuotaBytes  int64                 `json:"quotaBytes"`
+	UsedBytes   int64                 `json:"usedBytes"`
+	ByFolder    []persist.UsageBucket `json:"byFolder"`
+	ByExtension []persist.UsageBucket `json:"byExtension"`
+}
+
+func (s *Server) GetUsage(c *gin.Context) {
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+
+	used, err := s.persist.RefreshUsage(uid)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, Response{
+			Message: "could not compute usage",
+			Error:   err.Error(),
+		})
+		return
+	}
+	u, err := s.persist.GetUserById(uid)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, Response{
+			Error: err.Error(),
+		})
+		return
+	}
+	byFolder, err := s.persist.UsageByFolder(uid)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, Response{
+			Message: "could not compute usage",
+			Error:   err.Error(),
+		})
+		return
+	}
+	byExt, err := s.persist.UsageByExtension(uid)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, Response{
+			Message: "could not compute usage",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, UsageResponse{
+		QuotaBytes:  quotaFor(u),
+		UsedBytes:   used,
+		ByFolder:    byFolder,
+		ByExtension: byExt,
+	})
+}
@@ -12,7 +12,6 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
-	"github.com/google/uuid"
 )
 
 type LoginRequest struct {
@@ -20,18 +19,14 @@ type LoginRequest struct {
 	Password string `json:"password" validate:"required,min=4,max=64"`
 }
 
-var Sessions map[string]SessionData
-
-type SessionData struct {
-	ExpiresAt time.Time
-	IsValid   bool
-	UserId    uint
-}
-
 var validate = validator.New()
 
 func (s *Server) Login(c *gin.Context) {
 	var req LoginRequest
+	var actor *int
+	defer func() {
+		s.audit(c, persist.AuditEvent{Action: "user.login", ActorID: actor, Detail: req.Email})
+	}()
 
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.Status(http.StatusBadRequest)
@@ -54,17 +49,26 @@ func (s *Server) Login(c *gin.Context) {
 		return
 	}
 
-	uuidStr := uuid.NewString()
+	uid := int(u.ID)
+	actor = &uid
 
-	Sessions[uuidStr] = SessionData{
-		ExpiresAt: time.Now().Add(12 * time.Hour),
-		IsValid:   true,
-		UserId:    u.ID,
+	sess := persist.Session{
+		UserID:    u.ID,
+		Device:    c.Request.UserAgent(),
+		IP:        c.ClientIP(),
+		ExpiresAt: time.Now().Add(SESSIONTTL),
+	}
+	if err := s.sessions.Create(&sess); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, Response{
+			Message: "could not create session",
+			Error:   err.Error(),
+		})
+		return
 	}
 
 	c.SetCookie(shared.USERCOOKIENAME, fmt.Sprintf("%d", u.ID), 600, "/", "localhost", false, true)
-	c.SetCookie(shared.SESSIONCOOKIENAME, uuidStr, 600, "/", "localhost", false, true)
-	c.JSON(http.StatusOK, gin.H{"Message": "OK", "User-Id": u.ID, shared.SESSIONCOOKIENAME: uuidStr})
+	c.SetCookie(shared.SESSIONCOOKIENAME, sess.Token, 600, "/", "localhost", false, true)
+	c.JSON(http.StatusOK, gin.H{"Message": "OK", "User-Id": u.ID, shared.SESSIONCOOKIENAME: sess.Token})
 }
 
 func (s *Server) authorize(email, password string) (persist.User, error) {
@@ -73,18 +77,33 @@ func (s *Server) authorize(email, password string) (persist.User, error) {
 		return user, err
 	}
 
-	if user.Password != password {
+	ok, needsRehash, err := shared.VerifyPassword(user.Password, password)
+	if err != nil {
+		return user, err
+	}
+	if !ok {
 		return user, errors.New("Password incorrect")
 	}
+	if !user.CanLogin {
+		return user, errors.New("Login is disabled for this user")
+	}
+
+	// upgrade legacy plaintext rows (and hashes with old parameters) now that we know the password
+	if needsRehash {
+		if err := s.persist.UpdatePassword(user.ID, password); err != nil {
+			log.Printf("could not rehash password for user %d: %v", user.ID, err)
+		}
+	}
 
 	return user, nil
 }
 
 func (s *Server) Logout(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "user.logout"})
+
 	// expire the cookie
 	c.SetCookie(shared.USERCOOKIENAME, "", -1, "/", "localhost", false, true)
 
-	// TODO delete the session from map
 	ctx := c.Request.Context()
 
 	sessID := ctx.Value(shared.SESSIONCOOKIENAME)
@@ -95,16 +114,22 @@ func (s *Server) Logout(c *gin.Context) {
 		return
 	}
 
-	v, ok := Sessions[sessIDStr]
-	if !ok {
+	userId, err := shared.GetUserIdFromContext(ctx)
+	if err != nil {
 		c.Status(http.StatusBadRequest)
 		return
 	}
 
-	v.IsValid = false
-	v.ExpiresAt = time.Now()
+	u, err := s.persist.GetUserByIdStr(userId)
+	if err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
 
-	Sessions[sessIDStr] = v
+	if err := s.sessions.Revoke(u.ID, sessIDStr); err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
 
 	c.JSON(http.StatusOK, Response{Message: "OK"})
 }
@@ -153,6 +178,7 @@ func (s *Server) Register(c *gin.Context) {
 		})
 		return
 	}
+	s.queueUserWebhook("create", u)
 
 	c.JSON(http.StatusCreated, u)
 }
@@ -183,6 +209,11 @@ type UpdateProfileRequest struct {
 }
 
 func (s *Server) UpdateProfile(c *gin.Context) {
+	var detail string
+	defer func() {
+		s.audit(c, persist.AuditEvent{Action: "user.profile.update", Detail: detail})
+	}()
+
 	ctx := c.Request.Context()
 	userId, err := shared.GetUserIdFromContext(ctx)
 	if err != nil {
@@ -226,6 +257,7 @@ func (s *Server) UpdateProfile(c *gin.Context) {
 			return
 		}
 
+		detail = "email changed from " + u.Email + " to " + req.Email
 		u.Email = req.Email
 	}
 
@@ -245,6 +277,8 @@ type UpdatePasswordRequest struct {
 }
 
 func (s *Server) UpdatePassword(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "user.password.update"})
+
 	ctx := c.Request.Context()
 	userId, err := shared.GetUserIdFromContext(ctx)
 	if err != nil {
@@ -278,10 +312,7 @@ func (s *Server) UpdatePassword(c *gin.Context) {
 		return
 	}
 
-	u.Password = req.Password
-
-	u, err = s.persist.UpdateUser(u)
-	if err != nil {
+	if err := s.persist.UpdatePassword(u.ID, req.Password); err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, Response{
 			Error: err.Error(),
 		})
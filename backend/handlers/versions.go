@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"avenue/backend/persist"
+
+	"github.com/gin-gonic/gin"
+)
+
+type FileVersionsResponse struct {
+	Current  *persist.File         `json:"current"`
+	Versions []persist.FileVersion `json:"versions"`
+}
+
+// UploadFileVersion replaces the content of an existing file with a new
+// upload, keeping the previous content as a version. It takes an editor, and
+// counts against the owner's quota.
+func (s *Server) UploadFileVersion(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "file.version.create", TargetType: "file", TargetID: c.Param("fileID")})
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	file, ok := s.authorizeFile(c, uid, c.Param("fileID"), persist.PermissionEdit)
+	if !ok {
+		return
+	}
+
+	up, ok := s.readMultipartUpload(c, file.OwnerId)
+	if !ok {
+		return
+	}
+	defer up.discard()
+
+	f, err := s.saveContent(up.staged, file.OwnerId, uid, "", "", file)
+	if err != nil {
+		saveError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, f)
+}
+
+func (s *Server) ListFileVersions(c *gin.Context) {
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	file, ok := s.authorizeFile(c, uid, c.Param("fileID"), persist.PermissionView)
+	if !ok {
+		return
+	}
+
+	versions, err := s.persist.ListFileVersions(file.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not list versions",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, FileVersionsResponse{Current: file, Versions: versions})
+}
+
+// GetFileVersion serves the content of an earlier version, the same way
+// GetFile serves the current one.
+func (s *Server) GetFileVersion(c *gin.Context) {
+	if c.Request.Method == http.MethodGet {
+		defer s.audit(c, persist.AuditEvent{Action: "file.version.download", TargetType: "file", TargetID: c.Param("fileID"), Detail: "version " + c.Param("versionID")})
+	}
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	file, ok := s.authorizeFile(c, uid, c.Param("fileID"), persist.PermissionView)
+	if !ok {
+		return
+	}
+	v, err := s.persist.GetFileVersion(file.ID, c.Param("versionID"))
+	if err != nil {
+		lookupError(c, "version", err)
+		return
+	}
+
+	content, err := s.blobs.Open(v.Sha256)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not read file",
+			Error:   err.Error(),
+		})
+		return
+	}
+	defer content.Close()
+
+	versioned := *file
+	versioned.Sha256 = v.Sha256
+	versioned.FileSize = v.FileSize
+	versioned.UpdatedAt = v.CreatedAt
+	serveFile(c, &versioned, content)
+}
+
+// RestoreFileVersion makes an earlier version current again. It takes an
+// editor, and counts against the owner's quota.
+func (s *Server) RestoreFileVersion(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "file.version.restore", TargetType: "file", TargetID: c.Param("fileID"), Detail: "version " + c.Param("versionID")})
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	file, ok := s.authorizeFile(c, uid, c.Param("fileID"), persist.PermissionEdit)
+	if !ok {
+		return
+	}
+	v, err := s.persist.GetFileVersion(file.ID, c.Param("versionID"))
+	if err != nil {
+		lookupError(c, "version", err)
+		return
+	}
+	unlock, err := s.lockQuota(file.OwnerId, int64(v.FileSize))
+	if err != nil {
+		saveError(c, err)
+		return
+	}
+	defer unlock()
+
+	f, err := s.persist.RestoreFileVersion(file.OwnerId, file.ID, v.ID, uid)
+	if err != nil {
+		lookupError(c, "version", err)
+		return
+	}
+	s.pruneVersions(file.OwnerId, f.ID)
+	s.refreshUsage(file.OwnerId)
+
+	c.JSON(http.StatusOK, f)
+}
+
+// pruneVersions applies ownerId's retention policy to the versions of fileId,
+// returning how many were deleted.
+func (s *Server) pruneVersions(ownerId int, fileId string) int {
+	u, err := s.persist.GetUserById(ownerId)
+	if err != nil {
+		log.Printf("could not get retention policy of user %d: %v", ownerId, err)
+		return 0
+	}
+
+	var olderThan time.Time
+	if u.KeepVersionDays > 0 {
+		olderThan = time.Now().AddDate(0, 0, -u.KeepVersionDays)
+	}
+	if u.KeepVersions == 0 && olderThan.IsZero() {
+		return 0
+	}
+
+	n, err := s.persist.PruneFileVersions(fileId, u.KeepVersions, olderThan)
+	if err != nil {
+		log.Printf("could not prune versions of file %s: %v", fileId, err)
+	}
+	return n
+}
+
+// JanitorVersions prunes the versions every user's retention policy no longer
+// keeps, as they age past KeepVersionDays without the file changing, checking
+// every interval until ctx is done.
+func (s *Server) JanitorVersions(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			files, err := s.persist.ListPrunableFiles()
+			if err != nil {
+				log.Printf("could not list files with expired versions: %v", err)
+				continue
+			}
+			pruned := 0
+			owners := map[int]bool{}
+			for _, f := range files {
+				if n := s.pruneVersions(f.OwnerId, f.ID); n > 0 {
+					pruned += n
+					owners[f.OwnerId] = true
+				}
+			}
+			for ownerId := range owners {
+				s.refreshUsage(ownerId)
+			}
+			if pruned > 0 {
+				log.Printf("pruned %d file versions", pruned)
+			}
+		}
+	}
+}
+
+type UpdateVersioningRequest struct {
+	KeepVersions    *int `json:"keepVersions" validate:"omitempty,min=0"`
+	KeepVersionDays *int `json:"keepVersionDays" validate:"omitempty,min=0"`
+}
+
+// UpdateVersioning sets how many old versions of each file are kept, and for
+// how long. Versions it no longer keeps go the next time their file gets a
+// new version, or when JanitorVersions next runs.
+func (s *Server) UpdateVersioning(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "user.versioning.update"})
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+
+	var req UpdateVersioningRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, Response{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	u, err := s.persist.UpdateVersioning(uid, req.KeepVersions, req.KeepVersionDays)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, Response{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, u)
+}
@@ -0,0 +1,731 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"avenue/backend/persist"
+	"avenue/backend/shared"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+var (
+	// WEBHOOKATTEMPTS is how many times a delivery is tried before giving up
+	// on it.
+	WEBHOOKATTEMPTS = int(shared.GetEnvInt64("WEBHOOK_MAX_ATTEMPTS", 8))
+	// WEBHOOKLOGRETENTION is how long finished deliveries are kept in the
+	// delivery log.
+	WEBHOOKLOGRETENTION = shared.GetEnvDuration("WEBHOOK_LOG_RETENTION", 30*24*time.Hour)
+	// WEBHOOKALLOWPRIVATE lets webhooks reach loopback and private
+	// addresses, which are refused so users can't probe the local network.
+	WEBHOOKALLOWPRIVATE, _ = strconv.ParseBool(shared.GetEnv("WEBHOOK_ALLOW_PRIVATE", "false"))
+)
+
+const (
+	webhookTimeout = 10 * time.Second
+	// webhookLease is how long a claimed delivery is left alone, longer than
+	// an attempt can take.
+	webhookLease = time.Minute
+	// retries wait webhookRetryBase, doubling up to webhookRetryMax
+	webhookRetryBase = 30 * time.Second
+	webhookRetryMax  = 6 * time.Hour
+
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 500
+
+	// webhookPing is the event sent by TestWebhook.
+	webhookPing = "ping"
+)
+
+// webhookEvents are the events webhooks can ask for.
+var webhookEvents = map[string]bool{}
+
+func init() {
+	kinds := map[string][]string{
+		persist.ChangeKindFile:   {persist.ChangeCreate, persist.ChangeRename, persist.ChangeMove, persist.ChangeUpdate, persist.ChangeDelete, persist.ChangeRestore},
+		persist.ChangeKindFolder: {persist.ChangeCreate, persist.ChangeRename, persist.ChangeMove, persist.ChangeDelete, persist.ChangeRestore, persist.ChangeShare, persist.ChangeUnshare},
+		"user":                   {"create", "update", "delete", "restore"},
+	}
+	for kind, actions := range kinds {
+		webhookEvents[kind+".*"] = true
+		for _, a := range actions {
+			webhookEvents[kind+"."+a] = true
+		}
+	}
+}
+
+// WebhookPayload is the JSON body of a delivery.
+type WebhookPayload struct {
+	// ID is the id of the delivery, the same on every attempt.
+	ID        string    `json:"id"`
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"created_at"`
+	// Data is the change for file and folder events, and the user for user
+	// events.
+	Data any `json:"data"`
+}
+
+// webhookWants reports whether the event filters of w take event.
+func webhookWants(w *persist.Webhook, event string) bool {
+	if len(w.Events) == 0 || event == webhookPing {
+		return true
+	}
+	kind, _, _ := strings.Cut(event, ".")
+	for _, e := range w.Events {
+		if e == event || e == kind+".*" {
+			return true
+		}
+	}
+	return false
+}
+
+func newWebhookDelivery(w *persist.Webhook, event string, data any) (persist.WebhookDelivery, error) {
+	now := time.Now()
+	d := persist.WebhookDelivery{
+		ID:            uuid.NewString(),
+		WebhookID:     w.ID,
+		Event:         event,
+		Status:        persist.DeliveryPending,
+		NextAttemptAt: now,
+	}
+	body, err := json.Marshal(WebhookPayload{ID: d.ID, Event: event, CreatedAt: now, Data: data})
+	d.Payload = string(body)
+	return d, err
+}
+
+// webhookSignature signs a delivery body sent at timestamp, as
+// hex(HMAC-SHA256(secret, timestamp + "." + body)).
+func webhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookDialControl refuses connections to private addresses, after the
+// name is resolved so DNS can't be used to get around it.
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	if WEBHOOKALLOWPRIVATE {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("webhooks may not reach %s", host)
+	}
+	return nil
+}
+
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	// a redirect is an answer like any other, and could lead anywhere
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: webhookTimeout, Control: webhookDialControl}).DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+		MaxIdleConnsPerHost: 2,
+	},
+}
+
+// sendWebhook POSTs the payload of d to w, signed with its secret. Anything
+// but a 2xx answer is an error. It returns the status the endpoint answered,
+// 0 if it didn't.
+func sendWebhook(w *persist.Webhook, d *persist.WebhookDelivery) (int, error) {
+	body := []byte(d.Payload)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Avenue-Webhook")
+	req.Header.Set("X-Avenue-Event", d.Event)
+	req.Header.Set("X-Avenue-Delivery", d.ID)
+	req.Header.Set("X-Avenue-Timestamp", timestamp)
+	req.Header.Set("X-Avenue-Signature", "sha256="+webhookSignature(w.Secret, timestamp, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// read some of it so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookBackoff is how long to wait before trying again after attempt
+// failed.
+func webhookBackoff(attempt int) time.Duration {
+	d := webhookRetryBase
+	for i := 1; i < attempt && d < webhookRetryMax; i++ {
+		d *= 2
+	}
+	return min(d, webhookRetryMax)
+}
+
+// attemptWebhook sends d to w, and updates d with how it went and when to
+// try again.
+func attemptWebhook(w *persist.Webhook, d *persist.WebhookDelivery) {
+	code, err := sendWebhook(w, d)
+	now := time.Now()
+	d.ResponseCode = code
+	if err == nil {
+		d.Status, d.DeliveredAt, d.LastError = persist.DeliveryDelivered, &now, ""
+		return
+	}
+	d.LastError = err.Error()
+	if d.Attempts >= WEBHOOKATTEMPTS {
+		d.Status = persist.DeliveryFailed
+	} else {
+		d.NextAttemptAt = now.Add(webhookBackoff(d.Attempts))
+	}
+}
+
+// deliverWebhook makes an attempt at d, which must be claimed, and records
+// how it went.
+func (s *Server) deliverWebhook(w *persist.Webhook, d *persist.WebhookDelivery) {
+	attemptWebhook(w, d)
+	if err := s.persist.FinishWebhookDelivery(d); err != nil {
+		log.Printf("could not record webhook delivery %s: %v", d.ID, err)
+	}
+}
+
+// webhookScope is what one webhook hears about.
+type webhookScope struct {
+	all bool
+	// owner is whose changes are heard about, 0 for no one's
+	owner   int
+	folders map[string]bool
+}
+
+func (sc webhookScope) covers(c persist.Change) bool {
+	return sc.all || c.OwnerId == sc.owner ||
+		sc.folders[c.ItemID] || sc.folders[c.Parent] || c.OldParent != "" && sc.folders[c.OldParent]
+}
+
+// webhookScope looks up what w hears about: what its owner can see, the
+// folder it is limited to, or everything for global webhooks.
+func (s *Server) webhookScope(w *persist.Webhook) (webhookScope, error) {
+	sc := webhookScope{folders: map[string]bool{}}
+	var ids []string
+	var err error
+	switch {
+	case w.FolderID == "" && w.Global:
+		sc.all = true
+		return sc, nil
+	case w.FolderID == "":
+		sc.owner = w.OwnerId
+		ids, err = s.persist.SharedFolderTree(w.OwnerId)
+	default:
+		f, perm, ferr := s.persist.FolderPermission(w.OwnerId, w.FolderID)
+		if errors.Is(ferr, persist.ErrNotFound) {
+			// the folder is gone, nothing to hear about
+			return sc, nil
+		}
+		if ferr != nil {
+			return sc, ferr
+		}
+		if w.Global || perm >= persist.PermissionView {
+			ids, err = s.persist.SubtreeFolderIds(f.OwnerId, f.FolderID)
+		}
+	}
+	for _, id := range ids {
+		sc.folders[id] = true
+	}
+	return sc, err
+}
+
+// webhookDeliveries makes the deliveries for changes to every webhook that
+// wants them.
+func (s *Server) webhookDeliveries(changes []persist.Change) ([]persist.WebhookDelivery, error) {
+	hooks, err := s.persist.ListActiveWebhooks()
+	if err != nil {
+		return nil, err
+	}
+	scopes := map[string]webhookScope{}
+	var out []persist.WebhookDelivery
+	for _, c := range changes {
+		event := eventName(c)
+		for i := range hooks {
+			w := &hooks[i]
+			if !webhookWants(w, event) {
+				continue
+			}
+			sc, ok := scopes[w.ID]
+			if !ok {
+				if sc, err = s.webhookScope(w); err != nil {
+					return nil, err
+				}
+				scopes[w.ID] = sc
+			}
+			if !sc.covers(c) {
+				continue
+			}
+			d, err := newWebhookDelivery(w, event, c)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, d)
+		}
+	}
+	return out, nil
+}
+
+// queueUserWebhook queues a user event for the global webhooks that want
+// it.
+func (s *Server) queueUserWebhook(action string, u persist.User) {
+	event := "user." + action
+	hooks, err := s.persist.ListActiveWebhooks()
+	if err != nil {
+		log.Printf("could not list webhooks for %s: %v", event, err)
+		return
+	}
+	var out []persist.WebhookDelivery
+	for i := range hooks {
+		w := &hooks[i]
+		if !w.Global || !webhookWants(w, event) {
+			continue
+		}
+		d, err := newWebhookDelivery(w, event, u)
+		if err != nil {
+			log.Printf("could not make webhook delivery for %s: %v", event, err)
+			return
+		}
+		out = append(out, d)
+	}
+	if len(out) == 0 {
+		return
+	}
+	if err := s.persist.QueueWebhookDeliveries(out); err != nil {
+		log.Printf("could not queue webhook deliveries for %s: %v", event, err)
+		return
+	}
+	select {
+	case s.webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// RunWebhooks queues deliveries for new changes and sends the ones due,
+// until ctx is done. It runs when changes are recorded, when a user event
+// is queued, and every interval for retries.
+func (s *Server) RunWebhooks(ctx context.Context, interval time.Duration) {
+	changed := s.persist.Changed()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		s.queueWebhookChanges()
+		s.runWebhookDeliveries()
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-changed:
+		case <-s.webhookWake:
+		}
+	}
+}
+
+func (s *Server) queueWebhookChanges() {
+	for {
+		n, err := s.persist.QueueWebhookChanges(maxChangeLimit, s.webhookDeliveries)
+		if err != nil {
+			log.Printf("could not queue webhook deliveries: %v", err)
+			return
+		}
+		if n < maxChangeLimit {
+			return
+		}
+	}
+}
+
+// runWebhookDeliveries sends every delivery that is due, a batch at a time.
+func (s *Server) runWebhookDeliveries() {
+	for {
+		batch, err := s.persist.ClaimWebhookDeliveries(20, webhookLease)
+		if err != nil {
+			log.Printf("could not claim webhook deliveries: %v", err)
+			return
+		}
+		if len(batch) == 0 {
+			return
+		}
+		var wg sync.WaitGroup
+		for i := range batch {
+			d := &batch[i]
+			w, err := s.persist.GetWebhook(d.WebhookID)
+			if err != nil {
+				// deleted meanwhile, its deliveries went with it
+				continue
+			}
+			if w.Disabled {
+				d.Status, d.LastError = persist.DeliveryFailed, "webhook disabled"
+				if err := s.persist.FinishWebhookDelivery(d); err != nil {
+					log.Printf("could not record webhook delivery %s: %v", d.ID, err)
+				}
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.deliverWebhook(w, d)
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// JanitorWebhookDeliveries deletes finished deliveries older than retention
+// from the delivery log, checking every interval until ctx is done.
+func (s *Server) JanitorWebhookDeliveries(ctx context.Context, interval, retention time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n, err := s.persist.PruneWebhookDeliveries(time.Now().Add(-retention))
+			if err != nil {
+				log.Printf("could not prune webhook deliveries: %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("pruned %d webhook deliveries", n)
+			}
+		}
+	}
+}
+
+type CreateWebhookReq struct {
+	URL string `json:"url" validate:"required,max=2048"`
+	// Secret is made up when missing.
+	Secret   string   `json:"secret" validate:"omitempty,min=16,max=256"`
+	Events   []string `json:"events" validate:"max=32"`
+	FolderID string   `json:"folder_id"`
+	// Global webhooks are for admins.
+	Global bool `json:"global"`
+}
+
+type UpdateWebhookReq struct {
+	URL      *string   `json:"url" validate:"omitempty,max=2048"`
+	Secret   *string   `json:"secret" validate:"omitempty,min=16,max=256"`
+	Events   *[]string `json:"events" validate:"omitempty,max=32"`
+	FolderID *string   `json:"folder_id"`
+	Disabled *bool     `json:"disabled"`
+}
+
+type WebhookResponse struct {
+	persist.Webhook
+	// Secret is only returned when the webhook is created.
+	Secret string `json:"secret"`
+}
+
+// checkWebhook validates the settings of w for uid. If they are invalid an
+// error response has already been written and ok is false.
+func (s *Server) checkWebhook(c *gin.Context, uid int, w *persist.Webhook) bool {
+	u, err := url.Parse(w.URL)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "invalid webhook",
+			Error:   "url must be an absolute http or https url",
+		})
+		return false
+	}
+	for _, e := range w.Events {
+		if !webhookEvents[e] {
+			c.JSON(http.StatusBadRequest, Response{
+				Message: "invalid webhook",
+				Error:   "unknown event " + strconv.Quote(e),
+			})
+			return false
+		}
+		if strings.HasPrefix(e, "user.") && !w.Global {
+			c.JSON(http.StatusBadRequest, Response{
+				Message: "invalid webhook",
+				Error:   "only global webhooks get user events",
+			})
+			return false
+		}
+	}
+	if w.Global && requestRole(c) != persist.UserRoleAdmin {
+		c.JSON(http.StatusForbidden, Response{
+			Message: "only admins can create global webhooks",
+		})
+		return false
+	}
+	switch {
+	case w.FolderID == "":
+	case w.Global:
+		if _, err := s.persist.GetFolder(w.FolderID); err != nil {
+			lookupError(c, "folder", err)
+			return false
+		}
+	default:
+		if _, ok := s.authorizeFolder(c, uid, w.FolderID, persist.PermissionView); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// ownedWebhook returns the caller's webhook :webhookID. If there is none an
+// error response has already been written and ok is false.
+func (s *Server) ownedWebhook(c *gin.Context) (int, *persist.Webhook, bool) {
+	uid, ok := requestUserId(c)
+	if !ok {
+		return 0, nil, false
+	}
+	w, err := s.persist.GetOwnedWebhook(uid, c.Param("webhookID"))
+	if err != nil {
+		lookupError(c, "webhook", err)
+		return 0, nil, false
+	}
+	return uid, w, true
+}
+
+// CreateWebhook registers an endpoint that events are POSTed to as JSON,
+// signed with the secret: X-Avenue-Signature is "sha256=" and the hex
+// HMAC-SHA256 of X-Avenue-Timestamp, ".", and the body.
+func (s *Server) CreateWebhook(c *gin.Context) {
+	var id string
+	defer func() {
+		s.audit(c, persist.AuditEvent{Action: "webhook.create", TargetType: "webhook", TargetID: id})
+	}()
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	var req CreateWebhookReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "could not marshal all data to json",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "invalid webhook",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	w := persist.Webhook{
+		OwnerId:  uid,
+		URL:      req.URL,
+		Secret:   req.Secret,
+		Events:   req.Events,
+		FolderID: req.FolderID,
+		Global:   req.Global,
+	}
+	if !s.checkWebhook(c, uid, &w) {
+		return
+	}
+	if w.Secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			c.JSON(http.StatusInternalServerError, Response{
+				Message: "could not create webhook",
+				Error:   err.Error(),
+			})
+			return
+		}
+		w.Secret = hex.EncodeToString(b)
+	}
+	if w.Events == nil {
+		w.Events = []string{}
+	}
+	if err := s.persist.CreateWebhook(&w); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not create webhook",
+			Error:   err.Error(),
+		})
+		return
+	}
+	id = w.ID
+
+	c.JSON(http.StatusCreated, WebhookResponse{Webhook: w, Secret: w.Secret})
+}
+
+func (s *Server) ListWebhooks(c *gin.Context) {
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	hooks, err := s.persist.ListWebhooks(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not list webhooks",
+			Error:   err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, hooks)
+}
+
+func (s *Server) GetWebhook(c *gin.Context) {
+	_, w, ok := s.ownedWebhook(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, w)
+}
+
+// UpdateWebhook changes the settings of a webhook, or disables it.
+func (s *Server) UpdateWebhook(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "webhook.update", TargetType: "webhook", TargetID: c.Param("webhookID")})
+
+	uid, w, ok := s.ownedWebhook(c)
+	if !ok {
+		return
+	}
+	var req UpdateWebhookReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "could not marshal all data to json",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Message: "invalid webhook",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if req.URL != nil {
+		w.URL = *req.URL
+	}
+	if req.Secret != nil {
+		w.Secret = *req.Secret
+	}
+	if req.Events != nil {
+		w.Events = *req.Events
+	}
+	if req.FolderID != nil {
+		w.FolderID = *req.FolderID
+	}
+	if req.Disabled != nil {
+		w.Disabled = *req.Disabled
+	}
+	if !s.checkWebhook(c, uid, w) {
+		return
+	}
+	if err := s.persist.SaveWebhook(w); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not update webhook",
+			Error:   err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, w)
+}
+
+func (s *Server) DeleteWebhook(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "webhook.delete", TargetType: "webhook", TargetID: c.Param("webhookID")})
+
+	uid, ok := requestUserId(c)
+	if !ok {
+		return
+	}
+	if err := s.persist.DeleteWebhook(uid, c.Param("webhookID")); err != nil {
+		lookupError(c, "webhook", err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// ListWebhookDeliveries returns the delivery log of a webhook, newest first,
+// up to ?limit= entries.
+func (s *Server) ListWebhookDeliveries(c *gin.Context) {
+	_, w, ok := s.ownedWebhook(c)
+	if !ok {
+		return
+	}
+	limit := defaultDeliveryLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxDeliveryLimit {
+			c.JSON(http.StatusBadRequest, Response{
+				Message: "invalid limit",
+				Error:   "limit must be between 1 and " + strconv.Itoa(maxDeliveryLimit),
+			})
+			return
+		}
+		limit = n
+	}
+	d, err := s.persist.ListWebhookDeliveries(w.ID, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not list webhook deliveries",
+			Error:   err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+// TestWebhook sends a ping event to a webhook right away, and returns the
+// delivery with how the endpoint answered. A failed ping is retried like any
+// other delivery.
+func (s *Server) TestWebhook(c *gin.Context) {
+	defer s.audit(c, persist.AuditEvent{Action: "webhook.test", TargetType: "webhook", TargetID: c.Param("webhookID")})
+
+	_, w, ok := s.ownedWebhook(c)
+	if !ok {
+		return
+	}
+	d, err := newWebhookDelivery(w, webhookPing, gin.H{"webhook_id": w.ID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not create test event",
+			Error:   err.Error(),
+		})
+		return
+	}
+	// queued already claimed, so the worker leaves it to us
+	d.Attempts, d.NextAttemptAt = 1, time.Now().Add(webhookLease)
+	if err := s.persist.QueueWebhookDeliveries([]persist.WebhookDelivery{d}); err != nil {
+		c.JSON(http.StatusInternalServerError, Response{
+			Message: "could not create test event",
+			Error:   err.Error(),
+		})
+		return
+	}
+	s.deliverWebhook(w, &d)
+	c.JSON(http.StatusOK, d)
+}
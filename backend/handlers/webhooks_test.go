@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"avenue/backend/persist"
+)
+
+// allowPrivateWebhooks lets webhooks reach httptest servers on loopback for
+// the rest of the test.
+func allowPrivateWebhooks(t *testing.T) {
+	t.Helper()
+	old := WEBHOOKALLOWPRIVATE
+	WEBHOOKALLOWPRIVATE = true
+	t.Cleanup(func() { WEBHOOKALLOWPRIVATE = old })
+}
+
+func testDelivery(t *testing.T, w *persist.Webhook) persist.WebhookDelivery {
+	t.Helper()
+	d, err := newWebhookDelivery(w, "file.create", map[string]string{"item_id": "f1"})
+	if err != nil {
+		t.Fatalf("newWebhookDelivery: %v", err)
+	}
+	return d
+}
+
+func TestWebhookSignature(t *testing.T) {
+	got := webhookSignature("whsec_test", "1700000000", []byte(`{"event":"ping"}`))
+	want := "aa8efe37b751e71157c508c5ac4acb1e9fe5225db98355dfc00f4b680afbc447"
+	if got != want {
+		t.Fatalf("signature = %s, want %s", got, want)
+	}
+}
+
+func TestSendWebhookSigns(t *testing.T) {
+	allowPrivateWebhooks(t)
+
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+	got := make(chan received, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- received{r.Header.Clone(), body}
+	}))
+	defer srv.Close()
+
+	w := &persist.Webhook{ID: "w1", URL: srv.URL, Secret: "s3cret"}
+	d := testDelivery(t, w)
+	code, err := sendWebhook(w, &d)
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("sendWebhook = %d, %v", code, err)
+	}
+
+	r := <-got
+	if string(r.body) != d.Payload {
+		t.Errorf("body = %s, want %s", r.body, d.Payload)
+	}
+	if r.header.Get("X-Avenue-Event") != "file.create" || r.header.Get("X-Avenue-Delivery") != d.ID {
+		t.Errorf("event headers = %q, %q", r.header.Get("X-Avenue-Event"), r.header.Get("X-Avenue-Delivery"))
+	}
+	ts := r.header.Get("X-Avenue-Timestamp")
+	if n, err := strconv.ParseInt(ts, 10, 64); err != nil || time.Since(time.Unix(n, 0)) > time.Minute {
+		t.Errorf("timestamp = %q", ts)
+	}
+	// verified the way a receiver would
+	mac := hmac.New(sha256.New, []byte(w.Secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(r.body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); r.header.Get("X-Avenue-Signature") != want {
+		t.Errorf("signature = %q, want %q", r.header.Get("X-Avenue-Signature"), want)
+	}
+
+	var payload WebhookPayload
+	if err := json.Unmarshal(r.body, &payload); err != nil {
+		t.Fatalf("payload: %v", err)
+	}
+	if payload.ID != d.ID || payload.Event != "file.create" {
+		t.Errorf("payload = %+v", payload)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{8, 64 * time.Minute},
+		{10, 4*time.Hour + 16*time.Minute},
+		{11, 6 * time.Hour},
+		{50, 6 * time.Hour},
+	} {
+		if got := webhookBackoff(tc.attempt); got != tc.want {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", tc.attempt, got, tc.want)
+		}
+	}
+}
+
+func TestAttemptWebhookRetries(t *testing.T) {
+	allowPrivateWebhooks(t)
+
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	w := &persist.Webhook{ID: "w1", URL: srv.URL, Secret: "s3cret"}
+	d := testDelivery(t, w)
+	for attempt := 1; attempt <= 2; attempt++ {
+		// claiming counts the attempt
+		d.Attempts = attempt
+		before := time.Now()
+		attemptWebhook(w, &d)
+		if d.Status != persist.DeliveryPending {
+			t.Fatalf("attempt %d: status = %s, want pending", attempt, d.Status)
+		}
+		if d.ResponseCode != http.StatusServiceUnavailable || !strings.Contains(d.LastError, "503") {
+			t.Errorf("attempt %d: logged %d %q", attempt, d.ResponseCode, d.LastError)
+		}
+		if wait := d.NextAttemptAt.Sub(before); wait < webhookBackoff(attempt) || wait > webhookBackoff(attempt)+time.Second {
+			t.Errorf("attempt %d: retried after %v, want %v", attempt, wait, webhookBackoff(attempt))
+		}
+		if d.DeliveredAt != nil {
+			t.Errorf("attempt %d: delivered at %v", attempt, d.DeliveredAt)
+		}
+	}
+
+	d.Attempts = 3
+	attemptWebhook(w, &d)
+	if d.Status != persist.DeliveryDelivered || d.DeliveredAt == nil {
+		t.Fatalf("status = %s, delivered at %v", d.Status, d.DeliveredAt)
+	}
+	if d.ResponseCode != http.StatusOK || d.LastError != "" {
+		t.Errorf("logged %d %q", d.ResponseCode, d.LastError)
+	}
+}
+
+func TestAttemptWebhookGivesUp(t *testing.T) {
+	allowPrivateWebhooks(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		http.Redirect(rw, r, "http://example.com/", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	w := &persist.Webhook{ID: "w1", URL: srv.URL, Secret: "s3cret"}
+	d := testDelivery(t, w)
+	d.Attempts = WEBHOOKATTEMPTS - 1
+	attemptWebhook(w, &d)
+	if d.Status != persist.DeliveryPending {
+		t.Fatalf("status = %s before the last attempt", d.Status)
+	}
+	// redirects aren't followed, they are answers like any other
+	if d.ResponseCode != http.StatusFound {
+		t.Errorf("response code = %d, want 302", d.ResponseCode)
+	}
+
+	d.Attempts = WEBHOOKATTEMPTS
+	attemptWebhook(w, &d)
+	if d.Status != persist.DeliveryFailed {
+		t.Fatalf("status = %s after the last attempt, want failed", d.Status)
+	}
+}
+
+func TestSendWebhookRefusesPrivate(t *testing.T) {
+	var called atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		called.Store(true)
+	}))
+	defer srv.Close()
+
+	w := &persist.Webhook{ID: "w1", URL: srv.URL, Secret: "s3cret"}
+	d := testDelivery(t, w)
+	code, err := sendWebhook(w, &d)
+	if err == nil || code != 0 || called.Load() {
+		t.Fatalf("sendWebhook to loopback = %d, %v", code, err)
+	}
+}
+
+func TestWebhookWants(t *testing.T) {
+	w := &persist.Webhook{Events: []string{"file.create", "folder.*"}}
+	for event, want := range map[string]bool{
+		"file.create":   true,
+		"file.delete":   false,
+		"folder.share":  true,
+		"user.create":   false,
+		webhookPing:     true,
+		"folder.create": true,
+	} {
+		if got := webhookWants(w, event); got != want {
+			t.Errorf("webhookWants(%s) = %v, want %v", event, got, want)
+		}
+	}
+	if !webhookWants(&persist.Webhook{}, "user.delete") {
+		t.Error("a webhook without filters should want every event")
+	}
+}
@@ -0,0 +1,346 @@
+package persist
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Permission is what a user may do with a file or folder. Higher levels
+// include the lower ones.
+type Permission int
+
+const (
+	PermissionNone Permission = iota
+	PermissionView
+	PermissionEdit
+	// PermissionManage lets co-owners share, and permanently delete, what
+	// isn't theirs.
+	PermissionManage
+	// PermissionOwner is only held by the owner.
+	PermissionOwner
+)
+
+const (
+	RoleViewer  = "viewer"
+	RoleEditor  = "editor"
+	RoleCoOwner = "co-owner"
+)
+
+// RolePermission returns the permission granted by role.
+func RolePermission(role string) Permission {
+	switch role {
+	case RoleViewer:
+		return PermissionView
+	case RoleEditor:
+		return PermissionEdit
+	case RoleCoOwner:
+		return PermissionManage
+	}
+	return PermissionNone
+}
+
+// Group is a named set of users that folders can be shared with. Only its
+// owner can change it.
+type Group struct {
+	ID        string    `gorm:"primaryKey;type:uuid" json:"id"`
+	Name      string    `gorm:"not null" json:"name"`
+	OwnerId   int       `gorm:"not null;index" json:"owner_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type GroupMember struct {
+	GroupID string `gorm:"primaryKey;type:uuid" json:"group_id"`
+	UserID  int    `gorm:"primaryKey;index" json:"user_id"`
+}
+
+// FolderGrant gives a user, or every member of a group, a role on a folder
+// and everything below it.
+type FolderGrant struct {
+	ID       string `gorm:"primaryKey;type:uuid" json:"id"`
+	FolderID string `gorm:"not null;index" json:"folder_id"`
+	// OwnerId is the owner of the folder.
+	OwnerId   int       `gorm:"not null;index" json:"owner_id"`
+	UserID    *int      `gorm:"index" json:"user_id,omitempty"`
+	GroupID   *string   `gorm:"index" json:"group_id,omitempty"`
+	Role      string    `gorm:"not null" json:"role"`
+	CreatedBy int       `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SharedFolder is a folder someone else shared with a user.
+type SharedFolder struct {
+	Folder
+	Role string `json:"role"`
+}
+
+var ErrAlreadyMember = errors.New("user is already a member of the group")
+
+func (p *Persist) CreateGroup(g *Group) (string, error) {
+	if g.ID == "" {
+		g.ID = uuid.NewString()
+	}
+	return g.ID, p.db.Create(g).Error
+}
+
+// GetVisibleGroup retrieves a group userId owns or is a member of.
+func (p *Persist) GetVisibleGroup(userId int, id string) (*Group, error) {
+	var g Group
+	err := p.db.
+		Where("id = ? AND (owner_id = ? OR id IN (?))", id, userId, p.db.Model(&GroupMember{}).Select("group_id").Where("user_id = ?", userId)).
+		First(&g).Error
+	if err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (p *Persist) GetOwnedGroup(ownerId int, id string) (*Group, error) {
+	var g Group
+	err := p.db.Where("id = ? AND owner_id = ?", id, ownerId).First(&g).Error
+	if err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// ListGroups returns the groups userId owns or is a member of.
+func (p *Persist) ListGroups(userId int) ([]Group, error) {
+	var g []Group
+	err := p.db.
+		Where("owner_id = ? OR id IN (?)", userId, p.db.Model(&GroupMember{}).Select("group_id").Where("user_id = ?", userId)).
+		Order("name").
+		Find(&g).Error
+	return g, err
+}
+
+func (p *Persist) ListGroupMembers(groupId string) ([]GroupMember, error) {
+	var m []GroupMember
+	err := p.db.Where("group_id = ?", groupId).Find(&m).Error
+	return m, err
+}
+
+// AddGroupMember adds userId to a group, sharing the folders granted to it
+// with them.
+func (p *Persist) AddGroupMember(groupId string, userId int) error {
+	return p.transact(func(tx *gorm.DB) error {
+		res := tx.Where(GroupMember{GroupID: groupId, UserID: userId}).FirstOrCreate(&GroupMember{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrAlreadyMember
+		}
+		return recordMemberChanges(tx, groupId, []int{userId}, ChangeShare)
+	})
+}
+
+// RemoveGroupMember takes userId out of a group, and with it the folders
+// granted to it.
+func (p *Persist) RemoveGroupMember(groupId string, userId int) error {
+	return p.transact(func(tx *gorm.DB) error {
+		res := tx.Where("group_id = ? AND user_id = ?", groupId, userId).Delete(&GroupMember{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		return recordMemberChanges(tx, groupId, []int{userId}, ChangeUnshare)
+	})
+}
+
+// DeleteGroup deletes a group with its members and the grants made to it.
+func (p *Persist) DeleteGroup(ownerId int, id string) error {
+	return p.transact(func(tx *gorm.DB) error {
+		res := tx.Where("id = ? AND owner_id = ?", id, ownerId).Delete(&Group{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		var members []int
+		if err := tx.Model(&GroupMember{}).Where("group_id = ?", id).Pluck("user_id", &members).Error; err != nil {
+			return err
+		}
+		// recorded per member, who are no longer in the group after
+		if err := recordMemberChanges(tx, id, members, ChangeUnshare); err != nil {
+			return err
+		}
+		if err := tx.Where("group_id = ?", id).Delete(&GroupMember{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("group_id = ?", id).Delete(&FolderGrant{}).Error
+	})
+}
+
+// recordMemberChanges records that members gained or lost the folders granted
+// to a group.
+func recordMemberChanges(tx *gorm.DB, groupId string, members []int, action string) error {
+	var grants []FolderGrant
+	if err := tx.Where("group_id = ?", groupId).Find(&grants).Error; err != nil {
+		return err
+	}
+	for _, g := range grants {
+		for _, m := range members {
+			g.UserID, g.GroupID = &m, nil
+			if err := recordGrantChange(tx, &g, action); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CreateFolderGrant stores g, replacing an earlier grant on the same folder to
+// the same user or group.
+func (p *Persist) CreateFolderGrant(g *FolderGrant) (string, error) {
+	if g.ID == "" {
+		g.ID = uuid.NewString()
+	}
+	err := p.transact(func(tx *gorm.DB) error {
+		q := tx.Where("folder_id = ?", g.FolderID)
+		if g.UserID != nil {
+			q = q.Where("user_id = ?", *g.UserID)
+		} else {
+			q = q.Where("group_id = ?", *g.GroupID)
+		}
+		if err := q.Delete(&FolderGrant{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(g).Error; err != nil {
+			return err
+		}
+		return recordGrantChange(tx, g, ChangeShare)
+	})
+	return g.ID, err
+}
+
+func (p *Persist) ListFolderGrants(folderId string) ([]FolderGrant, error) {
+	var g []FolderGrant
+	err := p.db.Where("folder_id = ?", folderId).Order("created_at").Find(&g).Error
+	return g, err
+}
+
+func (p *Persist) DeleteFolderGrant(folderId, id string) error {
+	return p.transact(func(tx *gorm.DB) error {
+		var g FolderGrant
+		if err := tx.Where("id = ? AND folder_id = ?", id, folderId).First(&g).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&g).Error; err != nil {
+			return err
+		}
+		return recordGrantChange(tx, &g, ChangeUnshare)
+	})
+}
+
+// recordGrantChange records that g was given or taken away.
+func recordGrantChange(tx *gorm.DB, g *FolderGrant, action string) error {
+	var f Folder
+	if err := tx.Unscoped().Where("folder_id = ?", g.FolderID).First(&f).Error; err != nil {
+		return err
+	}
+	c := folderChange(&f, action)
+	c.GranteeId, c.GranteeGroup = g.UserID, g.GroupID
+	return recordChange(tx, c)
+}
+
+// grantsFor narrows q to grants that apply to userId, directly or through one
+// of their groups.
+func (p *Persist) grantsFor(q *gorm.DB, userId int) *gorm.DB {
+	groups := p.db.Model(&GroupMember{}).Select("group_id").Where("user_id = ?", userId)
+	return q.Where("(user_id = ? OR group_id IN (?))", userId, groups)
+}
+
+// FolderPermission returns what userId may do with a folder: everything if
+// they own it, otherwise the best role granted on it or on any folder above
+// it.
+func (p *Persist) FolderPermission(userId int, folderId string) (*Folder, Permission, error) {
+	folder, err := p.GetFolder(folderId)
+	if err != nil {
+		return nil, PermissionNone, err
+	}
+	if folder.OwnerId == userId {
+		return folder, PermissionOwner, nil
+	}
+
+	ids := []string{folder.FolderID}
+	for cur := folder.Parent; cur != ""; {
+		f, err := p.GetFolder(cur)
+		if err != nil {
+			return nil, PermissionNone, err
+		}
+		ids = append(ids, f.FolderID)
+		cur = f.Parent
+	}
+
+	var grants []FolderGrant
+	err = p.grantsFor(p.db.Where("folder_id IN ?", ids), userId).Find(&grants).Error
+	if err != nil {
+		return nil, PermissionNone, err
+	}
+	perm := PermissionNone
+	for _, g := range grants {
+		perm = max(perm, RolePermission(g.Role))
+	}
+	return folder, perm, nil
+}
+
+// FilePermission returns what userId may do with a file, which is whatever
+// they may do with the folder it is in.
+func (p *Persist) FilePermission(userId int, fileId string) (*File, Permission, error) {
+	file, err := p.GetFileByID(fileId)
+	if err != nil {
+		return nil, PermissionNone, err
+	}
+	if file.OwnerId == userId {
+		return file, PermissionOwner, nil
+	}
+	if file.Parent == "" {
+		return file, PermissionNone, nil
+	}
+	_, perm, err := p.FolderPermission(userId, file.Parent)
+	if err != nil {
+		return nil, PermissionNone, err
+	}
+	return file, perm, nil
+}
+
+// ListSharedWithUser returns the folders shared with userId directly or
+// through a group, with the best role they hold on each.
+func (p *Persist) ListSharedWithUser(userId int) ([]SharedFolder, error) {
+	var grants []FolderGrant
+	err := p.grantsFor(p.db.Where("owner_id <> ?", userId), userId).Find(&grants).Error
+	if err != nil {
+		return nil, err
+	}
+
+	roles := map[string]string{}
+	var ids []string
+	for _, g := range grants {
+		cur, seen := roles[g.FolderID]
+		if !seen {
+			ids = append(ids, g.FolderID)
+		}
+		if RolePermission(g.Role) > RolePermission(cur) {
+			roles[g.FolderID] = g.Role
+		}
+	}
+	if len(ids) == 0 {
+		return []SharedFolder{}, nil
+	}
+
+	var folders []Folder
+	if err := p.db.Where("folder_id IN ?", ids).Order("name").Find(&folders).Error; err != nil {
+		return nil, err
+	}
+	shared := make([]SharedFolder, 0, len(folders))
+	for _, f := range folders {
+		shared = append(shared, SharedFolder{Folder: f, Role: roles[f.FolderID]})
+	}
+	return shared, nil
+}
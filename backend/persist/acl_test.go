@@ -0,0 +1,168 @@
+package persist
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRolePermission(t *testing.T) {
+	for role, want := range map[string]Permission{
+		RoleViewer:  PermissionView,
+		RoleEditor:  PermissionEdit,
+		RoleCoOwner: PermissionManage,
+		"owner":     PermissionNone,
+		"":          PermissionNone,
+	} {
+		if got := RolePermission(role); got != want {
+			t.Errorf("RolePermission(%q) = %d, want %d", role, got, want)
+		}
+	}
+}
+
+// testTree makes the folders top, top/mid and top/mid/leaf of ownerId, and a
+// file in leaf.
+func testTree(t *testing.T, p *Persist, ownerId int) (top, mid, leaf, file string) {
+	t.Helper()
+	parent := ""
+	var ids []string
+	for _, name := range []string{"top", "mid", "leaf"} {
+		id, err := p.CreateFolder(&Folder{Name: name, Parent: parent, OwnerId: ownerId})
+		if err != nil {
+			t.Fatalf("CreateFolder: %v", err)
+		}
+		ids = append(ids, id)
+		parent = id
+	}
+	file, err := p.CreateFile(&File{Name: "a.txt", Extension: "txt", Parent: parent, OwnerId: ownerId})
+	if err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+	return ids[0], ids[1], ids[2], file
+}
+
+// grant gives userId role on folderId of ownerId.
+func grant(t *testing.T, p *Persist, ownerId int, folderId string, userId int, role string) string {
+	t.Helper()
+	id, err := p.CreateFolderGrant(&FolderGrant{FolderID: folderId, OwnerId: ownerId, UserID: &userId, Role: role, CreatedBy: ownerId})
+	if err != nil {
+		t.Fatalf("CreateFolderGrant: %v", err)
+	}
+	return id
+}
+
+// wantPermissions checks what userId may do with each folder or file.
+func wantPermissions(t *testing.T, p *Persist, userId int, folders map[string]Permission, file string, filePerm Permission) {
+	t.Helper()
+	for id, want := range folders {
+		_, got, err := p.FolderPermission(userId, id)
+		if err != nil {
+			t.Fatalf("FolderPermission: %v", err)
+		}
+		if got != want {
+			t.Errorf("user %d holds %d on folder %s, want %d", userId, got, id, want)
+		}
+	}
+	_, got, err := p.FilePermission(userId, file)
+	if err != nil {
+		t.Fatalf("FilePermission: %v", err)
+	}
+	if got != filePerm {
+		t.Errorf("user %d holds %d on the file, want %d", userId, got, filePerm)
+	}
+}
+
+func TestFolderPermissionOwner(t *testing.T) {
+	p := testPersist(t)
+	owner, stranger := testUser(t, p), testUser(t, p)
+	top, mid, leaf, file := testTree(t, p, owner)
+
+	wantPermissions(t, p, owner, map[string]Permission{top: PermissionOwner, mid: PermissionOwner, leaf: PermissionOwner}, file, PermissionOwner)
+	wantPermissions(t, p, stranger, map[string]Permission{top: PermissionNone, mid: PermissionNone, leaf: PermissionNone}, file, PermissionNone)
+
+	if _, _, err := p.FolderPermission(owner, "00000000-0000-0000-0000-000000000000"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("FolderPermission of a missing folder = %v, want ErrNotFound", err)
+	}
+}
+
+func TestFolderPermissionInherited(t *testing.T) {
+	p := testPersist(t)
+	owner, user := testUser(t, p), testUser(t, p)
+	top, mid, leaf, file := testTree(t, p, owner)
+
+	// a grant reaches everything below the folder, not above it
+	grant(t, p, owner, mid, user, RoleViewer)
+	wantPermissions(t, p, user, map[string]Permission{top: PermissionNone, mid: PermissionView, leaf: PermissionView}, file, PermissionView)
+
+	// the best of the grants on the way up wins, wherever it is
+	topGrant := grant(t, p, owner, top, user, RoleEditor)
+	wantPermissions(t, p, user, map[string]Permission{top: PermissionEdit, mid: PermissionEdit, leaf: PermissionEdit}, file, PermissionEdit)
+	grant(t, p, owner, leaf, user, RoleCoOwner)
+	wantPermissions(t, p, user, map[string]Permission{top: PermissionEdit, mid: PermissionEdit, leaf: PermissionManage}, file, PermissionManage)
+
+	// granting again on the same folder replaces the earlier grant
+	grant(t, p, owner, mid, user, RoleEditor)
+	if g, err := p.ListFolderGrants(mid); err != nil || len(g) != 1 || g[0].Role != RoleEditor {
+		t.Errorf("grants on mid after granting twice = %+v, %v", g, err)
+	}
+
+	// revoking the grant above leaves the ones below
+	if err := p.DeleteFolderGrant(top, topGrant); err != nil {
+		t.Fatalf("DeleteFolderGrant: %v", err)
+	}
+	wantPermissions(t, p, user, map[string]Permission{top: PermissionNone, mid: PermissionEdit, leaf: PermissionManage}, file, PermissionManage)
+}
+
+func TestFolderPermissionGroup(t *testing.T) {
+	p := testPersist(t)
+	owner, member, outsider := testUser(t, p), testUser(t, p), testUser(t, p)
+	top, mid, leaf, file := testTree(t, p, owner)
+
+	groupId, err := p.CreateGroup(&Group{Name: "team", OwnerId: owner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddGroupMember(groupId, member); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.CreateFolderGrant(&FolderGrant{FolderID: mid, OwnerId: owner, GroupID: &groupId, Role: RoleEditor, CreatedBy: owner}); err != nil {
+		t.Fatal(err)
+	}
+	wantPermissions(t, p, member, map[string]Permission{top: PermissionNone, mid: PermissionEdit, leaf: PermissionEdit}, file, PermissionEdit)
+	wantPermissions(t, p, outsider, map[string]Permission{top: PermissionNone, mid: PermissionNone, leaf: PermissionNone}, file, PermissionNone)
+
+	// a grant to the member themselves adds to the group's
+	grant(t, p, owner, top, member, RoleViewer)
+	wantPermissions(t, p, member, map[string]Permission{top: PermissionView, mid: PermissionEdit, leaf: PermissionEdit}, file, PermissionEdit)
+
+	// leaving the group takes what it was granted
+	if err := p.RemoveGroupMember(groupId, member); err != nil {
+		t.Fatal(err)
+	}
+	wantPermissions(t, p, member, map[string]Permission{top: PermissionView, mid: PermissionView, leaf: PermissionView}, file, PermissionView)
+
+	// and so does deleting it
+	if err := p.AddGroupMember(groupId, outsider); err != nil {
+		t.Fatal(err)
+	}
+	wantPermissions(t, p, outsider, map[string]Permission{top: PermissionNone, mid: PermissionEdit, leaf: PermissionEdit}, file, PermissionEdit)
+	if err := p.DeleteGroup(owner, groupId); err != nil {
+		t.Fatal(err)
+	}
+	wantPermissions(t, p, outsider, map[string]Permission{top: PermissionNone, mid: PermissionNone, leaf: PermissionNone}, file, PermissionNone)
+}
+
+func TestFilePermissionTopLevel(t *testing.T) {
+	p := testPersist(t)
+	owner, user := testUser(t, p), testUser(t, p)
+	id, err := p.CreateFile(&File{Name: "a.txt", Extension: "txt", OwnerId: owner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing at the top level can be granted
+	if _, perm, err := p.FilePermission(user, id); err != nil || perm != PermissionNone {
+		t.Errorf("FilePermission of another's top level file = %d, %v", perm, err)
+	}
+	if _, perm, err := p.FilePermission(owner, id); err != nil || perm != PermissionOwner {
+		t.Errorf("FilePermission of the owner = %d, %v", perm, err)
+	}
+}
@@ -0,0 +1,139 @@
+package persist
+
+import (
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// SearchUsers returns a page of users whose email contains query, along with
+// how many match in total. Deleted users are only included if includeDeleted.
+func (p *Persist) SearchUsers(query string, includeDeleted bool, limit, offset int) ([]User, int64, error) {
+	db := p.db.Model(&User{})
+	if includeDeleted {
+		db = db.Unscoped()
+	}
+	if query != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query)
+		db = db.Where("email ILIKE ?", "%"+escaped+"%")
+	}
+
+	var total int64
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var u []User
+	err := db.Order("id").Limit(limit).Offset(offset).Find(&u).Error
+	return u, total, err
+}
+
+// GetAnyUserById returns a user even if they were deleted.
+func (p *Persist) GetAnyUserById(id int) (User, error) {
+	var u User
+	err := p.db.Unscoped().First(&u, id).Error
+	return u, err
+}
+
+// UpdateUserAccess changes whether a user may log in and their role. A nil
+// value leaves that setting unchanged.
+func (p *Persist) UpdateUserAccess(id int, canLogin *bool, role *string) (User, error) {
+	fields := map[string]any{}
+	if canLogin != nil {
+		fields["can_login"] = *canLogin
+	}
+	if role != nil {
+		fields["role"] = *role
+	}
+	if len(fields) > 0 {
+		if err := p.db.Model(&User{}).Where("id = ?", id).Updates(fields).Error; err != nil {
+			return User{}, err
+		}
+	}
+	return p.GetUserById(id)
+}
+
+// SetUserQuota overrides a user's quota, nil puts them back on the default.
+func (p *Persist) SetUserQuota(id int, quota *int64) (User, error) {
+	if err := p.db.Model(&User{}).Where("id = ?", id).Update("quota_bytes", quota).Error; err != nil {
+		return User{}, err
+	}
+	return p.GetUserById(id)
+}
+
+// DeleteUser soft deletes a user. Their files are kept until they are purged.
+func (p *Persist) DeleteUser(id int) error {
+	res := p.db.Delete(&User{}, id)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RestoreUser undoes DeleteUser.
+func (p *Persist) RestoreUser(id int) (User, error) {
+	res := p.db.Unscoped().Model(&User{}).Where("id = ? AND deleted_at IS NOT NULL", id).Update("deleted_at", nil)
+	if res.Error != nil {
+		return User{}, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return User{}, ErrNotFound
+	}
+	return p.GetUserById(id)
+}
+
+// PurgeUser permanently deletes a user, deleted or not, with everything they
+// own and every share of theirs. The blobs of their files are released for
+// the garbage collector.
+func (p *Persist) PurgeUser(id int) error {
+	return p.db.Transaction(func(tx *gorm.DB) error {
+		tx = tx.Unscoped().Session(&gorm.Session{})
+
+		var u User
+		if err := tx.First(&u, id).Error; err != nil {
+			return err
+		}
+
+		var files []File
+		if err := tx.Where("owner_id = ?", id).Find(&files).Error; err != nil {
+			return err
+		}
+		if err := deleteFileVersions(tx, files); err != nil {
+			return err
+		}
+		if err := releaseBlobs(tx, files); err != nil {
+			return err
+		}
+
+		groups := tx.Model(&Group{}).Select("id").Where("owner_id = ?", id)
+		deletes := []struct {
+			model any
+			query string
+			args  []any
+		}{
+			{&File{}, "owner_id = ?", []any{id}},
+			{&Folder{}, "owner_id = ?", []any{id}},
+			{&FolderGrant{}, "owner_id = ? OR user_id = ? OR group_id IN (?)", []any{id, id, groups}},
+			{&GroupMember{}, "user_id = ? OR group_id IN (?)", []any{id, groups}},
+			{&Group{}, "owner_id = ?", []any{id}},
+			{&ShareLink{}, "owner_id = ?", []any{id}},
+			{&Upload{}, "owner_id = ?", []any{id}},
+			{&Session{}, "user_id = ?", []any{id}},
+			{&AppPassword{}, "user_id = ?", []any{id}},
+			{&AccessKey{}, "user_id = ?", []any{id}},
+			{&MultipartPart{}, "upload_id IN (?)", []any{tx.Model(&MultipartUpload{}).Select("id").Where("owner_id = ?", id)}},
+			{&MultipartUpload{}, "owner_id = ?", []any{id}},
+			{&Change{}, "owner_id = ?", []any{id}},
+			{&WebhookDelivery{}, "webhook_id IN (?)", []any{tx.Model(&Webhook{}).Select("id").Where("owner_id = ?", id)}},
+			{&Webhook{}, "owner_id = ?", []any{id}},
+		}
+		for _, d := range deletes {
+			if err := tx.Where(d.query, d.args...).Delete(d.model).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(&u).Error
+	})
+}
@@ -0,0 +1,83 @@
+package persist
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AppPassword lets one app, e.g. a WebDAV client, sign in as a user without
+// their account password, and can be revoked on its own. Only a hash of it
+// is stored. Being random it doesn't need a slow hash like account passwords.
+type AppPassword struct {
+	ID         string     `gorm:"primaryKey;type:uuid" json:"id"`
+	UserID     uint       `gorm:"not null;index" json:"user_id"`
+	Name       string     `gorm:"not null" json:"name"`
+	Hash       string     `gorm:"not null;uniqueIndex" json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+func hashAppPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAppPassword creates an app password for userId, returning the
+// password itself, which can't be recovered later.
+func (p *Persist) CreateAppPassword(userId uint, name string) (AppPassword, string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return AppPassword{}, "", err
+	}
+	password := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+
+	ap := AppPassword{
+		ID:     uuid.NewString(),
+		UserID: userId,
+		Name:   name,
+		Hash:   hashAppPassword(password),
+	}
+	return ap, password, p.db.Create(&ap).Error
+}
+
+func (p *Persist) ListAppPasswords(userId uint) ([]AppPassword, error) {
+	var ap []AppPassword
+	err := p.db.Where("user_id = ?", userId).Order("created_at").Find(&ap).Error
+	return ap, err
+}
+
+func (p *Persist) DeleteAppPassword(userId uint, id string) error {
+	res := p.db.Where("id = ? AND user_id = ?", id, userId).Delete(&AppPassword{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UseAppPassword reports whether password is an app password of userId,
+// recording when it was last used, to the minute.
+func (p *Persist) UseAppPassword(userId uint, password string) (bool, error) {
+	var ap AppPassword
+	err := p.db.Where("user_id = ? AND hash = ?", userId, hashAppPassword(password)).First(&ap).Error
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	if ap.LastUsedAt == nil || now.Sub(*ap.LastUsedAt) > time.Minute {
+		err = p.db.Model(&ap).Update("last_used_at", now).Error
+	}
+	return true, err
+}
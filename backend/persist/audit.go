@@ -0,0 +1,100 @@
+package persist
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+	// AuditDenied is a request refused for lack of authentication or access.
+	AuditDenied = "denied"
+)
+
+// AuditEvent records who did what to what. Events are only ever appended.
+type AuditEvent struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	Time           time.Time `gorm:"not null;index" json:"time"`
+	ActorID        *int      `gorm:"index" json:"actor_id"`
+	ImpersonatorID *int      `json:"impersonator_id,omitempty"`
+	Action         string    `gorm:"not null;index" json:"action"`
+	TargetType     string    `json:"target_type,omitempty"`
+	TargetID       string    `gorm:"index" json:"target_id,omitempty"`
+	IP             string    `json:"ip"`
+	UserAgent      string    `json:"user_agent"`
+	Outcome        string    `gorm:"not null" json:"outcome"`
+	Status         int       `json:"status"`
+	Detail         string    `json:"detail,omitempty"`
+}
+
+// AuditQuery filters audit events. Zero fields don't filter.
+type AuditQuery struct {
+	From    time.Time
+	To      time.Time
+	ActorID *int
+	Action  string
+	// BeforeID pages backwards, only events older than it are returned.
+	BeforeID uint
+	Limit    int
+}
+
+func (p *Persist) CreateAuditEvent(e *AuditEvent) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	return p.db.Create(e).Error
+}
+
+func (p *Persist) auditQuery(q AuditQuery) *gorm.DB {
+	db := p.db.Model(&AuditEvent{})
+	if !q.From.IsZero() {
+		db = db.Where("time >= ?", q.From)
+	}
+	if !q.To.IsZero() {
+		db = db.Where("time < ?", q.To)
+	}
+	if q.ActorID != nil {
+		db = db.Where("actor_id = ?", *q.ActorID)
+	}
+	if q.Action != "" {
+		db = db.Where("action = ?", q.Action)
+	}
+	if q.BeforeID != 0 {
+		db = db.Where("id < ?", q.BeforeID)
+	}
+	return db
+}
+
+// ListAuditEvents returns events matching q, newest first.
+func (p *Persist) ListAuditEvents(q AuditQuery) ([]AuditEvent, error) {
+	var e []AuditEvent
+	db := p.auditQuery(q).Order("id desc")
+	if q.Limit > 0 {
+		db = db.Limit(q.Limit)
+	}
+	err := db.Find(&e).Error
+	return e, err
+}
+
+// EachAuditEvent calls fn with every event matching q, oldest first, without
+// loading them all at once.
+func (p *Persist) EachAuditEvent(q AuditQuery, fn func(AuditEvent) error) error {
+	rows, err := p.auditQuery(q).Order("id").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e AuditEvent
+		if err := p.db.ScanRows(rows, &e); err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,119 @@
+package persist
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Blob is stored content, shared by every file with the same sha256.
+// RefCount is the number of files pointing at it; once it drops to zero the
+// content may be garbage collected.
+type Blob struct {
+	Hash      string    `gorm:"primaryKey" json:"hash"`
+	Size      int64     `gorm:"not null" json:"size"`
+	RefCount  int64     `gorm:"not null;default:0;index" json:"ref_count"`
+	CreatedAt time.Time `json:"created_at"`
+	// UpdatedAt is bumped whenever the blob is touched or referenced, the
+	// garbage collector leaves recently updated blobs alone.
+	UpdatedAt time.Time `gorm:"index" json:"updated_at"`
+}
+
+// TouchBlob records that content with hash is (about to be) stored, without
+// referencing it. It protects the blob from garbage collection for a grace
+// period while the file pointing at it is created.
+func (p *Persist) TouchBlob(hash string, size int64) error {
+	return p.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "hash"}},
+		DoUpdates: clause.Assignments(map[string]any{"updated_at": time.Now()}),
+	}).Create(&Blob{Hash: hash, Size: size}).Error
+}
+
+// refBlob adds delta references to hash.
+func refBlob(tx *gorm.DB, hash string, size int64, delta int64) error {
+	if hash == "" {
+		return nil
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "hash"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"ref_count":  gorm.Expr("blobs.ref_count + ?", delta),
+			"updated_at": time.Now(),
+		}),
+	}).Create(&Blob{Hash: hash, Size: size, RefCount: delta}).Error
+}
+
+// releaseBlobs drops one reference to the blob of each file.
+func releaseBlobs(tx *gorm.DB, files []File) error {
+	for _, f := range files {
+		if f.Sha256 == "" {
+			continue
+		}
+		err := tx.Model(&Blob{}).Where("hash = ?", f.Sha256).
+			Updates(map[string]any{"ref_count": gorm.Expr("ref_count - 1"), "updated_at": time.Now()}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListUnreferencedBlobs returns blobs nobody points at that haven't been
+// touched since before.
+func (p *Persist) ListUnreferencedBlobs(before time.Time) ([]Blob, error) {
+	var b []Blob
+	err := p.db.Where("ref_count <= 0 AND updated_at < ?", before).Find(&b).Error
+	return b, err
+}
+
+// DeleteUnreferencedBlob deletes the row for hash if it is still unreferenced
+// and untouched since before. It reports whether the row was deleted, only
+// then may the content be removed.
+func (p *Persist) DeleteUnreferencedBlob(hash string, before time.Time) (bool, error) {
+	var deleted bool
+	err := p.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("hash = ? AND ref_count <= 0 AND updated_at < ?", hash, before).Delete(&Blob{})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		deleted = true
+		for _, derived := range []any{&BlobText{}, &Thumbnail{}, &ThumbnailJob{}} {
+			if err := tx.Where("hash = ?", hash).Delete(derived).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// ListFilesWithoutBlob returns files, trashed or not, whose content has no
+// blob row, i.e. was stored before content addressing.
+func (p *Persist) ListFilesWithoutBlob() ([]File, error) {
+	var f []File
+	err := p.db.Unscoped().
+		Joins("LEFT JOIN blobs ON blobs.hash = files.sha256").
+		Where("blobs.hash IS NULL").
+		Find(&f).Error
+	return f, err
+}
+
+// SetFileOwner gives a file that had no owner to ownerId.
+func (p *Persist) SetFileOwner(id string, ownerId int) error {
+	return p.db.Unscoped().Model(&File{}).
+		Where("id = ? AND (owner_id IS NULL OR owner_id = 0)", id).
+		Update("owner_id", ownerId).Error
+}
+
+// SetFileBlob points a file at hash and references it.
+func (p *Persist) SetFileBlob(id, hash string, size int64) error {
+	return p.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Model(&File{}).Where("id = ?", id).
+			Updates(map[string]any{"sha256": hash, "file_size": size}).Error
+		if err != nil {
+			return err
+		}
+		return refBlob(tx, hash, size, 1)
+	})
+}
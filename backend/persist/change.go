@@ -0,0 +1,217 @@
+package persist
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+)
+
+const (
+	ChangeKindFile   = "file"
+	ChangeKindFolder = "folder"
+
+	ChangeCreate = "create"
+	// ChangeRename is a change of name in the same folder, ChangeMove one of
+	// folder, maybe with a new name too.
+	ChangeRename = "rename"
+	ChangeMove   = "move"
+	// ChangeUpdate is new content for a file.
+	ChangeUpdate = "update"
+	// ChangeDelete removes a file or folder with everything below it, be it
+	// into the trash or for good. ChangeRestore brings it back from the trash.
+	ChangeDelete  = "delete"
+	ChangeRestore = "restore"
+	// ChangeShare and ChangeUnshare are a folder grant given or taken away.
+	ChangeShare   = "share"
+	ChangeUnshare = "unshare"
+)
+
+// changeLock is the advisory lock taken to record changes. Holding it until
+// commit means changes become visible in the order of their ids, so a
+// client that has seen a change has seen all before it.
+const changeLock = 0x61766368 // "avch"
+
+// changeChannel is the Postgres channel notified when changes commit, so
+// every instance can follow the journal.
+const changeChannel = "avenue_changes"
+
+// Change is an entry of the change journal. Its ID only grows, so the last
+// one a client has seen works as a cursor.
+type Change struct {
+	ID      int64  `gorm:"primaryKey;autoIncrement" json:"id"`
+	OwnerId int    `gorm:"not null;index" json:"owner_id"`
+	Kind    string `gorm:"not null" json:"kind"`
+	ItemID  string `gorm:"not null;index" json:"item_id"`
+	Action  string `gorm:"not null" json:"action"`
+	Name    string `json:"name"`
+	Parent  string `gorm:"index" json:"parent"`
+	// OldParent is where a moved item was before.
+	OldParent string `gorm:"index" json:"old_parent,omitempty"`
+	// Sha256 and FileSize are the content of a created or updated file.
+	Sha256   string `json:"sha256,omitempty"`
+	FileSize int    `json:"file_size,omitempty"`
+	// GranteeId or GranteeGroup is who a share gave, or an unshare took,
+	// access, so they hear of it even when they can no longer see the folder.
+	GranteeId    *int      `gorm:"index" json:"grantee_id,omitempty"`
+	GranteeGroup *string   `gorm:"index" json:"grantee_group,omitempty"`
+	CreatedAt    time.Time `gorm:"index" json:"created_at"`
+}
+
+// recordChange adds c to the journal. tx must be a transaction, run by
+// transact.
+func recordChange(tx *gorm.DB, c Change) error {
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", changeLock).Error; err != nil {
+		return err
+	}
+	if err := tx.Exec("SELECT pg_notify(?, '')", changeChannel).Error; err != nil {
+		return err
+	}
+	return tx.Create(&c).Error
+}
+
+// transact runs fn in a transaction that may record changes, and signals
+// Changed once it commits.
+func (p *Persist) transact(fn func(tx *gorm.DB) error) error {
+	if err := p.db.Transaction(fn); err != nil {
+		return err
+	}
+	p.changedMu.Lock()
+	defer p.changedMu.Unlock()
+	for _, ch := range p.changed {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Changed returns a channel signalled when changes may have been recorded
+// by this process. Every call gets a channel of its own.
+func (p *Persist) Changed() <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	p.changedMu.Lock()
+	p.changed = append(p.changed, ch)
+	p.changedMu.Unlock()
+	return ch
+}
+
+// ListenChanges calls notify whenever changes are recorded by any process
+// sharing the database, until ctx is done or the connection fails.
+func (p *Persist) ListenChanges(ctx context.Context, notify func()) error {
+	conn, err := pgx.Connect(ctx, p.dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	if _, err := conn.Exec(ctx, "LISTEN "+changeChannel); err != nil {
+		return err
+	}
+	for {
+		if _, err := conn.WaitForNotification(ctx); err != nil {
+			return err
+		}
+		notify()
+	}
+}
+
+func fileChange(f *File, action string) Change {
+	c := Change{
+		OwnerId: f.OwnerId,
+		Kind:    ChangeKindFile,
+		ItemID:  f.ID,
+		Action:  action,
+		Name:    f.Name,
+		Parent:  f.Parent,
+	}
+	if action == ChangeCreate || action == ChangeUpdate {
+		c.Sha256, c.FileSize = f.Sha256, f.FileSize
+	}
+	return c
+}
+
+func folderChange(f *Folder, action string) Change {
+	return Change{
+		OwnerId: f.OwnerId,
+		Kind:    ChangeKindFolder,
+		ItemID:  f.FolderID,
+		Action:  action,
+		Name:    f.Name,
+		Parent:  f.Parent,
+	}
+}
+
+// movedChange is the change from a rename or move of an item that was in
+// oldParent.
+func movedChange(c Change, oldParent string) Change {
+	c.Action = ChangeRename
+	if c.Parent != oldParent {
+		c.Action, c.OldParent = ChangeMove, oldParent
+	}
+	return c
+}
+
+// ListChanges returns up to limit changes after cursor that userId may see:
+// changes to what they own, to what is in the folders shared, or that are
+// those folders, and the shares given to or taken from them or their groups.
+func (p *Persist) ListChanges(userId int, shared []string, cursor int64, limit int) ([]Change, error) {
+	groups := p.db.Model(&GroupMember{}).Select("group_id").Where("user_id = ?", userId)
+	scope := p.db.Where("owner_id = ? OR grantee_id = ? OR grantee_group IN (?)", userId, userId, groups)
+	if len(shared) > 0 {
+		scope = scope.Or("item_id IN ? OR parent IN ? OR old_parent IN ?", shared, shared, shared)
+	}
+	var changes []Change
+	err := p.db.Where("id > ?", cursor).Where(scope).Order("id").Limit(limit).Find(&changes).Error
+	return changes, err
+}
+
+// ListChangesAfter returns up to limit changes after cursor, whoever may
+// see them.
+func (p *Persist) ListChangesAfter(cursor int64, limit int) ([]Change, error) {
+	var changes []Change
+	err := p.db.Where("id > ?", cursor).Order("id").Limit(limit).Find(&changes).Error
+	return changes, err
+}
+
+// ChangeRange returns the ids of the oldest and newest change kept, 0 if
+// there have never been any. Pruning keeps the newest change, so a cursor
+// before oldest-1 has missed changes.
+func (p *Persist) ChangeRange() (oldest, newest int64, err error) {
+	row := p.db.Model(&Change{}).Select("COALESCE(MIN(id), 0), COALESCE(MAX(id), 0)").Row()
+	err = row.Scan(&oldest, &newest)
+	return oldest, newest, err
+}
+
+// PruneChanges deletes changes recorded before t. The newest change is
+// always kept, as the high-water mark ChangeRange needs to tell that older
+// cursors have lost their changes.
+func (p *Persist) PruneChanges(t time.Time) (int64, error) {
+	res := p.db.Where("created_at < ? AND id < (SELECT MAX(id) FROM changes)", t).Delete(&Change{})
+	return res.RowsAffected, res.Error
+}
+
+// SharedFolderTree returns the ids of every folder shared with userId, and
+// of every folder below those.
+func (p *Persist) SharedFolderTree(userId int) ([]string, error) {
+	roots, err := p.ListSharedWithUser(userId)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var ids []string
+	for _, r := range roots {
+		below, err := descendantFolderIds(p.db, r.OwnerId, r.FolderID)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range below {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, nil
+}
@@ -1,27 +1,47 @@
 package persist
 
 import (
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 type File struct {
-	ID         string    `gorm:"primaryKey, type:uuid" json:"id"`
-	Name       string    `gorm:"not null" json:"name"`
-	Extension  string    `gorm:"not null" json:"extension"`
-	FileSize   int       `gorm:"column:file_size" json:"file_size"`
-	Parent     string    `json:"parent"`
+	ID        string `gorm:"primaryKey, type:uuid" json:"id"`
+	Name      string `gorm:"not null" json:"name"`
+	Extension string `gorm:"not null" json:"extension"`
+	FileSize  int    `gorm:"column:file_size" json:"file_size"`
+	Sha256    string `gorm:"column:sha256" json:"sha256"`
+	Parent    string `json:"parent"`
+	OwnerId   int    `gorm:"index" json:"owner_id"`
+	// Version counts the uploads of this file's content, see FileVersion.
+	Version    int       `gorm:"not null;default:1" json:"version"`
+	UploaderId int       `json:"uploader_id"`
 	CreatedAt  time.Time `json:"created_at"`
-	DeleteTime time.Time `json:"delete_time"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	// DeleteTime is set while the file is in the trash. TrashRoot is the id
+	// of the file or folder whose deletion put it there.
+	DeleteTime gorm.DeletedAt `gorm:"index" json:"delete_time"`
+	TrashRoot  string         `gorm:"index" json:"-"`
 }
 
-// CreateFile creates a new file record in the database.
+// CreateFile creates a new file record in the database and references its blob.
 func (p *Persist) CreateFile(file *File) (string, error) {
 	if file.ID == "" {
 		file.ID = uuid.NewString()
 	}
-	return file.ID, p.db.Create(file).Error
+	return file.ID, p.transact(func(tx *gorm.DB) error {
+		if err := tx.Create(file).Error; err != nil {
+			return err
+		}
+		if err := recordChange(tx, fileChange(file, ChangeCreate)); err != nil {
+			return err
+		}
+		return refBlob(tx, file.Sha256, int64(file.FileSize), 1)
+	})
 }
 
 // GetFileByID retrieves a file by its ID.
@@ -34,21 +54,63 @@ func (p *Persist) GetFileByID(id string) (*File, error) {
 	return &file, nil
 }
 
-// GetAllFiles retrieves all files from the database.
-func (p *Persist) ListFiles() ([]File, error) {
+// GetOwnedFile retrieves a file by its ID if it belongs to ownerId.
+func (p *Persist) GetOwnedFile(ownerId int, id string) (*File, error) {
+	var file File
+	err := p.db.Where("id = ? AND owner_id = ?", id, ownerId).First(&file).Error
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// GetFileByName retrieves the file of ownerId called name in the folder
+// parent, "" being the top level.
+func (p *Persist) GetFileByName(ownerId int, parent, name string) (*File, error) {
+	var file File
+	err := p.db.Where("owner_id = ? AND parent = ? AND name = ?", ownerId, parent, name).
+		Order("created_at").First(&file).Error
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// ListFiles retrieves all files belonging to ownerId.
+func (p *Persist) ListFiles(ownerId int) ([]File, error) {
 	var files []File
-	err := p.db.Find(&files).Error
+	err := p.db.Where("owner_id = ?", ownerId).Find(&files).Error
 	return files, err
 }
 
-// DeleteFile deletes a file by its ID.
+// DeleteFile permanently deletes a file by its ID, bypassing the trash, and
+// releases its blob.
 func (p *Persist) DeleteFile(id string) error {
-	return p.db.Where("id = ?", id).Delete(&File{}).Error
+	return p.transact(func(tx *gorm.DB) error {
+		tx = tx.Unscoped().Session(&gorm.Session{})
+		var f File
+		if err := tx.Where("id = ?", id).First(&f).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("id = ?", id).Delete(&File{}).Error; err != nil {
+			return err
+		}
+		if err := deleteFileVersions(tx, []File{f}); err != nil {
+			return err
+		}
+		// trashing it was the change already
+		if !f.DeleteTime.Valid {
+			if err := recordChange(tx, fileChange(&f, ChangeDelete)); err != nil {
+				return err
+			}
+		}
+		return releaseBlobs(tx, []File{f})
+	})
 }
 
-func (p *Persist) ListChildFile(parentId string) ([]File, error) {
+func (p *Persist) ListChildFile(ownerId int, parentId string) ([]File, error) {
 	var f []File
-	db := p.db
+	db := p.db.Where("owner_id = ?", ownerId)
 	if parentId != "-1" {
 		db = db.Where("parent = ?", parentId)
 	} else {
@@ -61,3 +123,38 @@ func (p *Persist) ListChildFile(parentId string) ([]File, error) {
 func (p *Persist) UpdateFile(f File, mask []string) error {
 	return p.db.Model(&File{}).Where("id = ?", f.ID).Select(mask).Updates(f).Error
 }
+
+// UpdateOwnedFile renames and/or re-parents a file belonging to ownerId. A nil
+// name or parent leaves that field unchanged.
+func (p *Persist) UpdateOwnedFile(ownerId int, id string, name, parent *string) (*File, error) {
+	fields := map[string]any{}
+	if name != nil {
+		fields["name"] = *name
+		fields["extension"] = strings.ToLower(strings.TrimPrefix(filepath.Ext(*name), "."))
+	}
+	if parent != nil {
+		fields["parent"] = *parent
+	}
+
+	var f File
+	err := p.transact(func(tx *gorm.DB) error {
+		if err := tx.Where("id = ? AND owner_id = ?", id, ownerId).First(&f).Error; err != nil {
+			return err
+		}
+		if len(fields) == 0 {
+			return nil
+		}
+		oldParent := f.Parent
+		if err := tx.Model(&File{}).Where("id = ?", id).Updates(fields).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("id = ?", id).First(&f).Error; err != nil {
+			return err
+		}
+		return recordChange(tx, movedChange(fileChange(&f, ""), oldParent))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
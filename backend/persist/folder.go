@@ -1,19 +1,31 @@
 package persist
 
-import "github.com/google/uuid"
+import (
+	"errors"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
 
 type Folder struct {
-	FolderID string `gorm:"primaryKey, type:uuid, column:folder_id" json:"folder_id"`
-	Name     string `gorm:"not null" json:"name"`
-	Parent   string `json:"parent"`
-	OwnerId  int    `gorm:"not null, column:owner_id" json:"owner_id"`
+	FolderID   string         `gorm:"primaryKey, type:uuid, column:folder_id" json:"folder_id"`
+	Name       string         `gorm:"not null" json:"name"`
+	Parent     string         `json:"parent"`
+	OwnerId    int            `gorm:"not null, column:owner_id" json:"owner_id"`
+	DeleteTime gorm.DeletedAt `gorm:"index" json:"delete_time"`
+	TrashRoot  string         `gorm:"index" json:"-"`
 }
 
 func (p *Persist) CreateFolder(f *Folder) (string, error) {
 	if f.FolderID == "" {
 		f.FolderID = uuid.NewString()
 	}
-	return f.FolderID, p.db.Create(f).Error
+	return f.FolderID, p.transact(func(tx *gorm.DB) error {
+		if err := tx.Create(f).Error; err != nil {
+			return err
+		}
+		return recordChange(tx, folderChange(f, ChangeCreate))
+	})
 }
 
 func (p *Persist) GetFolder(id string) (*Folder, error) {
@@ -25,9 +37,31 @@ func (p *Persist) GetFolder(id string) (*Folder, error) {
 	return &f, nil
 }
 
-func (p *Persist) ListChildFolder(parentId string) ([]Folder, error) {
+// GetOwnedFolder retrieves a folder by its ID if it belongs to ownerId.
+func (p *Persist) GetOwnedFolder(ownerId int, id string) (*Folder, error) {
+	var f Folder
+	err := p.db.Where("folder_id = ? AND owner_id = ?", id, ownerId).First(&f).Error
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// GetFolderByName retrieves the folder of ownerId called name in the folder
+// parent, "" being the top level.
+func (p *Persist) GetFolderByName(ownerId int, parent, name string) (*Folder, error) {
+	var f Folder
+	err := p.db.Where("owner_id = ? AND parent = ? AND name = ?", ownerId, parent, name).
+		Order("folder_id").First(&f).Error
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func (p *Persist) ListChildFolder(ownerId int, parentId string) ([]Folder, error) {
 	var f []Folder
-	db := p.db
+	db := p.db.Where("owner_id = ?", ownerId)
 	if parentId != "-1" {
 		db = db.Where("parent = ?", parentId)
 	} else {
@@ -36,3 +70,99 @@ func (p *Persist) ListChildFolder(parentId string) ([]Folder, error) {
 	err := db.Find(&f).Error
 	return f, err
 }
+
+var ErrFolderCycle = errors.New("a folder can't be moved into itself or one of its descendants")
+
+// UpdateFolder renames and/or re-parents a folder belonging to ownerId. A nil
+// name or parent leaves that field unchanged, and an empty parent moves the
+// folder to the top level.
+func (p *Persist) UpdateFolder(ownerId int, id string, name, parent *string) (*Folder, error) {
+	var f Folder
+	err := p.transact(func(tx *gorm.DB) error {
+		if err := tx.Where("folder_id = ? AND owner_id = ?", id, ownerId).First(&f).Error; err != nil {
+			return err
+		}
+
+		fields := map[string]any{}
+		if name != nil {
+			fields["name"] = *name
+		}
+		if parent != nil && *parent != f.Parent {
+			if *parent != "" {
+				// walk up from the new parent, if we pass through the folder
+				// being moved it would become its own ancestor
+				for cur := *parent; cur != ""; {
+					if cur == id {
+						return ErrFolderCycle
+					}
+					var anc Folder
+					if err := tx.Where("folder_id = ? AND owner_id = ?", cur, ownerId).First(&anc).Error; err != nil {
+						return err
+					}
+					cur = anc.Parent
+				}
+			}
+			fields["parent"] = *parent
+		}
+		if len(fields) == 0 {
+			return nil
+		}
+
+		oldParent := f.Parent
+		if err := tx.Model(&Folder{}).Where("folder_id = ?", id).Updates(fields).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("folder_id = ?", id).First(&f).Error; err != nil {
+			return err
+		}
+		return recordChange(tx, movedChange(folderChange(&f, ""), oldParent))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// DeleteFolderTree permanently deletes a folder together with every folder and
+// file below it, trashed or not, in one transaction, releasing the blobs of the
+// removed files, which are returned.
+func (p *Persist) DeleteFolderTree(ownerId int, id string) ([]File, error) {
+	var files []File
+	err := p.transact(func(tx *gorm.DB) error {
+		tx = tx.Unscoped().Session(&gorm.Session{})
+
+		var root Folder
+		if err := tx.Where("folder_id = ? AND owner_id = ?", id, ownerId).First(&root).Error; err != nil {
+			return err
+		}
+
+		ids, err := descendantFolderIds(tx, ownerId, id)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Where("owner_id = ? AND parent IN ?", ownerId, ids).Find(&files).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("owner_id = ? AND parent IN ?", ownerId, ids).Delete(&File{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("folder_id IN ?", ids).Delete(&Folder{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("folder_id IN ?", ids).Delete(&FolderGrant{}).Error; err != nil {
+			return err
+		}
+		if err := deleteFileVersions(tx, files); err != nil {
+			return err
+		}
+		// trashing it was the change already
+		if !root.DeleteTime.Valid {
+			if err := recordChange(tx, folderChange(&root, ChangeDelete)); err != nil {
+				return err
+			}
+		}
+		return releaseBlobs(tx, files)
+	})
+	return files, err
+}
@@ -2,13 +2,22 @@ package persist
 
 import (
 	"fmt"
+	"sync"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
+// ErrNotFound is returned when a record does not exist or is not visible to
+// the caller. Handlers should answer it with a 404.
+var ErrNotFound = gorm.ErrRecordNotFound
+
 type Persist struct {
-	db *gorm.DB
+	db  *gorm.DB
+	dsn string
+	// changed are signalled after a transaction that recorded changes commits
+	changedMu sync.Mutex
+	changed   []chan struct{}
 }
 
 func NewPersist(host, user, password, dbname string) *Persist {
@@ -25,6 +34,31 @@ func NewPersist(host, user, password, dbname string) *Persist {
 		panic(fmt.Sprintf("failed to migrate database for files: %v", err))
 	}
 
+	// files used to be written with a zero delete_time, which would now read
+	// as being in the trash
+	err = db.Exec("UPDATE files SET delete_time = NULL WHERE delete_time < '1970-01-02'").Error
+	if err != nil {
+		panic(fmt.Sprintf("failed to migrate database for files: %v", err))
+	}
+
+	// files used to have no owner, they belong to the owner of their folder.
+	// Those at the top level are claimed by MigrateLegacyBlobs, from where
+	// their content was stored.
+	err = db.Exec("UPDATE files SET owner_id = folders.owner_id FROM folders WHERE files.parent = folders.folder_id AND files.owner_id IS NULL").Error
+	if err != nil {
+		panic(fmt.Sprintf("failed to migrate database for files: %v", err))
+	}
+
+	err = db.Exec("UPDATE files SET updated_at = created_at WHERE updated_at IS NULL").Error
+	if err != nil {
+		panic(fmt.Sprintf("failed to migrate database for files: %v", err))
+	}
+
+	err = db.AutoMigrate(&FileVersion{})
+	if err != nil {
+		panic(fmt.Sprintf("failed to migrate database for file versions: %v", err))
+	}
+
 	err = db.AutoMigrate(&User{})
 	if err != nil {
 		panic(fmt.Sprintf("failed to migrate database for users: %v", err))
@@ -35,5 +69,62 @@ func NewPersist(host, user, password, dbname string) *Persist {
 		panic(fmt.Sprintf("failed to migrate database for folder: %v", err))
 	}
 
-	return &Persist{db: db}
+	err = db.AutoMigrate(&Session{})
+	if err != nil {
+		panic(fmt.Sprintf("failed to migrate database for sessions: %v", err))
+	}
+
+	err = db.AutoMigrate(&Blob{})
+	if err != nil {
+		panic(fmt.Sprintf("failed to migrate database for blobs: %v", err))
+	}
+
+	migrateSearch(db)
+
+	err = db.AutoMigrate(&Group{}, &GroupMember{}, &FolderGrant{})
+	if err != nil {
+		panic(fmt.Sprintf("failed to migrate database for groups and grants: %v", err))
+	}
+
+	err = db.AutoMigrate(&AuditEvent{})
+	if err != nil {
+		panic(fmt.Sprintf("failed to migrate database for audit events: %v", err))
+	}
+
+	err = db.AutoMigrate(&ShareLink{})
+	if err != nil {
+		panic(fmt.Sprintf("failed to migrate database for share links: %v", err))
+	}
+
+	err = db.AutoMigrate(&Upload{})
+	if err != nil {
+		panic(fmt.Sprintf("failed to migrate database for uploads: %v", err))
+	}
+
+	err = db.AutoMigrate(&AppPassword{})
+	if err != nil {
+		panic(fmt.Sprintf("failed to migrate database for app passwords: %v", err))
+	}
+
+	err = db.AutoMigrate(&AccessKey{}, &MultipartUpload{}, &MultipartPart{})
+	if err != nil {
+		panic(fmt.Sprintf("failed to migrate database for s3 access: %v", err))
+	}
+
+	err = db.AutoMigrate(&Thumbnail{}, &ThumbnailJob{})
+	if err != nil {
+		panic(fmt.Sprintf("failed to migrate database for thumbnails: %v", err))
+	}
+
+	err = db.AutoMigrate(&Change{})
+	if err != nil {
+		panic(fmt.Sprintf("failed to migrate database for changes: %v", err))
+	}
+
+	err = db.AutoMigrate(&Webhook{}, &WebhookDelivery{}, &WebhookCursor{})
+	if err != nil {
+		panic(fmt.Sprintf("failed to migrate database for webhooks: %v", err))
+	}
+
+	return &Persist{db: db, dsn: dsn}
 }
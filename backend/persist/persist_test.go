@@ -0,0 +1,42 @@
+package persist
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"avenue/backend/shared"
+)
+
+// testPersist connects to the database at TEST_DB_HOST. Tests needing one
+// are skipped without it.
+func testPersist(t *testing.T) *Persist {
+	t.Helper()
+	host := os.Getenv("TEST_DB_HOST")
+	if host == "" {
+		t.Skip("TEST_DB_HOST is not set")
+	}
+	return NewPersist(
+		host,
+		shared.GetEnv("TEST_DB_USER", "user"),
+		shared.GetEnv("TEST_DB_PASSWORD", "secret"),
+		shared.GetEnv("TEST_DB_DATABASE", "avenue"),
+	)
+}
+
+// testUser makes a user that is purged with everything they own when the
+// test ends.
+func testUser(t *testing.T, p *Persist) int {
+	t.Helper()
+	u, err := p.CreateUser(fmt.Sprintf("test-%d@example.com", time.Now().UnixNano()), "secret")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := p.PurgeUser(int(u.ID)); err != nil {
+			t.Errorf("PurgeUser: %v", err)
+		}
+	})
+	return int(u.ID)
+}
@@ -0,0 +1,173 @@
+package persist
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// AccessKey lets S3 clients sign requests as a user. Checking a SigV4
+// signature takes the secret itself, so unlike passwords it is stored as is.
+type AccessKey struct {
+	ID         string     `gorm:"primaryKey" json:"access_key_id"`
+	UserID     uint       `gorm:"not null;index" json:"user_id"`
+	Name       string     `gorm:"not null" json:"name"`
+	SecretKey  string     `gorm:"not null" json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// CreateAccessKey creates an access key for userId. Its id looks like an AWS
+// one, 20 upper case characters, so clients that check accept it.
+func (p *Persist) CreateAccessKey(userId uint, name string) (AccessKey, error) {
+	id := make([]byte, 10)
+	secret := make([]byte, 30)
+	if _, err := rand.Read(id); err != nil {
+		return AccessKey{}, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return AccessKey{}, err
+	}
+	k := AccessKey{
+		ID:        "AV" + strings.ToUpper(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(id))[:18],
+		UserID:    userId,
+		Name:      name,
+		SecretKey: base64.StdEncoding.EncodeToString(secret),
+	}
+	return k, p.db.Create(&k).Error
+}
+
+func (p *Persist) GetAccessKey(id string) (AccessKey, error) {
+	var k AccessKey
+	err := p.db.Where("id = ?", id).First(&k).Error
+	return k, err
+}
+
+// TouchAccessKey records that k was used, to the minute.
+func (p *Persist) TouchAccessKey(k AccessKey) error {
+	now := time.Now()
+	if k.LastUsedAt != nil && now.Sub(*k.LastUsedAt) < time.Minute {
+		return nil
+	}
+	return p.db.Model(&k).Update("last_used_at", now).Error
+}
+
+func (p *Persist) ListAccessKeys(userId uint) ([]AccessKey, error) {
+	var k []AccessKey
+	err := p.db.Where("user_id = ?", userId).Order("created_at").Find(&k).Error
+	return k, err
+}
+
+func (p *Persist) DeleteAccessKey(userId uint, id string) error {
+	res := p.db.Where("id = ? AND user_id = ?", id, userId).Delete(&AccessKey{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// MultipartUpload is an S3 multipart upload that hasn't been completed or
+// aborted yet. Its parts live in the upload staging area until then.
+type MultipartUpload struct {
+	ID      string `gorm:"primaryKey;type:uuid" json:"id"`
+	OwnerId int    `gorm:"not null;index" json:"owner_id"`
+	// Bucket is the id of the top level folder the upload goes in.
+	Bucket    string    `gorm:"not null" json:"bucket"`
+	Key       string    `gorm:"not null" json:"key"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MultipartPart is a part received for a MultipartUpload.
+type MultipartPart struct {
+	UploadID   string    `gorm:"primaryKey;type:uuid" json:"upload_id"`
+	PartNumber int       `gorm:"primaryKey;autoIncrement:false" json:"part_number"`
+	Size       int64     `gorm:"not null" json:"size"`
+	Sha256     string    `gorm:"not null" json:"sha256"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+func (p *Persist) CreateMultipartUpload(u *MultipartUpload) error {
+	if u.ID == "" {
+		u.ID = uuid.NewString()
+	}
+	return p.db.Create(u).Error
+}
+
+// GetOwnedMultipartUpload retrieves an upload by its ID if it belongs to
+// ownerId.
+func (p *Persist) GetOwnedMultipartUpload(ownerId int, id string) (*MultipartUpload, error) {
+	var u MultipartUpload
+	err := p.db.Where("id = ? AND owner_id = ?", id, ownerId).First(&u).Error
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// SaveMultipartPart records a part, replacing one with the same number.
+func (p *Persist) SaveMultipartPart(part *MultipartPart) error {
+	return p.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(part).Error
+}
+
+// ListMultipartParts returns the parts of an upload by number.
+func (p *Persist) ListMultipartParts(uploadId string) ([]MultipartPart, error) {
+	var parts []MultipartPart
+	err := p.db.Where("upload_id = ?", uploadId).Order("part_number").Find(&parts).Error
+	return parts, err
+}
+
+// MultipartBytes returns the size of the parts ownerId has uploaded for
+// multipart uploads that are still in progress, leaving out part number
+// skipPart of upload skipUpload.
+func (p *Persist) MultipartBytes(ownerId int, skipUpload string, skipPart int) (int64, error) {
+	var n int64
+	err := p.db.Model(&MultipartPart{}).
+		Select("COALESCE(SUM(size), 0)").
+		Where("upload_id IN (?)", p.db.Model(&MultipartUpload{}).Select("id").Where("owner_id = ?", ownerId)).
+		Where("NOT (upload_id = ? AND part_number = ?)", skipUpload, skipPart).
+		Scan(&n).Error
+	return n, err
+}
+
+// ListMultipartUploadsBefore returns the uploads started before t.
+func (p *Persist) ListMultipartUploadsBefore(t time.Time) ([]MultipartUpload, error) {
+	var u []MultipartUpload
+	err := p.db.Where("created_at < ?", t).Find(&u).Error
+	return u, err
+}
+
+// DeleteMultipartUpload forgets an upload and its parts.
+func (p *Persist) DeleteMultipartUpload(id string) error {
+	return p.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("upload_id = ?", id).Delete(&MultipartPart{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", id).Delete(&MultipartUpload{}).Error
+	})
+}
+
+// ListFolderTree returns every live folder below id, and every live file in
+// it or below.
+func (p *Persist) ListFolderTree(ownerId int, id string) ([]Folder, []File, error) {
+	ids, err := descendantFolderIds(p.db, ownerId, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	var folders []Folder
+	err = p.db.Where("owner_id = ? AND folder_id IN ? AND folder_id <> ?", ownerId, ids, id).Find(&folders).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	var files []File
+	err = p.db.Where("owner_id = ? AND parent IN ?", ownerId, ids).Find(&files).Error
+	return folders, files, err
+}
@@ -0,0 +1,164 @@
+package persist
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// BlobText is the text extracted from a blob for full-text search. The tsv
+// column indexing it is generated by postgres, see migrateSearch.
+type BlobText struct {
+	Hash      string `gorm:"primaryKey"`
+	Text      string `gorm:"type:text;not null"`
+	CreatedAt time.Time
+}
+
+// migrateSearch adds the indexes behind SearchFiles and SearchFolders. Name
+// searches use trigram indexes when the pg_trgm extension can be created,
+// and fall back to scanning otherwise.
+func migrateSearch(db *gorm.DB) {
+	if err := db.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm").Error; err != nil {
+		log.Printf("pg_trgm is not available, name search won't be indexed: %v", err)
+	} else {
+		for _, stmt := range []string{
+			"CREATE INDEX IF NOT EXISTS idx_files_name_trgm ON files USING gin (name gin_trgm_ops)",
+			"CREATE INDEX IF NOT EXISTS idx_folders_name_trgm ON folders USING gin (name gin_trgm_ops)",
+		} {
+			if err := db.Exec(stmt).Error; err != nil {
+				panic(fmt.Sprintf("failed to migrate database for search: %v", err))
+			}
+		}
+	}
+
+	if err := db.AutoMigrate(&BlobText{}); err != nil {
+		panic(fmt.Sprintf("failed to migrate database for search: %v", err))
+	}
+	for _, stmt := range []string{
+		"ALTER TABLE blob_texts ADD COLUMN IF NOT EXISTS tsv tsvector GENERATED ALWAYS AS (to_tsvector('simple', text)) STORED",
+		"CREATE INDEX IF NOT EXISTS idx_blob_texts_tsv ON blob_texts USING gin (tsv)",
+	} {
+		if err := db.Exec(stmt).Error; err != nil {
+			panic(fmt.Sprintf("failed to migrate database for search: %v", err))
+		}
+	}
+}
+
+// SaveBlobText stores the text of the blob hash, unless it has some already.
+func (p *Persist) SaveBlobText(hash, text string) error {
+	return p.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&BlobText{Hash: hash, Text: text}).Error
+}
+
+func (p *Persist) HasBlobText(hash string) (bool, error) {
+	var n int64
+	err := p.db.Model(&BlobText{}).Where("hash = ?", hash).Count(&n).Error
+	return n > 0, err
+}
+
+// ListUnindexedFiles returns files with one of extensions whose content has
+// no text stored yet.
+func (p *Persist) ListUnindexedFiles(extensions []string) ([]File, error) {
+	var f []File
+	err := p.db.
+		Joins("LEFT JOIN blob_texts ON blob_texts.hash = files.sha256").
+		Where("blob_texts.hash IS NULL AND files.sha256 <> '' AND files.extension IN ?", extensions).
+		Find(&f).Error
+	return f, err
+}
+
+// SubtreeFolderIds returns id and the ids of every live folder below it.
+func (p *Persist) SubtreeFolderIds(ownerId int, id string) ([]string, error) {
+	return descendantFolderIds(p.db, ownerId, id)
+}
+
+// SearchQuery filters files and folders. Zero fields don't filter.
+type SearchQuery struct {
+	// OwnerId and FolderIds decide what may be found: everything owned by
+	// OwnerId, and everything directly inside one of FolderIds. An OwnerId
+	// of 0 matches nobody.
+	OwnerId   int
+	FolderIds []string
+
+	// Name matches names containing it, Prefix names starting with it.
+	Name   string
+	Prefix string
+
+	// The rest only apply to files.
+	Extensions    []string
+	MinSize       *int64
+	MaxSize       *int64
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// Content is a full-text query over the indexed text of files.
+	Content string
+
+	Limit  int
+	Offset int
+}
+
+// FilesOnly reports whether q filters on something folders don't have.
+func (q SearchQuery) FilesOnly() bool {
+	return len(q.Extensions) > 0 || q.MinSize != nil || q.MaxSize != nil ||
+		!q.CreatedAfter.IsZero() || !q.CreatedBefore.IsZero() || q.Content != ""
+}
+
+func likeEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// nameFilter narrows db to the part of q that applies to both files and
+// folders, on table.
+func (q SearchQuery) nameFilter(db *gorm.DB, table string) *gorm.DB {
+	db = db.Where("("+table+".owner_id = ? OR "+table+".parent IN ?)", q.OwnerId, q.FolderIds)
+	if q.Name != "" {
+		db = db.Where(table+".name ILIKE ?", "%"+likeEscape(q.Name)+"%")
+	}
+	if q.Prefix != "" {
+		db = db.Where(table+".name ILIKE ?", likeEscape(q.Prefix)+"%")
+	}
+	if q.Limit > 0 {
+		db = db.Limit(q.Limit)
+	}
+	return db.Offset(q.Offset)
+}
+
+// SearchFiles returns the files matching q, best full-text matches first
+// when q.Content is set and by name otherwise.
+func (p *Persist) SearchFiles(q SearchQuery) ([]File, error) {
+	db := q.nameFilter(p.db.Model(&File{}), "files")
+	if len(q.Extensions) > 0 {
+		db = db.Where("files.extension IN ?", q.Extensions)
+	}
+	if q.MinSize != nil {
+		db = db.Where("files.file_size >= ?", *q.MinSize)
+	}
+	if q.MaxSize != nil {
+		db = db.Where("files.file_size <= ?", *q.MaxSize)
+	}
+	if !q.CreatedAfter.IsZero() {
+		db = db.Where("files.created_at >= ?", q.CreatedAfter)
+	}
+	if !q.CreatedBefore.IsZero() {
+		db = db.Where("files.created_at < ?", q.CreatedBefore)
+	}
+	if q.Content != "" {
+		db = db.Joins("JOIN blob_texts ON blob_texts.hash = files.sha256").
+			Where("blob_texts.tsv @@ plainto_tsquery('simple', ?)", q.Content).
+			Order(clause.Expr{SQL: "ts_rank(blob_texts.tsv, plainto_tsquery('simple', ?)) DESC", Vars: []any{q.Content}})
+	}
+
+	var f []File
+	err := db.Order("files.name").Find(&f).Error
+	return f, err
+}
+
+// SearchFolders returns the folders matching the name part of q.
+func (p *Persist) SearchFolders(q SearchQuery) ([]Folder, error) {
+	var f []Folder
+	err := q.nameFilter(p.db.Model(&Folder{}), "folders").Order("folders.name").Find(&f).Error
+	return f, err
+}
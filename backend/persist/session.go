@@ -0,0 +1,227 @@
+package persist
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is a single logged in device. Token is the bearer secret handed to
+// the client, ID is the public handle used when listing and revoking.
+type Session struct {
+	ID         string     `gorm:"primaryKey;type:uuid" json:"id"`
+	Token      string     `gorm:"not null;uniqueIndex" json:"-"`
+	UserID     uint       `gorm:"not null;index" json:"user_id"`
+	Device     string     `json:"device"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `gorm:"not null;index" json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	// ImpersonatorID is the admin who opened the session as this user.
+	ImpersonatorID *uint `json:"impersonator_id,omitempty"`
+}
+
+// IsActive reports whether the session can still be used to authenticate.
+func (s *Session) IsActive(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+// SessionStore keeps track of logged in sessions.
+type SessionStore interface {
+	// Create stores a new session, filling in the ID and Token if empty.
+	Create(s *Session) error
+	// GetByToken looks up a session by its bearer token.
+	GetByToken(token string) (*Session, error)
+	// Touch records activity on a session and slides its expiry forward.
+	Touch(id string, lastSeen, expiresAt time.Time) error
+	// Revoke invalidates a single session belonging to userID.
+	Revoke(userID uint, id string) error
+	// RevokeAll invalidates every session belonging to userID.
+	RevokeAll(userID uint) error
+	// ListActive returns the sessions of userID that are still usable.
+	ListActive(userID uint, now time.Time) ([]Session, error)
+	// DeleteExpired removes expired and revoked sessions, returning how many were removed.
+	DeleteExpired(now time.Time) (int64, error)
+}
+
+func fillSession(s *Session) {
+	if s.ID == "" {
+		s.ID = uuid.NewString()
+	}
+	if s.Token == "" {
+		s.Token = uuid.NewString()
+	}
+	if s.CreatedAt.IsZero() {
+		s.CreatedAt = time.Now()
+	}
+	if s.LastSeenAt.IsZero() {
+		s.LastSeenAt = s.CreatedAt
+	}
+}
+
+// DBSessionStore is a SessionStore backed by the sessions table.
+type DBSessionStore struct {
+	db *gorm.DB
+}
+
+// SessionStore returns a SessionStore backed by the database.
+func (p *Persist) SessionStore() *DBSessionStore {
+	return &DBSessionStore{db: p.db}
+}
+
+func (d *DBSessionStore) Create(s *Session) error {
+	fillSession(s)
+	return d.db.Create(s).Error
+}
+
+func (d *DBSessionStore) GetByToken(token string) (*Session, error) {
+	var s Session
+	err := d.db.Where("token = ?", token).First(&s).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (d *DBSessionStore) Touch(id string, lastSeen, expiresAt time.Time) error {
+	return d.db.Model(&Session{}).
+		Where("id = ? AND revoked_at IS NULL", id).
+		Updates(map[string]any{"last_seen_at": lastSeen, "expires_at": expiresAt}).Error
+}
+
+func (d *DBSessionStore) Revoke(userID uint, id string) error {
+	res := d.db.Model(&Session{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", id, userID).
+		Update("revoked_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+func (d *DBSessionStore) RevokeAll(userID uint) error {
+	return d.db.Model(&Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+func (d *DBSessionStore) ListActive(userID uint, now time.Time) ([]Session, error) {
+	var s []Session
+	err := d.db.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, now).
+		Order("last_seen_at desc").
+		Find(&s).Error
+	return s, err
+}
+
+func (d *DBSessionStore) DeleteExpired(now time.Time) (int64, error) {
+	res := d.db.Where("expires_at <= ? OR revoked_at IS NOT NULL", now).Delete(&Session{})
+	return res.RowsAffected, res.Error
+}
+
+// MemorySessionStore is a SessionStore that lives in memory, for tests and
+// running without a database.
+type MemorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]Session
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string]Session)}
+}
+
+func (m *MemorySessionStore) Create(s *Session) error {
+	fillSession(s)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[s.ID] = *s
+	return nil
+}
+
+func (m *MemorySessionStore) GetByToken(token string) (*Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, s := range m.sessions {
+		if s.Token == token {
+			return &s, nil
+		}
+	}
+	return nil, ErrSessionNotFound
+}
+
+func (m *MemorySessionStore) Touch(id string, lastSeen, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok || s.RevokedAt != nil {
+		return nil
+	}
+	s.LastSeenAt = lastSeen
+	s.ExpiresAt = expiresAt
+	m.sessions[id] = s
+	return nil
+}
+
+func (m *MemorySessionStore) Revoke(userID uint, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok || s.UserID != userID || s.RevokedAt != nil {
+		return ErrSessionNotFound
+	}
+	now := time.Now()
+	s.RevokedAt = &now
+	m.sessions[id] = s
+	return nil
+}
+
+func (m *MemorySessionStore) RevokeAll(userID uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for id, s := range m.sessions {
+		if s.UserID == userID && s.RevokedAt == nil {
+			s.RevokedAt = &now
+			m.sessions[id] = s
+		}
+	}
+	return nil
+}
+
+func (m *MemorySessionStore) ListActive(userID uint, now time.Time) ([]Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var out []Session
+	for _, s := range m.sessions {
+		if s.UserID == userID && s.IsActive(now) {
+			out = append(out, s)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LastSeenAt.After(out[j].LastSeenAt) })
+	return out, nil
+}
+
+func (m *MemorySessionStore) DeleteExpired(now time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for id, s := range m.sessions {
+		if !s.IsActive(now) {
+			delete(m.sessions, id)
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,188 @@
+package persist
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemorySessionCreate(t *testing.T) {
+	m := NewMemorySessionStore()
+	s := Session{UserID: 1, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := m.Create(&s); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if s.ID == "" || s.Token == "" || s.ID == s.Token {
+		t.Fatalf("Create filled in ID %q and Token %q", s.ID, s.Token)
+	}
+	if s.CreatedAt.IsZero() || !s.LastSeenAt.Equal(s.CreatedAt) {
+		t.Errorf("created %v, last seen %v", s.CreatedAt, s.LastSeenAt)
+	}
+
+	got, err := m.GetByToken(s.Token)
+	if err != nil || got.ID != s.ID {
+		t.Fatalf("GetByToken = %+v, %v", got, err)
+	}
+	// callers get a copy, not the stored session
+	got.UserID = 2
+	if again, _ := m.GetByToken(s.Token); again.UserID != 1 {
+		t.Error("changing a looked up session changed the store")
+	}
+	if _, err := m.GetByToken(s.ID); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("GetByToken with the public id = %v", err)
+	}
+}
+
+func TestMemorySessionSlidingExpiry(t *testing.T) {
+	m := NewMemorySessionStore()
+	start := time.Now()
+	s := Session{UserID: 1, ExpiresAt: start.Add(time.Hour)}
+	if err := m.Create(&s); err != nil {
+		t.Fatal(err)
+	}
+
+	// seen half an hour in, the session now lasts until an hour after that
+	seen := start.Add(30 * time.Minute)
+	if err := m.Touch(s.ID, seen, seen.Add(time.Hour)); err != nil {
+		t.Fatalf("Touch: %v", err)
+	}
+	got, err := m.GetByToken(s.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.LastSeenAt.Equal(seen) || !got.ExpiresAt.Equal(seen.Add(time.Hour)) {
+		t.Errorf("touched session last seen %v, expires %v", got.LastSeenAt, got.ExpiresAt)
+	}
+
+	later := start.Add(80 * time.Minute)
+	if !got.IsActive(later) {
+		t.Error("session expired at its original time despite being touched")
+	}
+	if active, _ := m.ListActive(1, later); len(active) != 1 {
+		t.Errorf("%d active sessions after the original expiry, want 1", len(active))
+	}
+	if got.IsActive(seen.Add(time.Hour)) {
+		t.Error("session still active at its new expiry")
+	}
+	if active, _ := m.ListActive(1, seen.Add(time.Hour)); len(active) != 0 {
+		t.Errorf("%d active sessions after the new expiry, want 0", len(active))
+	}
+
+	// touching a session that is gone is not an error
+	if err := m.Touch("missing", seen, seen.Add(time.Hour)); err != nil {
+		t.Errorf("Touch of a missing session: %v", err)
+	}
+}
+
+func TestMemorySessionListActive(t *testing.T) {
+	m := NewMemorySessionStore()
+	now := time.Now()
+	old := Session{UserID: 1, LastSeenAt: now.Add(-time.Hour), CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(time.Hour)}
+	recent := Session{UserID: 1, LastSeenAt: now.Add(-time.Minute), CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(time.Hour)}
+	expired := Session{UserID: 1, ExpiresAt: now.Add(-time.Second)}
+	other := Session{UserID: 2, ExpiresAt: now.Add(time.Hour)}
+	for _, s := range []*Session{&old, &recent, &expired, &other} {
+		if err := m.Create(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	active, err := m.ListActive(1, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != 2 || active[0].ID != recent.ID || active[1].ID != old.ID {
+		t.Errorf("ListActive = %+v, want the recent then the old session", active)
+	}
+}
+
+func TestMemorySessionRevoke(t *testing.T) {
+	m := NewMemorySessionStore()
+	now := time.Now()
+	s := Session{UserID: 1, ExpiresAt: now.Add(time.Hour)}
+	if err := m.Create(&s); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Revoke(2, s.ID); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Revoke by another user = %v, want ErrSessionNotFound", err)
+	}
+	if err := m.Revoke(1, s.ID); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if err := m.Revoke(1, s.ID); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Revoke twice = %v, want ErrSessionNotFound", err)
+	}
+
+	got, err := m.GetByToken(s.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.RevokedAt == nil || got.IsActive(now) {
+		t.Errorf("revoked session: revoked at %v, active %v", got.RevokedAt, got.IsActive(now))
+	}
+	// a revoked session can't be brought back by activity
+	if err := m.Touch(s.ID, now, now.Add(24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := m.GetByToken(s.Token); !got.ExpiresAt.Equal(s.ExpiresAt) {
+		t.Errorf("Touch moved a revoked session's expiry to %v", got.ExpiresAt)
+	}
+}
+
+func TestMemorySessionRevokeAll(t *testing.T) {
+	m := NewMemorySessionStore()
+	now := time.Now()
+	mine := []Session{{UserID: 1, ExpiresAt: now.Add(time.Hour)}, {UserID: 1, ExpiresAt: now.Add(time.Hour)}}
+	theirs := Session{UserID: 2, ExpiresAt: now.Add(time.Hour)}
+	for i := range mine {
+		if err := m.Create(&mine[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Create(&theirs); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RevokeAll(1); err != nil {
+		t.Fatalf("RevokeAll: %v", err)
+	}
+	if active, _ := m.ListActive(1, now); len(active) != 0 {
+		t.Errorf("%d sessions still active after RevokeAll", len(active))
+	}
+	if active, _ := m.ListActive(2, now); len(active) != 1 {
+		t.Errorf("RevokeAll of user 1 left user 2 with %d sessions, want 1", len(active))
+	}
+}
+
+func TestMemorySessionDeleteExpired(t *testing.T) {
+	m := NewMemorySessionStore()
+	now := time.Now()
+	active := Session{UserID: 1, ExpiresAt: now.Add(time.Hour)}
+	expired := Session{UserID: 1, ExpiresAt: now.Add(-time.Minute)}
+	revoked := Session{UserID: 2, ExpiresAt: now.Add(time.Hour)}
+	for _, s := range []*Session{&active, &expired, &revoked} {
+		if err := m.Create(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Revoke(2, revoked.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := m.DeleteExpired(now)
+	if err != nil || n != 2 {
+		t.Fatalf("DeleteExpired = %d, %v, want 2", n, err)
+	}
+	if _, err := m.GetByToken(active.Token); err != nil {
+		t.Errorf("active session was reaped: %v", err)
+	}
+	for _, s := range []Session{expired, revoked} {
+		if _, err := m.GetByToken(s.Token); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("session %s was kept: %v", s.ID, err)
+		}
+	}
+	if n, _ := m.DeleteExpired(now); n != 0 {
+		t.Errorf("second DeleteExpired removed %d", n)
+	}
+}
@@ -0,0 +1,141 @@
+package persist
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	ShareKindFile   = "file"
+	ShareKindFolder = "folder"
+
+	ShareModeRead   = "read"
+	ShareModeUpload = "upload"
+)
+
+// ShareLink gives anyone holding Token access to a file or folder without an
+// account.
+type ShareLink struct {
+	ID    string `gorm:"primaryKey;type:uuid" json:"id"`
+	Token string `gorm:"not null;uniqueIndex" json:"token"`
+	// OwnerId owns what is shared. CreatedBy is who made the link, a co-owner
+	// of a shared folder when it isn't the owner.
+	OwnerId      int        `gorm:"not null;index" json:"owner_id"`
+	CreatedBy    int        `gorm:"index" json:"created_by,omitempty"`
+	Kind         string     `gorm:"not null" json:"kind"`
+	TargetID     string     `gorm:"not null;index" json:"target_id"`
+	Mode         string     `gorm:"not null" json:"mode"`
+	PasswordHash string     `json:"-"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	// MaxDownloads limits how many files may be downloaded through the
+	// link, 0 means unlimited.
+	MaxDownloads int        `gorm:"not null;default:0" json:"max_downloads"`
+	Downloads    int        `gorm:"not null;default:0" json:"downloads"`
+	CreatedAt    time.Time  `json:"created_at"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+}
+
+// HasPassword reports whether the link is password protected.
+func (l *ShareLink) HasPassword() bool {
+	return l.PasswordHash != ""
+}
+
+// IsActive reports whether the link can still be used.
+func (l *ShareLink) IsActive(now time.Time) bool {
+	if l.RevokedAt != nil {
+		return false
+	}
+	if l.ExpiresAt != nil && !now.Before(*l.ExpiresAt) {
+		return false
+	}
+	return l.MaxDownloads == 0 || l.Downloads < l.MaxDownloads
+}
+
+// newShareToken returns 256 random bits, URL safe.
+func newShareToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CreateShareLink stores a new link, filling in the ID and Token if empty.
+func (p *Persist) CreateShareLink(l *ShareLink) (string, error) {
+	if l.ID == "" {
+		l.ID = uuid.NewString()
+	}
+	if l.Token == "" {
+		t, err := newShareToken()
+		if err != nil {
+			return "", err
+		}
+		l.Token = t
+	}
+	return l.ID, p.db.Create(l).Error
+}
+
+func (p *Persist) GetShareLinkByToken(token string) (*ShareLink, error) {
+	var l ShareLink
+	err := p.db.Where("token = ?", token).First(&l).Error
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// ListShareLinks returns the links to ownerId's things, and those ownerId
+// made, that haven't been revoked.
+func (p *Persist) ListShareLinks(ownerId int) ([]ShareLink, error) {
+	var l []ShareLink
+	err := p.db.Where("(owner_id = ? OR created_by = ?) AND revoked_at IS NULL", ownerId, ownerId).Order("created_at desc").Find(&l).Error
+	return l, err
+}
+
+// RevokeShareLink revokes a link to ownerId's things, or one ownerId made.
+func (p *Persist) RevokeShareLink(ownerId int, id string) error {
+	res := p.db.Model(&ShareLink{}).
+		Where("id = ? AND (owner_id = ? OR created_by = ?) AND revoked_at IS NULL", id, ownerId, ownerId).
+		Update("revoked_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// CountShareDownload uses up one download of a link. It returns ErrNotFound if
+// the link has no downloads left.
+func (p *Persist) CountShareDownload(id string) error {
+	res := p.db.Model(&ShareLink{}).
+		Where("id = ? AND (max_downloads = 0 OR downloads < max_downloads)", id).
+		Update("downloads", gorm.Expr("downloads + 1"))
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// IsFolderWithin reports whether folderId is rootId or one of its descendants.
+func (p *Persist) IsFolderWithin(ownerId int, folderId, rootId string) (bool, error) {
+	for cur := folderId; cur != ""; {
+		if cur == rootId {
+			return true, nil
+		}
+		f, err := p.GetOwnedFolder(ownerId, cur)
+		if err != nil {
+			return false, err
+		}
+		cur = f.Parent
+	}
+	return false, nil
+}
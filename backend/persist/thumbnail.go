@@ -0,0 +1,106 @@
+package persist
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Thumbnail is a rendered preview of a blob, at most Size pixels along
+// either side. Being keyed by content, it is shared by every file with that
+// content and never goes stale.
+type Thumbnail struct {
+	Hash        string `gorm:"primaryKey"`
+	Size        int    `gorm:"primaryKey;autoIncrement:false"`
+	ContentType string `gorm:"not null"`
+	Data        []byte `gorm:"not null"`
+	CreatedAt   time.Time
+}
+
+// ThumbnailJob is a blob waiting for its thumbnails. Jobs are deleted once
+// the thumbnails are stored; ones that can't ever succeed are kept as Failed
+// so they aren't queued again.
+type ThumbnailJob struct {
+	Hash          string    `gorm:"primaryKey"`
+	Extension     string    `gorm:"not null"`
+	Attempts      int       `gorm:"not null;default:0"`
+	NextAttemptAt time.Time `gorm:"index"`
+	Failed        bool      `gorm:"not null;default:false"`
+	LastError     string
+	CreatedAt     time.Time
+}
+
+// QueueThumbnail queues the blob hash for thumbnails, unless it is queued
+// already.
+func (p *Persist) QueueThumbnail(hash, ext string) error {
+	return p.db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&ThumbnailJob{Hash: hash, Extension: ext, NextAttemptAt: time.Now()}).Error
+}
+
+// ClaimThumbnailJobs returns up to limit jobs that are due, pushing their
+// next attempt back by lease so nothing else picks them up meanwhile.
+func (p *Persist) ClaimThumbnailJobs(limit int, lease time.Duration) ([]ThumbnailJob, error) {
+	var jobs []ThumbnailJob
+	err := p.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("NOT failed AND next_attempt_at <= ?", now).
+			Order("next_attempt_at").Limit(limit).
+			Find(&jobs).Error
+		if err != nil || len(jobs) == 0 {
+			return err
+		}
+		hashes := make([]string, len(jobs))
+		for i, j := range jobs {
+			hashes[i] = j.Hash
+		}
+		return tx.Model(&ThumbnailJob{}).Where("hash IN ?", hashes).
+			Updates(map[string]any{"next_attempt_at": now.Add(lease), "attempts": gorm.Expr("attempts + 1")}).Error
+	})
+	return jobs, err
+}
+
+// FinishThumbnailJob stores the thumbnails of the blob hash and drops its
+// job.
+func (p *Persist) FinishThumbnailJob(hash string, thumbs []Thumbnail) error {
+	return p.db.Transaction(func(tx *gorm.DB) error {
+		if len(thumbs) > 0 {
+			err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&thumbs).Error
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Where("hash = ?", hash).Delete(&ThumbnailJob{}).Error
+	})
+}
+
+// RetryThumbnailJob records a failed attempt, to be tried again at retryAt.
+func (p *Persist) RetryThumbnailJob(hash, reason string, retryAt time.Time) error {
+	return p.db.Model(&ThumbnailJob{}).Where("hash = ?", hash).
+		Updates(map[string]any{"next_attempt_at": retryAt, "last_error": reason}).Error
+}
+
+// FailThumbnailJob gives up on the thumbnails of the blob hash.
+func (p *Persist) FailThumbnailJob(hash, reason string) error {
+	return p.db.Model(&ThumbnailJob{}).Where("hash = ?", hash).
+		Updates(map[string]any{"failed": true, "last_error": reason}).Error
+}
+
+func (p *Persist) GetThumbnailJob(hash string) (ThumbnailJob, error) {
+	var j ThumbnailJob
+	err := p.db.Where("hash = ?", hash).First(&j).Error
+	return j, err
+}
+
+func (p *Persist) GetThumbnail(hash string, size int) (Thumbnail, error) {
+	var t Thumbnail
+	err := p.db.Where("hash = ? AND size = ?", hash, size).First(&t).Error
+	return t, err
+}
+
+func (p *Persist) HasThumbnails(hash string) (bool, error) {
+	var n int64
+	err := p.db.Model(&Thumbnail{}).Where("hash = ?", hash).Count(&n).Error
+	return n > 0, err
+}
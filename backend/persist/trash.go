@@ -0,0 +1,240 @@
+package persist
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	TrashKindFile   = "file"
+	TrashKindFolder = "folder"
+)
+
+// TrashItem is something a user deleted. Trashing a folder also trashes
+// everything below it, but only the folder itself shows up as an item.
+type TrashItem struct {
+	Kind       string    `json:"kind"`
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Parent     string    `json:"parent"`
+	OwnerId    int       `json:"owner_id"`
+	FileSize   int       `json:"file_size,omitempty"`
+	DeleteTime time.Time `json:"delete_time"`
+}
+
+// TrashFile moves a single file into the trash.
+func (p *Persist) TrashFile(ownerId int, id string) error {
+	return p.transact(func(tx *gorm.DB) error {
+		var f File
+		if err := tx.Where("id = ? AND owner_id = ?", id, ownerId).First(&f).Error; err != nil {
+			return err
+		}
+		err := tx.Model(&File{}).
+			Where("id = ?", id).
+			Updates(map[string]any{"delete_time": time.Now(), "trash_root": id}).Error
+		if err != nil {
+			return err
+		}
+		return recordChange(tx, fileChange(&f, ChangeDelete))
+	})
+}
+
+// TrashFolder moves a folder and everything below it into the trash in one
+// transaction.
+func (p *Persist) TrashFolder(ownerId int, id string) error {
+	return p.transact(func(tx *gorm.DB) error {
+		var root Folder
+		if err := tx.Where("folder_id = ? AND owner_id = ?", id, ownerId).First(&root).Error; err != nil {
+			return err
+		}
+
+		ids, err := descendantFolderIds(tx, ownerId, id)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		fields := map[string]any{"delete_time": now, "trash_root": id}
+		if err := tx.Model(&Folder{}).Where("folder_id IN ?", ids).Updates(fields).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&File{}).Where("owner_id = ? AND parent IN ?", ownerId, ids).Updates(fields).Error; err != nil {
+			return err
+		}
+		return recordChange(tx, folderChange(&root, ChangeDelete))
+	})
+}
+
+// descendantFolderIds returns id and the ids of every folder below it. Only
+// live folders are followed unless tx is unscoped.
+func descendantFolderIds(tx *gorm.DB, ownerId int, id string) ([]string, error) {
+	ids := []string{id}
+	frontier := []string{id}
+	for len(frontier) > 0 {
+		var next []string
+		err := tx.Model(&Folder{}).
+			Where("owner_id = ? AND parent IN ?", ownerId, frontier).
+			Pluck("folder_id", &next).Error
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, next...)
+		frontier = next
+	}
+	return ids, nil
+}
+
+// ListTrash returns the items ownerId has deleted, newest first.
+func (p *Persist) ListTrash(ownerId int) ([]TrashItem, error) {
+	return p.listTrash("owner_id = ?", ownerId)
+}
+
+// ListTrashBefore returns the items of every user deleted before t.
+func (p *Persist) ListTrashBefore(t time.Time) ([]TrashItem, error) {
+	return p.listTrash("delete_time < ?", t)
+}
+
+func (p *Persist) listTrash(query string, args ...any) ([]TrashItem, error) {
+	var files []File
+	err := p.db.Unscoped().Where(query, args...).Where("trash_root = id").Order("delete_time desc").Find(&files).Error
+	if err != nil {
+		return nil, err
+	}
+	var folders []Folder
+	err = p.db.Unscoped().Where(query, args...).Where("trash_root = folder_id").Order("delete_time desc").Find(&folders).Error
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]TrashItem, 0, len(files)+len(folders))
+	for _, f := range folders {
+		items = append(items, TrashItem{
+			Kind:       TrashKindFolder,
+			ID:         f.FolderID,
+			Name:       f.Name,
+			Parent:     f.Parent,
+			OwnerId:    f.OwnerId,
+			DeleteTime: f.DeleteTime.Time,
+		})
+	}
+	for _, f := range files {
+		items = append(items, TrashItem{
+			Kind:       TrashKindFile,
+			ID:         f.ID,
+			Name:       f.Name,
+			Parent:     f.Parent,
+			OwnerId:    f.OwnerId,
+			FileSize:   f.FileSize,
+			DeleteTime: f.DeleteTime.Time,
+		})
+	}
+	return items, nil
+}
+
+// RestoreTrash brings a trashed item and everything deleted along with it
+// back. If its original parent is gone it is restored to the top level.
+func (p *Persist) RestoreTrash(ownerId int, id string) error {
+	return p.transact(func(tx *gorm.DB) error {
+		tx = tx.Unscoped().Session(&gorm.Session{})
+
+		var parent string
+		var file File
+		err := tx.Where("id = ? AND owner_id = ? AND trash_root = ?", id, ownerId, id).First(&file).Error
+		switch {
+		case err == nil:
+			parent = file.Parent
+		case errors.Is(err, ErrNotFound):
+			var folder Folder
+			err := tx.Where("folder_id = ? AND owner_id = ? AND trash_root = ?", id, ownerId, id).First(&folder).Error
+			if err != nil {
+				return err
+			}
+			parent = folder.Parent
+		default:
+			return err
+		}
+
+		if parent != "" {
+			var n int64
+			err := tx.Model(&Folder{}).Where("folder_id = ? AND delete_time IS NULL", parent).Count(&n).Error
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				err := tx.Model(&File{}).Where("id = ?", id).Update("parent", "").Error
+				if err != nil {
+					return err
+				}
+				err = tx.Model(&Folder{}).Where("folder_id = ?", id).Update("parent", "").Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		fields := map[string]any{"delete_time": nil, "trash_root": ""}
+		if err := tx.Model(&Folder{}).Where("owner_id = ? AND trash_root = ?", ownerId, id).Updates(fields).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&File{}).Where("owner_id = ? AND trash_root = ?", ownerId, id).Updates(fields).Error; err != nil {
+			return err
+		}
+
+		if file.ID != "" {
+			if err := tx.Where("id = ?", id).First(&file).Error; err != nil {
+				return err
+			}
+			return recordChange(tx, fileChange(&file, ChangeRestore))
+		}
+		var folder Folder
+		if err := tx.Where("folder_id = ?", id).First(&folder).Error; err != nil {
+			return err
+		}
+		return recordChange(tx, folderChange(&folder, ChangeRestore))
+	})
+}
+
+// PurgeTrash permanently deletes a trashed item and everything deleted along
+// with it, releasing the blobs of the removed files, which are returned.
+func (p *Persist) PurgeTrash(ownerId int, id string) ([]File, error) {
+	var files []File
+	err := p.db.Transaction(func(tx *gorm.DB) error {
+		tx = tx.Unscoped().Session(&gorm.Session{})
+
+		var n int64
+		err := tx.Model(&File{}).Where("owner_id = ? AND trash_root = ? AND id = ?", ownerId, id, id).Count(&n).Error
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			err := tx.Model(&Folder{}).Where("owner_id = ? AND trash_root = ? AND folder_id = ?", ownerId, id, id).Count(&n).Error
+			if err != nil {
+				return err
+			}
+		}
+		if n == 0 {
+			return ErrNotFound
+		}
+
+		if err := tx.Where("owner_id = ? AND trash_root = ?", ownerId, id).Find(&files).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("owner_id = ? AND trash_root = ?", ownerId, id).Delete(&File{}).Error; err != nil {
+			return err
+		}
+		folders := tx.Model(&Folder{}).Select("folder_id").Where("owner_id = ? AND trash_root = ?", ownerId, id)
+		if err := tx.Where("folder_id IN (?)", folders).Delete(&FolderGrant{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("owner_id = ? AND trash_root = ?", ownerId, id).Delete(&Folder{}).Error; err != nil {
+			return err
+		}
+		if err := deleteFileVersions(tx, files); err != nil {
+			return err
+		}
+		return releaseBlobs(tx, files)
+	})
+	return files, err
+}
@@ -0,0 +1,66 @@
+package persist
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Upload tracks a resumable upload that has not been completed yet. The bytes
+// received so far live in the file system until Offset reaches Length.
+type Upload struct {
+	ID      string `gorm:"primaryKey;type:uuid" json:"id"`
+	OwnerId int    `gorm:"not null;index" json:"owner_id"`
+	// FileOwnerId owns the file once it is complete. It is the owner of
+	// Parent, which isn't the uploader when the folder is shared with them.
+	FileOwnerId int       `json:"file_owner_id,omitempty"`
+	Name        string    `gorm:"not null" json:"name"`
+	Parent      string    `json:"parent"`
+	Length      int64     `gorm:"not null" json:"length"`
+	Offset      int64     `gorm:"column:upload_offset;not null" json:"offset"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// FileOwner returns who will own the file, uploads made before FileOwnerId
+// was kept are the uploader's.
+func (u *Upload) FileOwner() int {
+	if u.FileOwnerId == 0 {
+		return u.OwnerId
+	}
+	return u.FileOwnerId
+}
+
+func (p *Persist) CreateUpload(u *Upload) (string, error) {
+	if u.ID == "" {
+		u.ID = uuid.NewString()
+	}
+	return u.ID, p.db.Create(u).Error
+}
+
+// GetOwnedUpload retrieves an upload by its ID if it belongs to ownerId.
+func (p *Persist) GetOwnedUpload(ownerId int, id string) (*Upload, error) {
+	var u Upload
+	err := p.db.Where("id = ? AND owner_id = ?", id, ownerId).First(&u).Error
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// ListUploadsBefore returns the uploads with no activity since t.
+func (p *Persist) ListUploadsBefore(t time.Time) ([]Upload, error) {
+	var u []Upload
+	err := p.db.Where("updated_at < ?", t).Find(&u).Error
+	return u, err
+}
+
+// UpdateUploadOffset saves how much of an upload has arrived, which also
+// marks it active.
+func (p *Persist) UpdateUploadOffset(id string, offset int64) error {
+	return p.db.Model(&Upload{}).Where("id = ?", id).Update("upload_offset", offset).Error
+}
+
+func (p *Persist) DeleteUpload(id string) error {
+	return p.db.Where("id = ?", id).Delete(&Upload{}).Error
+}
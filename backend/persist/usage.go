@@ -0,0 +1,62 @@
+package persist
+
+// UsageBucket is the space taken up by a group of files.
+type UsageBucket struct {
+	Key   string `json:"key"`
+	Name  string `json:"name,omitempty"`
+	Bytes int64  `json:"bytes"`
+	Files int64  `json:"files"`
+}
+
+// RefreshUsage recomputes the total size of ownerId's files, including ones in
+// the trash and their earlier versions, and caches it on the user row.
+func (p *Persist) RefreshUsage(ownerId int) (int64, error) {
+	var used int64
+	err := p.db.Unscoped().Model(&File{}).
+		Where("owner_id = ?", ownerId).
+		Select("COALESCE(SUM(file_size), 0)").
+		Scan(&used).Error
+	if err != nil {
+		return 0, err
+	}
+
+	var versions int64
+	err = p.db.Model(&FileVersion{}).
+		Joins("JOIN files ON files.id = file_versions.file_id").
+		Where("files.owner_id = ?", ownerId).
+		Select("COALESCE(SUM(file_versions.file_size), 0)").
+		Scan(&versions).Error
+	if err != nil {
+		return 0, err
+	}
+	used += versions
+
+	err = p.db.Model(&User{}).Where("id = ?", ownerId).Update("used_bytes", used).Error
+	return used, err
+}
+
+// UsageByFolder breaks ownerId's usage down by the folder files sit directly
+// in. Files at the top level have an empty key.
+func (p *Persist) UsageByFolder(ownerId int) ([]UsageBucket, error) {
+	var b []UsageBucket
+	err := p.db.Unscoped().Table("files").
+		Select("files.parent AS key, COALESCE(folders.name, '') AS name, SUM(files.file_size) AS bytes, COUNT(*) AS files").
+		Joins("LEFT JOIN folders ON folders.folder_id = files.parent").
+		Where("files.owner_id = ?", ownerId).
+		Group("files.parent, folders.name").
+		Order("bytes desc").
+		Scan(&b).Error
+	return b, err
+}
+
+// UsageByExtension breaks ownerId's usage down by file extension.
+func (p *Persist) UsageByExtension(ownerId int) ([]UsageBucket, error) {
+	var b []UsageBucket
+	err := p.db.Unscoped().Model(&File{}).
+		Select("extension AS key, SUM(file_size) AS bytes, COUNT(*) AS files").
+		Where("owner_id = ?", ownerId).
+		Group("extension").
+		Order("bytes desc").
+		Scan(&b).Error
+	return b, err
+}
@@ -9,13 +9,29 @@ import (
 	"avenue/backend/shared"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	UserRoleAdmin    = "admin"
+	UserRoleUser     = "user"
+	UserRoleReadOnly = "read-only"
 )
 
 type User struct {
-	ID        uint           `gorm:"primarykey" json:"id"`
-	Email     string         `gorm:"not null;uniqueIndex" json:"email"`
-	Password  string         `gorm:"not null" json:"-"`
-	CanLogin  bool           `gorm:"not null" json:"canLogin"`
+	ID       uint   `gorm:"primarykey" json:"id"`
+	Email    string `gorm:"not null;uniqueIndex" json:"email"`
+	Password string `gorm:"not null" json:"-"`
+	CanLogin bool   `gorm:"not null" json:"canLogin"`
+	Role     string `gorm:"not null;default:user" json:"role"`
+	// QuotaBytes overrides the default quota when set, 0 means unlimited.
+	QuotaBytes *int64 `json:"quotaBytes"`
+	// KeepVersions and KeepVersionDays limit how many old versions of each
+	// file are kept and for how long, 0 means no limit.
+	KeepVersions    int `gorm:"not null;default:0" json:"keepVersions"`
+	KeepVersionDays int `gorm:"not null;default:0" json:"keepVersionDays"`
+	// UsedBytes caches the total size of the user's files, see RefreshUsage.
+	UsedBytes int64          `gorm:"not null;default:0" json:"usedBytes"`
 	CreatedAt time.Time      `json:"createdAt"`
 	UpdatedAt time.Time      `json:"updatedAt"`
 	DeletedAt gorm.DeletedAt `gorm:"index" json:"deletedAt"`
@@ -49,19 +65,49 @@ func (p *Persist) UpdateUser(user User) (User, error) {
 	return user, res.Error
 }
 
+// UpdatePassword hashes password and stores it for the user with id.
+func (p *Persist) UpdatePassword(id uint, password string) error {
+	hash, err := shared.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return p.db.Model(&User{}).Where("id = ?", id).Update("password", hash).Error
+}
+
+// RootUserID is the id of the admin created on start up. Only it can lock
+// out, take over or delete other admins.
+const RootUserID = 1
+
 func (p *Persist) UpsertRootUser() error {
+	hash, err := shared.HashPassword(shared.GetEnv("ROOT_USER_PASSWORD", "password"))
+	if err != nil {
+		return err
+	}
+
 	user := User{
-		ID:        1,
+		ID:        RootUserID,
 		Email:     shared.GetEnv("ROOT_USER_EMAIL", "root@gmail.com"),
-		Password:  shared.GetEnv("ROOT_USER_PASSWORD", "password"),
+		Password:  hash,
 		CanLogin:  true,
+		Role:      UserRoleAdmin,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 		DeletedAt: gorm.DeletedAt{},
 	}
 
-	res := p.db.Save(&user)
-	return res.Error
+	// only the login is reset, root keeps its quota, usage and versioning
+	return p.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"email", "password", "can_login", "role", "updated_at", "deleted_at"}),
+	}).Create(&user).Error
+}
+
+// ListUserIds returns the ids of every user, deleted or not.
+func (p *Persist) ListUserIds() ([]int, error) {
+	var ids []int
+	err := p.db.Unscoped().Model(&User{}).Order("id").Pluck("id", &ids).Error
+	return ids, err
 }
 
 func (p *Persist) GetUserByEmail(email string) (User, error) {
@@ -76,10 +122,16 @@ func (p *Persist) GetUserByEmail(email string) (User, error) {
 }
 
 func (p *Persist) CreateUser(email, password string) (User, error) {
+	hash, err := shared.HashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+
 	u := User{
 		Email:     email,
-		Password:  password,
+		Password:  hash,
 		CanLogin:  true,
+		Role:      UserRoleUser,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
@@ -103,3 +155,21 @@ func (p *Persist) IsUniqueEmail(email string) bool {
 
 	return false
 }
+
+// UpdateVersioning sets the version retention policy of a user. A nil value
+// leaves that setting unchanged.
+func (p *Persist) UpdateVersioning(id int, keepVersions, keepVersionDays *int) (User, error) {
+	fields := map[string]any{}
+	if keepVersions != nil {
+		fields["keep_versions"] = *keepVersions
+	}
+	if keepVersionDays != nil {
+		fields["keep_version_days"] = *keepVersionDays
+	}
+	if len(fields) > 0 {
+		if err := p.db.Model(&User{}).Where("id = ?", id).Updates(fields).Error; err != nil {
+			return User{}, err
+		}
+	}
+	return p.GetUserById(id)
+}
@@ -0,0 +1,191 @@
+package persist
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// FileVersion is earlier content of a file. Each one holds a reference to its
+// blob until it is pruned.
+type FileVersion struct {
+	ID         string    `gorm:"primaryKey;type:uuid" json:"id"`
+	FileID     string    `gorm:"not null;index" json:"file_id"`
+	Version    int       `gorm:"not null" json:"version"`
+	Sha256     string    `gorm:"column:sha256;not null" json:"sha256"`
+	FileSize   int       `gorm:"column:file_size" json:"file_size"`
+	UploaderId int       `json:"uploader_id"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// pushVersion records the current content of f as a version. The blob
+// reference held by the file moves over to the version.
+func pushVersion(tx *gorm.DB, f *File) error {
+	uploader := f.UploaderId
+	if uploader == 0 {
+		uploader = f.OwnerId
+	}
+	created := f.UpdatedAt
+	if created.IsZero() {
+		created = f.CreatedAt
+	}
+	return tx.Create(&FileVersion{
+		ID:         uuid.NewString(),
+		FileID:     f.ID,
+		Version:    f.Version,
+		Sha256:     f.Sha256,
+		FileSize:   f.FileSize,
+		UploaderId: uploader,
+		CreatedAt:  created,
+	}).Error
+}
+
+// setContent points f at new content, as the next version.
+func setContent(tx *gorm.DB, f *File, hash string, size int, uploaderId int) error {
+	f.Sha256 = hash
+	f.FileSize = size
+	f.Version++
+	f.UploaderId = uploaderId
+	err := tx.Model(&File{}).Where("id = ?", f.ID).Updates(map[string]any{
+		"sha256":      f.Sha256,
+		"file_size":   f.FileSize,
+		"version":     f.Version,
+		"uploader_id": f.UploaderId,
+		"updated_at":  time.Now(),
+	}).Error
+	if err != nil {
+		return err
+	}
+	return recordChange(tx, fileChange(f, ChangeUpdate))
+}
+
+// AddFileVersion replaces the content of a file belonging to ownerId with the
+// blob hash, keeping the previous content as a version.
+func (p *Persist) AddFileVersion(ownerId int, fileId string, uploaderId int, hash string, size int64) (*File, error) {
+	var f File
+	err := p.transact(func(tx *gorm.DB) error {
+		if err := tx.Where("id = ? AND owner_id = ?", fileId, ownerId).First(&f).Error; err != nil {
+			return err
+		}
+		if err := pushVersion(tx, &f); err != nil {
+			return err
+		}
+		if err := setContent(tx, &f, hash, int(size), uploaderId); err != nil {
+			return err
+		}
+		return refBlob(tx, hash, size, 1)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// ListFileVersions returns the earlier versions of a file, newest first.
+func (p *Persist) ListFileVersions(fileId string) ([]FileVersion, error) {
+	var v []FileVersion
+	err := p.db.Where("file_id = ?", fileId).Order("version desc").Find(&v).Error
+	return v, err
+}
+
+func (p *Persist) GetFileVersion(fileId, versionId string) (*FileVersion, error) {
+	var v FileVersion
+	err := p.db.Where("id = ? AND file_id = ?", versionId, fileId).First(&v).Error
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// RestoreFileVersion makes the content of an earlier version current again.
+// The content it replaces is kept as a version, and so is the restored one.
+func (p *Persist) RestoreFileVersion(ownerId int, fileId, versionId string, uploaderId int) (*File, error) {
+	var f File
+	err := p.transact(func(tx *gorm.DB) error {
+		if err := tx.Where("id = ? AND owner_id = ?", fileId, ownerId).First(&f).Error; err != nil {
+			return err
+		}
+		var v FileVersion
+		if err := tx.Where("id = ? AND file_id = ?", versionId, fileId).First(&v).Error; err != nil {
+			return err
+		}
+		if err := pushVersion(tx, &f); err != nil {
+			return err
+		}
+		if err := setContent(tx, &f, v.Sha256, v.FileSize, uploaderId); err != nil {
+			return err
+		}
+		return refBlob(tx, v.Sha256, int64(v.FileSize), 1)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// PruneFileVersions deletes versions of a file beyond the keep newest ones and
+// versions created before olderThan. A zero keep or olderThan disables that
+// limit.
+func (p *Persist) PruneFileVersions(fileId string, keep int, olderThan time.Time) (int, error) {
+	var pruned []FileVersion
+	err := p.db.Transaction(func(tx *gorm.DB) error {
+		var versions []FileVersion
+		if err := tx.Where("file_id = ?", fileId).Order("version desc").Find(&versions).Error; err != nil {
+			return err
+		}
+		for i, v := range versions {
+			if (keep > 0 && i >= keep) || (!olderThan.IsZero() && v.CreatedAt.Before(olderThan)) {
+				pruned = append(pruned, v)
+			}
+		}
+		return deleteVersions(tx, pruned)
+	})
+	return len(pruned), err
+}
+
+// ListPrunableFiles returns the files, trashed or not, of every user that
+// have versions their owner's retention policy no longer keeps.
+func (p *Persist) ListPrunableFiles() ([]File, error) {
+	var files []File
+	err := p.db.Unscoped().Model(&File{}).
+		Joins("JOIN users ON users.id = files.owner_id").
+		Where(`(users.keep_version_days > 0 AND EXISTS (
+			SELECT 1 FROM file_versions
+			WHERE file_versions.file_id = files.id
+			AND file_versions.created_at < now() - make_interval(days => users.keep_version_days)))
+		OR (users.keep_versions > 0 AND (
+			SELECT count(*) FROM file_versions
+			WHERE file_versions.file_id = files.id) > users.keep_versions)`).
+		Find(&files).Error
+	return files, err
+}
+
+// deleteFileVersions deletes every version of files along with their blob
+// references, for when the files themselves are deleted.
+func deleteFileVersions(tx *gorm.DB, files []File) error {
+	if len(files) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(files))
+	for _, f := range files {
+		ids = append(ids, f.ID)
+	}
+	var versions []FileVersion
+	if err := tx.Where("file_id IN ?", ids).Find(&versions).Error; err != nil {
+		return err
+	}
+	return deleteVersions(tx, versions)
+}
+
+func deleteVersions(tx *gorm.DB, versions []FileVersion) error {
+	for _, v := range versions {
+		if err := tx.Where("id = ?", v.ID).Delete(&FileVersion{}).Error; err != nil {
+			return err
+		}
+		if err := releaseBlobs(tx, []File{{Sha256: v.Sha256}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package persist
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	// DeliveryFailed is a delivery given up on after too many attempts.
+	DeliveryFailed = "failed"
+)
+
+// Webhook is an endpoint events are POSTed to. Global webhooks, made by
+// admins, hear about everyone's files and about users too.
+type Webhook struct {
+	ID      string `gorm:"primaryKey;type:uuid" json:"id"`
+	OwnerId int    `gorm:"not null;index" json:"owner_id"`
+	URL     string `gorm:"not null" json:"url"`
+	// Secret signs the deliveries. It is needed to sign, so it is stored as
+	// is.
+	Secret string `gorm:"not null" json:"-"`
+	// Events are the events sent, like "file.create" or "folder.*". None
+	// sends every event.
+	Events []string `gorm:"type:text;serializer:json" json:"events"`
+	// FolderID limits file and folder events to those in the folder and
+	// below it.
+	FolderID  string    `json:"folder_id,omitempty"`
+	Global    bool      `gorm:"not null;default:false" json:"global"`
+	Disabled  bool      `gorm:"not null;default:false" json:"disabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is an event for a webhook. It is queued until delivered or
+// given up on, and kept after as the delivery log.
+type WebhookDelivery struct {
+	ID        string `gorm:"primaryKey;type:uuid" json:"id"`
+	WebhookID string `gorm:"not null;index" json:"webhook_id"`
+	Event     string `gorm:"not null" json:"event"`
+	// Payload is the JSON body sent.
+	Payload       string     `gorm:"not null" json:"payload"`
+	Status        string     `gorm:"not null;index" json:"status"`
+	Attempts      int        `gorm:"not null;default:0" json:"attempts"`
+	NextAttemptAt time.Time  `gorm:"index" json:"next_attempt_at"`
+	ResponseCode  int        `json:"response_code,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	CreatedAt     time.Time  `gorm:"index" json:"created_at"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+}
+
+// WebhookCursor is the last change queued for webhooks. There is one row.
+type WebhookCursor struct {
+	ID         int `gorm:"primaryKey;autoIncrement:false"`
+	LastChange int64
+}
+
+func (p *Persist) CreateWebhook(w *Webhook) error {
+	if w.ID == "" {
+		w.ID = uuid.NewString()
+	}
+	return p.db.Create(w).Error
+}
+
+func (p *Persist) GetWebhook(id string) (*Webhook, error) {
+	var w Webhook
+	err := p.db.Where("id = ?", id).First(&w).Error
+	if err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+func (p *Persist) GetOwnedWebhook(ownerId int, id string) (*Webhook, error) {
+	var w Webhook
+	err := p.db.Where("id = ? AND owner_id = ?", id, ownerId).First(&w).Error
+	if err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+func (p *Persist) ListWebhooks(ownerId int) ([]Webhook, error) {
+	var w []Webhook
+	err := p.db.Where("owner_id = ?", ownerId).Order("created_at").Find(&w).Error
+	return w, err
+}
+
+// SaveWebhook stores every field of w.
+func (p *Persist) SaveWebhook(w *Webhook) error {
+	return p.db.Select("*").Updates(w).Error
+}
+
+// DeleteWebhook deletes a webhook of ownerId, with its deliveries.
+func (p *Persist) DeleteWebhook(ownerId int, id string) error {
+	return p.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("id = ? AND owner_id = ?", id, ownerId).Delete(&Webhook{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		return tx.Where("webhook_id = ?", id).Delete(&WebhookDelivery{}).Error
+	})
+}
+
+// ListActiveWebhooks returns the webhooks that are not disabled, of owners
+// who can log in and aren't deleted. Global ones only count while their
+// owner is an admin.
+func (p *Persist) ListActiveWebhooks() ([]Webhook, error) {
+	var w []Webhook
+	err := p.db.
+		Joins("JOIN users ON users.id = webhooks.owner_id").
+		Where("NOT webhooks.disabled AND users.can_login AND users.deleted_at IS NULL").
+		Where("NOT webhooks.global OR users.role = ?", UserRoleAdmin).
+		Find(&w).Error
+	return w, err
+}
+
+// QueueWebhookDeliveries queues d to be sent as soon as possible.
+func (p *Persist) QueueWebhookDeliveries(d []WebhookDelivery) error {
+	if len(d) == 0 {
+		return nil
+	}
+	return p.db.Create(&d).Error
+}
+
+// QueueWebhookChanges turns up to limit changes after the webhook cursor into
+// the deliveries build returns, and moves the cursor past them. The first
+// call starts from the newest change, history isn't sent. Only one process
+// at a time gets the same changes.
+func (p *Persist) QueueWebhookChanges(limit int, build func([]Change) ([]WebhookDelivery, error)) (int, error) {
+	var n int
+	err := p.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec("INSERT INTO webhook_cursors (id, last_change) SELECT 1, COALESCE(MAX(id), 0) FROM changes ON CONFLICT DO NOTHING").Error
+		if err != nil {
+			return err
+		}
+		var cur WebhookCursor
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&cur, 1).Error; err != nil {
+			return err
+		}
+		var changes []Change
+		if err := tx.Where("id > ?", cur.LastChange).Order("id").Limit(limit).Find(&changes).Error; err != nil {
+			return err
+		}
+		if len(changes) == 0 {
+			return nil
+		}
+		d, err := build(changes)
+		if err != nil {
+			return err
+		}
+		if len(d) > 0 {
+			if err := tx.Create(&d).Error; err != nil {
+				return err
+			}
+		}
+		n = len(changes)
+		return tx.Model(&cur).Update("last_change", changes[len(changes)-1].ID).Error
+	})
+	return n, err
+}
+
+// ClaimWebhookDeliveries returns up to limit pending deliveries that are
+// due, counting the attempt and pushing the next one back by lease so
+// nothing else picks them up meanwhile.
+func (p *Persist) ClaimWebhookDeliveries(limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	var d []WebhookDelivery
+	err := p.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", DeliveryPending, now).
+			Order("next_attempt_at").Limit(limit).
+			Find(&d).Error
+		if err != nil || len(d) == 0 {
+			return err
+		}
+		ids := make([]string, len(d))
+		for i := range d {
+			d[i].Attempts++
+			d[i].NextAttemptAt = now.Add(lease)
+			ids[i] = d[i].ID
+		}
+		return tx.Model(&WebhookDelivery{}).Where("id IN ?", ids).
+			Updates(map[string]any{"next_attempt_at": now.Add(lease), "attempts": gorm.Expr("attempts + 1")}).Error
+	})
+	return d, err
+}
+
+// FinishWebhookDelivery records the outcome of an attempt at d.
+func (p *Persist) FinishWebhookDelivery(d *WebhookDelivery) error {
+	return p.db.Model(d).Select("status", "next_attempt_at", "response_code", "last_error", "delivered_at").Updates(d).Error
+}
+
+// ListWebhookDeliveries returns the latest deliveries for a webhook, newest
+// first.
+func (p *Persist) ListWebhookDeliveries(webhookId string, limit int) ([]WebhookDelivery, error) {
+	var d []WebhookDelivery
+	err := p.db.Where("webhook_id = ?", webhookId).Order("created_at desc").Limit(limit).Find(&d).Error
+	return d, err
+}
+
+// PruneWebhookDeliveries deletes delivered and failed deliveries created
+// before t.
+func (p *Persist) PruneWebhookDeliveries(t time.Time) (int64, error) {
+	res := p.db.Where("status <> ? AND created_at < ?", DeliveryPending, t).Delete(&WebhookDelivery{})
+	return res.RowsAffected, res.Error
+}
@@ -0,0 +1,109 @@
+package shared
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// argon2id parameters for newly hashed passwords. Bumping any of these makes
+// VerifyPassword report existing hashes as needing a rehash.
+const (
+	argonTime    uint32 = 3
+	argonMemory  uint32 = 64 * 1024
+	argonThreads uint8  = 2
+	argonKeyLen  uint32 = 32
+	argonSaltLen        = 16
+)
+
+const argonPrefix = "$argon2id$"
+
+var ErrInvalidHash = errors.New("invalid password hash")
+
+// HashPassword hashes password with argon2id using the PHC string format:
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argonPrefix,
+		argon2.Version,
+		argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// IsHashedPassword reports whether stored looks like a hash produced by
+// HashPassword rather than a legacy plaintext password.
+func IsHashedPassword(stored string) bool {
+	return strings.HasPrefix(stored, argonPrefix)
+}
+
+// VerifyPassword compares password against stored in constant time. stored may
+// be an argon2id hash or a legacy plaintext password, which is what a value
+// that only starts like a hash is taken to be. needsRehash is true when the
+// password matched but stored should be replaced by a fresh HashPassword.
+func VerifyPassword(stored, password string) (ok bool, needsRehash bool, err error) {
+	if IsHashedPassword(stored) {
+		ok, needsRehash, err = verifyArgon2id(stored, password)
+		if !errors.Is(err, ErrInvalidHash) {
+			return ok, needsRehash, err
+		}
+	}
+	ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	return ok, ok, nil
+}
+
+// verifyArgon2id compares password against a hash made by HashPassword,
+// failing with ErrInvalidHash if stored isn't one.
+func verifyArgon2id(stored, password string) (ok bool, needsRehash bool, err error) {
+	parts := strings.Split(stored, "$")
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, hash
+	if len(parts) != 6 {
+		return false, false, ErrInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, false, ErrInvalidHash
+	}
+	if version != argon2.Version {
+		return false, false, ErrInvalidHash
+	}
+
+	var memory, time uint32
+	var threads uint8
+	// argon2 panics without a pass or a thread
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil || time == 0 || threads == 0 {
+		return false, false, ErrInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false, ErrInvalidHash
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	// an empty hash would match every password
+	if err != nil || len(want) == 0 {
+		return false, false, ErrInvalidHash
+	}
+
+	got := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(want)))
+	if subtle.ConstantTimeCompare(got, want) != 1 {
+		return false, false, nil
+	}
+
+	needsRehash = memory != argonMemory || time != argonTime || threads != argonThreads || uint32(len(want)) != argonKeyLen
+	return true, needsRehash, nil
+}
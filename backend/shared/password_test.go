@@ -0,0 +1,115 @@
+package shared
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+func TestHashPasswordRoundTrip(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+	parts := strings.Split(hash, "$")
+	want := fmt.Sprintf("v=%d m=%d,t=%d,p=%d", argon2.Version, argonMemory, argonTime, argonThreads)
+	if len(parts) != 6 || parts[1] != "argon2id" || parts[2]+" "+parts[3] != want {
+		t.Fatalf("HashPassword = %q, not a PHC string with %s", hash, want)
+	}
+	if !IsHashedPassword(hash) {
+		t.Errorf("IsHashedPassword(%q) = false", hash)
+	}
+
+	ok, needsRehash, err := VerifyPassword(hash, "correct horse")
+	if err != nil || !ok || needsRehash {
+		t.Errorf("VerifyPassword with the password = %v, %v, %v", ok, needsRehash, err)
+	}
+	ok, needsRehash, err = VerifyPassword(hash, "correct horse ")
+	if err != nil || ok || needsRehash {
+		t.Errorf("VerifyPassword with another password = %v, %v, %v", ok, needsRehash, err)
+	}
+
+	// salted, so the same password hashes differently each time
+	again, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == hash {
+		t.Error("hashing the same password twice gave the same hash")
+	}
+}
+
+// oldHash hashes password the way HashPassword would with other parameters.
+func oldHash(password string, memory, time uint32, threads uint8, keyLen uint32) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, time, memory, threads, keyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, memory, time, threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+}
+
+func TestVerifyPasswordNeedsRehash(t *testing.T) {
+	for name, stored := range map[string]string{
+		"memory":  oldHash("hunter2", 8*1024, argonTime, argonThreads, argonKeyLen),
+		"time":    oldHash("hunter2", argonMemory, 1, argonThreads, argonKeyLen),
+		"threads": oldHash("hunter2", argonMemory, argonTime, 1, argonKeyLen),
+		"key":     oldHash("hunter2", argonMemory, argonTime, argonThreads, 16),
+	} {
+		ok, needsRehash, err := VerifyPassword(stored, "hunter2")
+		if err != nil || !ok || !needsRehash {
+			t.Errorf("other %s: VerifyPassword = %v, %v, %v, want a match needing a rehash", name, ok, needsRehash, err)
+		}
+		// only a match is worth rehashing
+		ok, needsRehash, err = VerifyPassword(stored, "hunter3")
+		if err != nil || ok || needsRehash {
+			t.Errorf("other %s: VerifyPassword with another password = %v, %v, %v", name, ok, needsRehash, err)
+		}
+	}
+
+	current := oldHash("hunter2", argonMemory, argonTime, argonThreads, argonKeyLen)
+	if ok, needsRehash, err := VerifyPassword(current, "hunter2"); err != nil || !ok || needsRehash {
+		t.Errorf("current parameters: VerifyPassword = %v, %v, %v", ok, needsRehash, err)
+	}
+}
+
+func TestVerifyPasswordPlaintext(t *testing.T) {
+	valid := oldHash("x", argonMemory, argonTime, argonThreads, argonKeyLen)
+	for _, stored := range []string{
+		"hunter2",
+		"",
+		// plaintext passwords that only look like a hash
+		"$argon2id$",
+		"$argon2id$hunter2",
+		"$argon2id$v=19$m=65536,t=3,p=2$not base64!$AAAA",
+		"$argon2id$v=19$m=65536,t=0,p=2$c2FsdA$AAAA",
+		"$argon2id$v=19$m=65536,t=3,p=0$c2FsdA$AAAA",
+		// an empty hash must not match everything
+		"$argon2id$v=19$m=65536,t=3,p=2$c2FsdA$",
+		strings.Replace(valid, "v=19", "v=16", 1),
+		strings.Replace(valid, "$argon2id$", "$argon2i$", 1),
+	} {
+		ok, needsRehash, err := VerifyPassword(stored, stored)
+		if err != nil || !ok || !needsRehash {
+			t.Errorf("VerifyPassword(%q) with itself = %v, %v, %v, want a match needing a rehash", stored, ok, needsRehash, err)
+		}
+		ok, needsRehash, err = VerifyPassword(stored, stored+"x")
+		if err != nil || ok || needsRehash {
+			t.Errorf("VerifyPassword(%q) with another password = %v, %v, %v", stored, ok, needsRehash, err)
+		}
+		if stored != "" {
+			if ok, _, _ := VerifyPassword(stored, ""); ok {
+				t.Errorf("VerifyPassword(%q) matched no password", stored)
+			}
+		}
+	}
+
+	// a real hash is never compared as plaintext
+	if ok, _, _ := VerifyPassword(valid, valid); ok {
+		t.Error("a hash matched itself as a password")
+	}
+}
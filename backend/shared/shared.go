@@ -5,12 +5,16 @@ import (
 	"errors"
 	"net/mail"
 	"os"
+	"strconv"
+	"time"
 )
 
 const (
 	SESSIONCOOKIENAME = "session_id"
 	USERCOOKIENAME    = "user_id"
 	USERCOOKIEVALUE   = "test"
+	USERROLENAME      = "user_role"
+	IMPERSONATORNAME  = "impersonator_id"
 )
 
 func GetEnv(key string, defaultVal string) string {
@@ -23,6 +27,28 @@ func GetEnv(key string, defaultVal string) string {
 	return envKey
 }
 
+// GetEnvDuration reads a time.Duration such as "12h" from the environment,
+// falling back to defaultVal when unset or unparsable.
+func GetEnvDuration(key string, defaultVal time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return defaultVal
+	}
+
+	return d
+}
+
+// GetEnvInt64 reads an integer from the environment, falling back to
+// defaultVal when unset or unparsable.
+func GetEnvInt64(key string, defaultVal int64) int64 {
+	i, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+	if err != nil {
+		return defaultVal
+	}
+
+	return i
+}
+
 func IsValidEmail(email string) bool {
 	_, err := mail.ParseAddress(email)
 	return err == nil
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path"
+
+	"github.com/google/uuid"
+	"github.com/spf13/afero"
+)
+
+const aferoStagingDir = "/.staging"
+
+// AferoStore is a BlobStore on top of an afero file system.
+type AferoStore struct {
+	fs afero.Fs
+}
+
+func NewAferoStore(fs afero.Fs) *AferoStore {
+	return &AferoStore{fs: fs}
+}
+
+// Stage copies r into a temp file, so a failed copy never leaves half a blob
+// behind under a real hash.
+func (a *AferoStore) Stage(r io.Reader) (StagedBlob, error) {
+	if err := a.fs.MkdirAll(aferoStagingDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	b := &aferoStaged{fs: a.fs, tmpPath: path.Join(aferoStagingDir, uuid.NewString())}
+	if err := b.write(r); err != nil {
+		_ = b.Discard()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (a *AferoStore) Open(hash string) (io.ReadSeekCloser, error) {
+	return a.fs.Open("/" + blobKey(hash))
+}
+
+func (a *AferoStore) Remove(hash string) error {
+	return a.remove("/" + blobKey(hash))
+}
+
+func (a *AferoStore) OpenLegacy(ownerId int, fileId string) (io.ReadSeekCloser, error) {
+	return a.fs.Open("/" + legacyKey(ownerId, fileId))
+}
+
+func (a *AferoStore) RemoveLegacy(ownerId int, fileId string) error {
+	return a.remove("/" + legacyKey(ownerId, fileId))
+}
+
+func (a *AferoStore) remove(name string) error {
+	err := a.fs.Remove(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+type aferoStaged struct {
+	fs      afero.Fs
+	tmpPath string
+	hash    string
+	size    int64
+}
+
+func (b *aferoStaged) write(r io.Reader) error {
+	dst, err := b.fs.Create(b.tmpPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	h := sha256.New()
+	b.size, err = io.Copy(io.MultiWriter(dst, h), r)
+	if err != nil {
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		return err
+	}
+	b.hash = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+func (b *aferoStaged) Hash() string { return b.hash }
+func (b *aferoStaged) Size() int64  { return b.size }
+
+func (b *aferoStaged) Commit() error {
+	key := "/" + blobKey(b.hash)
+	if exists, err := afero.Exists(b.fs, key); err != nil {
+		return err
+	} else if exists {
+		return b.Discard()
+	}
+
+	if err := b.fs.MkdirAll(path.Dir(key), os.ModePerm); err != nil {
+		return err
+	}
+	return b.fs.Rename(b.tmpPath, key)
+}
+
+func (b *aferoStaged) Discard() error {
+	err := b.fs.Remove(b.tmpPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
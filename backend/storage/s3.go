@@ -0,0 +1,279 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"avenue/backend/shared"
+)
+
+// S3Store is a BlobStore on an S3 compatible object store such as MinIO,
+// addressed path style as <endpoint>/<bucket>/<key>.
+type S3Store struct {
+	endpoint string
+	bucket   string
+	creds    Credentials
+	client   *http.Client
+}
+
+func NewS3Store(endpoint, bucket, accessKey, secretKey, region string) *S3Store {
+	return &S3Store{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		bucket:   bucket,
+		creds: Credentials{
+			AccessKey: accessKey,
+			SecretKey: secretKey,
+			Region:    region,
+			Service:   "s3",
+		},
+		client: newS3Client(),
+	}
+}
+
+// newS3Client gives up on an object store that doesn't answer, without
+// limiting how long a large body may take to stream.
+func newS3Client() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   10 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: time.Minute,
+			ExpectContinueTimeout: time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   16,
+		},
+	}
+}
+
+// NewS3StoreFromEnv configures an S3Store from S3_ENDPOINT, S3_BUCKET,
+// S3_ACCESS_KEY, S3_SECRET_KEY and S3_REGION.
+func NewS3StoreFromEnv() (*S3Store, error) {
+	endpoint := shared.GetEnv("S3_ENDPOINT", "")
+	bucket := shared.GetEnv("S3_BUCKET", "")
+	if endpoint == "" || bucket == "" {
+		return nil, errors.New("S3_ENDPOINT and S3_BUCKET must be set for the s3 storage backend")
+	}
+	return NewS3Store(
+		endpoint,
+		bucket,
+		shared.GetEnv("S3_ACCESS_KEY", ""),
+		shared.GetEnv("S3_SECRET_KEY", ""),
+		shared.GetEnv("S3_REGION", "us-east-1"),
+	), nil
+}
+
+func (s *S3Store) url(key string) string {
+	return fmt.Sprintf("%s/%s/%s", s.endpoint, s.bucket, uriEncode(key, false))
+}
+
+func (s *S3Store) do(method, key string, body io.Reader, size int64, payloadHash string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.url(key), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.creds.Sign(req, payloadHash)
+	return s.client.Do(req)
+}
+
+func s3Error(resp *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3: %s: %s", resp.Status, strings.TrimSpace(string(b)))
+}
+
+// Stage spools r to a local temp file: S3 needs the length and hash of the
+// body up front, and the object only appears once the PUT in Commit succeeds.
+// Objects are written with a single PUT, so they are limited to 5 GiB.
+func (s *S3Store) Stage(r io.Reader) (StagedBlob, error) {
+	tmp, err := os.CreateTemp("", "avenue-s3-*")
+	if err != nil {
+		return nil, err
+	}
+	b := &s3Staged{store: s, tmp: tmp}
+
+	h := sha256.New()
+	b.size, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		_ = b.Discard()
+		return nil, err
+	}
+	b.hash = hex.EncodeToString(h.Sum(nil))
+	return b, nil
+}
+
+func (s *S3Store) Open(hash string) (io.ReadSeekCloser, error) {
+	return s.open(blobKey(hash))
+}
+
+func (s *S3Store) Remove(hash string) error {
+	return s.remove(blobKey(hash))
+}
+
+func (s *S3Store) OpenLegacy(ownerId int, fileId string) (io.ReadSeekCloser, error) {
+	return s.open(legacyKey(ownerId, fileId))
+}
+
+func (s *S3Store) RemoveLegacy(ownerId int, fileId string) error {
+	return s.remove(legacyKey(ownerId, fileId))
+}
+
+// head returns the size of the object at key, or os.ErrNotExist.
+func (s *S3Store) head(key string) (int64, error) {
+	resp, err := s.do(http.MethodHead, key, nil, 0, emptySha256, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, os.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("s3: %s", resp.Status)
+	}
+	return resp.ContentLength, nil
+}
+
+func (s *S3Store) open(key string) (io.ReadSeekCloser, error) {
+	size, err := s.head(key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Object{store: s, key: key, size: size}, nil
+}
+
+func (s *S3Store) remove(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, 0, emptySha256, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+type s3Staged struct {
+	store *S3Store
+	tmp   *os.File
+	hash  string
+	size  int64
+}
+
+func (b *s3Staged) Hash() string { return b.hash }
+func (b *s3Staged) Size() int64  { return b.size }
+
+func (b *s3Staged) Commit() error {
+	defer b.Discard()
+
+	key := blobKey(b.hash)
+	if _, err := b.store.head(key); err == nil {
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if _, err := b.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	resp, err := b.store.do(http.MethodPut, key, b.tmp, b.size, b.hash, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (b *s3Staged) Discard() error {
+	b.tmp.Close()
+	err := os.Remove(b.tmp.Name())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// s3Object reads an object lazily with ranged GETs, so seeking (for Range
+// requests) doesn't download the skipped part.
+type s3Object struct {
+	store  *S3Store
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		h := http.Header{}
+		h.Set("Range", "bytes="+strconv.FormatInt(o.offset, 10)+"-")
+		resp, err := o.store.do(http.MethodGet, o.key, nil, 0, emptySha256, h)
+		if err != nil {
+			return 0, err
+		}
+		// a server ignoring the Range answers with the whole object, which is
+		// only what was asked for when reading from the start
+		if resp.StatusCode != http.StatusPartialContent && (resp.StatusCode != http.StatusOK || o.offset > 0) {
+			defer resp.Body.Close()
+			return 0, s3Error(resp)
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = o.offset + offset
+	case io.SeekEnd:
+		abs = o.size + offset
+	default:
+		return 0, errors.New("s3: invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("s3: negative position")
+	}
+	if abs != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = abs
+	return abs, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body != nil {
+		return o.body.Close()
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is just enough of an S3 server for S3Store: objects in a map, every
+// request checked against the SigV4 signature it carries.
+type fakeS3 struct {
+	t      *testing.T
+	bucket string
+	secret string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	puts    int
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *S3Store) {
+	t.Helper()
+	f := &fakeS3{t: t, bucket: "avenue", secret: "s3cret", objects: map[string][]byte{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	// staged bodies are spooled to the temp dir, keep them where they can
+	// be checked
+	t.Setenv("TMPDIR", t.TempDir())
+	return f, NewS3Store(srv.URL+"/", f.bucket, "AKIDTEST", f.secret, "us-east-1")
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sr, err := ParseSignedRequest(r)
+	if err == nil {
+		err = sr.Verify(r, f.secret, time.Now())
+	}
+	if err != nil {
+		f.t.Errorf("%s %s: %v", r.Method, r.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+f.bucket+"/")
+	if !ok {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		body, err := sr.Body(r.Body, f.secret)
+		if err == nil {
+			var b []byte
+			if b, err = io.ReadAll(body); err == nil {
+				f.objects[key] = b
+				f.puts++
+			}
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	case http.MethodHead, http.MethodGet:
+		b, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		if rng, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok {
+			start, _ := strconv.Atoi(strings.TrimSuffix(rng, "-"))
+			w.Header().Set("Content-Range", "bytes "+strconv.Itoa(start)+"-"+strconv.Itoa(len(b)-1)+"/"+strconv.Itoa(len(b)))
+			w.Header().Set("Content-Length", strconv.Itoa(len(b)-start))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(b[start:])
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		w.Write(b)
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func tempFiles(t *testing.T) []os.DirEntry {
+	t.Helper()
+	entries, err := os.ReadDir(os.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestS3StageCommit(t *testing.T) {
+	f, s := newFakeS3(t)
+	content := "hello, blob store"
+	sum := sha256.Sum256([]byte(content))
+	hash := hex.EncodeToString(sum[:])
+
+	b, err := s.Stage(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Stage: %v", err)
+	}
+	if b.Hash() != hash || b.Size() != int64(len(content)) {
+		t.Errorf("staged %s, %d bytes", b.Hash(), b.Size())
+	}
+	if len(f.objects) != 0 {
+		t.Error("staging stored an object")
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if got := string(f.objects[blobKey(hash)]); got != content {
+		t.Errorf("stored %q at %s", got, blobKey(hash))
+	}
+	if n := len(tempFiles(t)); n != 0 {
+		t.Errorf("%d temp files left after Commit", n)
+	}
+
+	// the same content again is already there
+	b, err = s.Stage(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Stage: %v", err)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if f.puts != 1 {
+		t.Errorf("%d PUTs for the same content twice, want 1", f.puts)
+	}
+}
+
+func TestS3StageDiscard(t *testing.T) {
+	f, s := newFakeS3(t)
+	b, err := s.Stage(strings.NewReader("never mind"))
+	if err != nil {
+		t.Fatalf("Stage: %v", err)
+	}
+	if err := b.Discard(); err != nil {
+		t.Fatalf("Discard: %v", err)
+	}
+	if len(f.objects) != 0 {
+		t.Error("discarded content was stored")
+	}
+	if n := len(tempFiles(t)); n != 0 {
+		t.Errorf("%d temp files left after Discard", n)
+	}
+}
+
+func TestS3StageReadError(t *testing.T) {
+	_, s := newFakeS3(t)
+	boom := errors.New("connection reset")
+	_, err := s.Stage(io.MultiReader(strings.NewReader("partial"), errReader{boom}))
+	if !errors.Is(err, boom) {
+		t.Fatalf("Stage = %v, want %v", err, boom)
+	}
+	if n := len(tempFiles(t)); n != 0 {
+		t.Errorf("%d temp files left after a failed Stage", n)
+	}
+}
+
+func TestS3Open(t *testing.T) {
+	f, s := newFakeS3(t)
+	content := "0123456789abcdef"
+	f.objects[blobKey("feedface")] = []byte(content)
+
+	o, err := s.Open("feedface")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer o.Close()
+	if end, err := o.Seek(0, io.SeekEnd); err != nil || end != int64(len(content)) {
+		t.Fatalf("Seek to end = %d, %v", end, err)
+	}
+	if _, err := o.Seek(10, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(o)
+	if err != nil || string(b) != content[10:] {
+		t.Fatalf("read from 10 = %q, %v", b, err)
+	}
+	if _, err := o.Seek(-16, io.SeekCurrent); err != nil {
+		t.Fatal(err)
+	}
+	b, err = io.ReadAll(io.LimitReader(o, 4))
+	if err != nil || string(b) != content[:4] {
+		t.Fatalf("read from 0 = %q, %v", b, err)
+	}
+	if _, err := o.Seek(-1, io.SeekStart); err == nil {
+		t.Error("seeking before the start worked")
+	}
+
+	if _, err := s.Open("missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Open of a missing blob = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestS3Remove(t *testing.T) {
+	f, s := newFakeS3(t)
+	f.objects[blobKey("feedface")] = []byte("gone soon")
+	f.objects[legacyKey(7, "f1")] = []byte("old layout")
+
+	if err := s.Remove("feedface"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if err := s.RemoveLegacy(7, "f1"); err != nil {
+		t.Fatalf("RemoveLegacy: %v", err)
+	}
+	if len(f.objects) != 0 {
+		t.Errorf("objects left: %v", f.objects)
+	}
+	// removing twice is fine
+	if err := s.Remove("feedface"); err != nil {
+		t.Errorf("Remove of a missing blob: %v", err)
+	}
+}
+
+func TestS3Errors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+	}))
+	defer srv.Close()
+	s := NewS3Store(srv.URL, "avenue", "AKIDTEST", "s3cret", "us-east-1")
+
+	if err := s.Remove("feedface"); err == nil || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Errorf("Remove = %v", err)
+	}
+	if _, err := s.Open("feedface"); err == nil || errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Open = %v", err)
+	}
+}
+
+func TestS3OpenIgnoredRange(t *testing.T) {
+	content := "0123456789abcdef"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if r.Method == http.MethodGet {
+			w.Write([]byte(content))
+		}
+	}))
+	defer srv.Close()
+	s := NewS3Store(srv.URL, "avenue", "AKIDTEST", "s3cret", "us-east-1")
+
+	o, err := s.Open("feedface")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer o.Close()
+	if b, err := io.ReadAll(o); err != nil || string(b) != content {
+		t.Fatalf("read from the start = %q, %v", b, err)
+	}
+	if _, err := o.Seek(10, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	// the whole object again must not pass for the part from 10 on
+	if b, err := io.ReadAll(o); err == nil {
+		t.Errorf("read from 10 of a server ignoring Range = %q", b)
+	}
+}
+
+type errReader struct{ err error }
+
+func (e errReader) Read([]byte) (int, error) { return 0, e.err }
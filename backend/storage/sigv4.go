@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4, just enough of it to talk to S3:
+// https://docs.aws.amazon.com/IAM/latest/UserGuide/reference_sigv-create-signed-request.html
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat = "20060102T150405Z"
+	sigV4DateFormat = "20060102"
+	// UnsignedPayload may be used as the payload hash when the body isn't signed.
+	UnsignedPayload = "UNSIGNED-PAYLOAD"
+	emptySha256     = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// Credentials identify the signer of a request.
+type Credentials struct {
+	AccessKey string
+	SecretKey string
+	Region    string
+	Service   string
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	h := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(h[:])
+}
+
+// uriEncode percent-encodes s the way SigV4 expects, leaving only the
+// unreserved characters (and '/' when encodeSlash is false) as is.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// canonicalRequest builds the canonical form of r with query over
+// signedHeaders, which must be lower case and sorted.
+func canonicalRequest(r *http.Request, query url.Values, signedHeaders []string, payloadHash string) string {
+	var headers strings.Builder
+	for _, h := range signedHeaders {
+		var v string
+		if h == "host" {
+			v = r.Host
+			if v == "" {
+				v = r.URL.Host
+			}
+		} else {
+			v = strings.Join(r.Header.Values(h), ",")
+		}
+		headers.WriteString(h + ":" + strings.Join(strings.Fields(v), " ") + "\n")
+	}
+
+	path := r.URL.EscapedPath()
+	if p, err := url.PathUnescape(path); err == nil {
+		path = uriEncode(p, false)
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		path,
+		canonicalQuery(query),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+func (c Credentials) scope(t time.Time) string {
+	return fmt.Sprintf("%s/%s/%s/aws4_request", t.Format(sigV4DateFormat), c.Region, c.Service)
+}
+
+func (c Credentials) signingKey(t time.Time) []byte {
+	k := hmacSha256([]byte("AWS4"+c.SecretKey), t.Format(sigV4DateFormat))
+	k = hmacSha256(k, c.Region)
+	k = hmacSha256(k, c.Service)
+	return hmacSha256(k, "aws4_request")
+}
+
+// Signature computes the SigV4 signature of r at time t.
+func (c Credentials) Signature(r *http.Request, t time.Time, signedHeaders []string, payloadHash string) string {
+	return c.signature(r, r.URL.Query(), t, signedHeaders, payloadHash)
+}
+
+func (c Credentials) signature(r *http.Request, query url.Values, t time.Time, signedHeaders []string, payloadHash string) string {
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		t.Format(sigV4TimeFormat),
+		c.scope(t),
+		sha256Hex(canonicalRequest(r, query, signedHeaders, payloadHash)),
+	}, "\n")
+	return hex.EncodeToString(hmacSha256(c.signingKey(t), stringToSign))
+}
+
+// Sign adds the SigV4 headers to r. payloadHash is the hex sha256 of the body
+// or UnsignedPayload.
+func (c Credentials) Sign(r *http.Request, payloadHash string) {
+	t := time.Now().UTC()
+	r.Header.Set("X-Amz-Date", t.Format(sigV4TimeFormat))
+	r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	sig := c.Signature(r, t, signed, payloadHash)
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, c.AccessKey, c.scope(t), strings.Join(signed, ";"), sig))
+}
@@ -0,0 +1,356 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Checking SigV4 signatures made by S3 clients, the other side of Sign.
+
+const (
+	// StreamingPayload is the payload hash of bodies sent in signed
+	// aws-chunked encoding.
+	StreamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	// StreamingUnsignedPayload is the payload hash of bodies sent in
+	// unsigned aws-chunked encoding, with checksums in trailers.
+	StreamingUnsignedPayload = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+
+	// maxClockSkew is how far the time of a signature may be off.
+	maxClockSkew = 15 * time.Minute
+	// maxPresignExpiry is the longest a presigned URL may be valid for.
+	maxPresignExpiry = 7 * 24 * time.Hour
+)
+
+var (
+	// ErrNotSigned is returned for requests without a SigV4 signature.
+	ErrNotSigned = errors.New("sigv4: request is not signed")
+	// ErrMalformedSignature is returned for signatures that can't be parsed.
+	ErrMalformedSignature = errors.New("sigv4: malformed signature")
+	// ErrSignatureMismatch is returned when a signature, of the request or
+	// of a chunk of its body, is wrong.
+	ErrSignatureMismatch = errors.New("sigv4: signature does not match")
+	// ErrSignatureExpired is returned when a signature is too old or too
+	// far in the future.
+	ErrSignatureExpired = errors.New("sigv4: signature expired")
+	// ErrPayloadMismatch is returned when the body doesn't hash to the
+	// signed payload hash.
+	ErrPayloadMismatch = errors.New("sigv4: payload does not match its hash")
+)
+
+// SignedRequest is the SigV4 signature a request carries, in its
+// Authorization header or, for presigned URLs, in its query.
+type SignedRequest struct {
+	AccessKey     string
+	Time          time.Time
+	Region        string
+	Service       string
+	SignedHeaders []string
+	Signature     string
+	// PayloadHash is the hex sha256 of the body, UnsignedPayload or one of
+	// the streaming payloads.
+	PayloadHash string
+	// Expires is how long a presigned URL is valid for, 0 otherwise.
+	Expires time.Duration
+}
+
+// ParseSignedRequest reads the signature of r without checking it.
+func ParseSignedRequest(r *http.Request) (*SignedRequest, error) {
+	q := r.URL.Query()
+	if q.Get("X-Amz-Algorithm") != "" {
+		return parsePresigned(r)
+	}
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return nil, ErrNotSigned
+	}
+	rest, ok := strings.CutPrefix(auth, sigV4Algorithm+" ")
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported algorithm", ErrMalformedSignature)
+	}
+
+	fields := map[string]string{}
+	for _, f := range strings.Split(rest, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(f), "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrMalformedSignature, f)
+		}
+		fields[k] = v
+	}
+	sr := &SignedRequest{
+		Signature:   fields["Signature"],
+		PayloadHash: r.Header.Get("X-Amz-Content-Sha256"),
+	}
+	if sr.PayloadHash == "" {
+		return nil, fmt.Errorf("%w: missing X-Amz-Content-Sha256", ErrMalformedSignature)
+	}
+	date := r.Header.Get("X-Amz-Date")
+	if date == "" {
+		date = r.Header.Get("Date")
+	}
+	if err := sr.parse(fields["Credential"], fields["SignedHeaders"], date); err != nil {
+		return nil, err
+	}
+	return sr, nil
+}
+
+func parsePresigned(r *http.Request) (*SignedRequest, error) {
+	q := r.URL.Query()
+	if q.Get("X-Amz-Algorithm") != sigV4Algorithm {
+		return nil, fmt.Errorf("%w: unsupported algorithm", ErrMalformedSignature)
+	}
+	secs, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+	if err != nil || secs <= 0 || time.Duration(secs)*time.Second > maxPresignExpiry {
+		return nil, fmt.Errorf("%w: invalid X-Amz-Expires", ErrMalformedSignature)
+	}
+	sr := &SignedRequest{
+		Signature:   q.Get("X-Amz-Signature"),
+		PayloadHash: UnsignedPayload,
+		Expires:     time.Duration(secs) * time.Second,
+	}
+	if h := q.Get("X-Amz-Content-Sha256"); h != "" {
+		sr.PayloadHash = h
+	}
+	if err := sr.parse(q.Get("X-Amz-Credential"), q.Get("X-Amz-SignedHeaders"), q.Get("X-Amz-Date")); err != nil {
+		return nil, err
+	}
+	return sr, nil
+}
+
+// parse fills in sr from a credential of the form
+// <access key>/<date>/<region>/<service>/aws4_request, the signed header list
+// and the time of signing.
+func (sr *SignedRequest) parse(credential, signedHeaders, date string) error {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" || parts[0] == "" {
+		return fmt.Errorf("%w: invalid credential", ErrMalformedSignature)
+	}
+	t, err := time.Parse(sigV4TimeFormat, date)
+	if err != nil {
+		return fmt.Errorf("%w: invalid date", ErrMalformedSignature)
+	}
+	if t.Format(sigV4DateFormat) != parts[1] {
+		return fmt.Errorf("%w: credential date doesn't match", ErrMalformedSignature)
+	}
+	if signedHeaders == "" || sr.Signature == "" {
+		return fmt.Errorf("%w: missing signature", ErrMalformedSignature)
+	}
+	sr.AccessKey, sr.Region, sr.Service = parts[0], parts[2], parts[3]
+	sr.SignedHeaders = strings.Split(signedHeaders, ";")
+	sr.Time = t
+	if !slices.IsSorted(sr.SignedHeaders) || !slices.Contains(sr.SignedHeaders, "host") {
+		return fmt.Errorf("%w: invalid signed headers", ErrMalformedSignature)
+	}
+	return nil
+}
+
+// Verify checks sr is a signature of r made with secretKey, and is still
+// valid at now. The body is checked as it is read, see Body.
+func (sr *SignedRequest) Verify(r *http.Request, secretKey string, now time.Time) error {
+	if sr.Expires > 0 {
+		if now.Before(sr.Time.Add(-maxClockSkew)) || now.After(sr.Time.Add(sr.Expires)) {
+			return ErrSignatureExpired
+		}
+	} else if d := now.Sub(sr.Time); d > maxClockSkew || d < -maxClockSkew {
+		return ErrSignatureExpired
+	}
+
+	query := r.URL.Query()
+	query.Del("X-Amz-Signature")
+	want := sr.credentials(secretKey).signature(r, query, sr.Time, sr.SignedHeaders, sr.PayloadHash)
+	if !hmac.Equal([]byte(want), []byte(sr.Signature)) {
+		return ErrSignatureMismatch
+	}
+	return nil
+}
+
+func (sr *SignedRequest) credentials(secretKey string) Credentials {
+	return Credentials{AccessKey: sr.AccessKey, SecretKey: secretKey, Region: sr.Region, Service: sr.Service}
+}
+
+// Body returns the content of the verified request body, decoding
+// aws-chunked encoding. Reading it fails with ErrPayloadMismatch or
+// ErrSignatureMismatch if the body isn't what was signed.
+func (sr *SignedRequest) Body(body io.Reader, secretKey string) (io.Reader, error) {
+	switch sr.PayloadHash {
+	case UnsignedPayload:
+		return body, nil
+	case StreamingPayload:
+		c := sr.credentials(secretKey)
+		return &chunkedReader{
+			r:       bufio.NewReader(body),
+			signed:  true,
+			key:     c.signingKey(sr.Time),
+			prefix:  "AWS4-HMAC-SHA256-PAYLOAD\n" + sr.Time.Format(sigV4TimeFormat) + "\n" + c.scope(sr.Time) + "\n",
+			prevSig: sr.Signature,
+			h:       sha256.New(),
+		}, nil
+	case StreamingUnsignedPayload:
+		return &chunkedReader{r: bufio.NewReader(body)}, nil
+	}
+	if len(sr.PayloadHash) != sha256.Size*2 {
+		return nil, fmt.Errorf("%w: unsupported payload hash %q", ErrMalformedSignature, sr.PayloadHash)
+	}
+	return &hashingReader{r: body, h: sha256.New(), want: sr.PayloadHash}, nil
+}
+
+// hashingReader fails at the end of r if it didn't hash to want.
+type hashingReader struct {
+	r    io.Reader
+	h    hash.Hash
+	want string
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.h.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(h.h.Sum(nil)) != h.want {
+		return n, ErrPayloadMismatch
+	}
+	return n, err
+}
+
+// chunkedReader decodes aws-chunked encoding, where each chunk is
+//
+//	<hex size>[;chunk-signature=<signature>]\r\n<data>\r\n
+//
+// ending with an empty chunk and, for unsigned payloads, trailers. Signed
+// chunks are each checked against the signature of the one before.
+type chunkedReader struct {
+	r *bufio.Reader
+	// remaining is what is left of the current chunk
+	remaining int64
+	inChunk   bool
+	done      bool
+	err       error
+
+	signed  bool
+	key     []byte
+	prefix  string
+	prevSig string
+	sig     string
+	h       hash.Hash
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for c.err == nil && !c.done && c.remaining == 0 {
+		c.err = c.nextChunk()
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.done {
+		return 0, io.EOF
+	}
+
+	n, err := c.r.Read(p[:min(int64(len(p)), c.remaining)])
+	c.remaining -= int64(n)
+	if c.signed {
+		c.h.Write(p[:n])
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	c.err = err
+	return n, err
+}
+
+// nextChunk finishes the current chunk and reads the header of the next.
+func (c *chunkedReader) nextChunk() error {
+	if c.inChunk {
+		if err := c.expectCRLF(); err != nil {
+			return err
+		}
+		if err := c.checkChunk(); err != nil {
+			return err
+		}
+	}
+
+	line, err := c.line()
+	if err != nil {
+		return err
+	}
+	size, ext, _ := strings.Cut(line, ";")
+	n, err := strconv.ParseInt(size, 16, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("%w: invalid chunk size %q", ErrMalformedSignature, size)
+	}
+	if c.signed {
+		sig, ok := strings.CutPrefix(ext, "chunk-signature=")
+		if !ok {
+			return fmt.Errorf("%w: missing chunk signature", ErrMalformedSignature)
+		}
+		c.sig = sig
+		c.h.Reset()
+	}
+	c.remaining, c.inChunk = n, true
+	if n > 0 {
+		return nil
+	}
+
+	// the last chunk is empty, and followed by trailers and a blank line
+	if c.signed {
+		if err := c.checkChunk(); err != nil {
+			return err
+		}
+	}
+	for {
+		line, err := c.line()
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			break
+		}
+	}
+	c.done = true
+	return nil
+}
+
+func (c *chunkedReader) checkChunk() error {
+	if !c.signed {
+		return nil
+	}
+	stringToSign := c.prefix + c.prevSig + "\n" + emptySha256 + "\n" + hex.EncodeToString(c.h.Sum(nil))
+	want := hex.EncodeToString(hmacSha256(c.key, stringToSign))
+	if !hmac.Equal([]byte(want), []byte(c.sig)) {
+		return ErrSignatureMismatch
+	}
+	c.prevSig = c.sig
+	return nil
+}
+
+// line reads a line of at most the reader's buffer size.
+func (c *chunkedReader) line() (string, error) {
+	line, err := c.r.ReadSlice('\n')
+	switch {
+	case err == io.EOF:
+		return "", io.ErrUnexpectedEOF
+	case errors.Is(err, bufio.ErrBufferFull):
+		return "", fmt.Errorf("%w: chunk header too long", ErrMalformedSignature)
+	case err != nil:
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func (c *chunkedReader) expectCRLF() error {
+	line, err := c.line()
+	if err != nil {
+		return err
+	}
+	if line != "" {
+		return fmt.Errorf("%w: chunk not terminated", ErrMalformedSignature)
+	}
+	return nil
+}
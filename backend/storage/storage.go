@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"avenue/backend/shared"
+
+	"github.com/spf13/afero"
+)
+
+// BlobStore holds the content of files, addressed by the hex sha256 of the
+// content so identical uploads are only stored once. Callers never build
+// storage paths themselves.
+type BlobStore interface {
+	// Stage reads r into temporary storage while hashing it. Nothing is
+	// visible under the hash until the returned blob is committed.
+	Stage(r io.Reader) (StagedBlob, error)
+	// Open returns the content stored under hash for reading.
+	Open(hash string) (io.ReadSeekCloser, error)
+	// Remove deletes the content stored under hash. Removing content that
+	// does not exist is not an error.
+	Remove(hash string) error
+}
+
+// StagedBlob is content that has been received but not stored yet.
+type StagedBlob interface {
+	Hash() string
+	Size() int64
+	// Commit stores the content under its hash. If the same content is
+	// already stored the staged copy is simply dropped.
+	Commit() error
+	// Discard drops the staged content. It is safe to call after Commit.
+	Discard() error
+}
+
+// LegacyStore is implemented by stores that may still hold content written
+// before blobs were content addressed, at <ownerId>/<fileId>.
+type LegacyStore interface {
+	OpenLegacy(ownerId int, fileId string) (io.ReadSeekCloser, error)
+	RemoveLegacy(ownerId int, fileId string) error
+}
+
+// blobKey is the one place that decides where content lives. The first two
+// bytes of the hash fan blobs out over directories.
+func blobKey(hash string) string {
+	if len(hash) < 4 {
+		return "blobs/" + hash
+	}
+	return fmt.Sprintf("blobs/%s/%s/%s", hash[:2], hash[2:4], hash)
+}
+
+func legacyKey(ownerId int, fileId string) string {
+	return fmt.Sprintf("%d/%s", ownerId, fileId)
+}
+
+// NewFromEnv builds the BlobStore selected by STORAGE_BACKEND:
+//
+//	local  files under STORAGE_ROOT on the local disk (default)
+//	memory files held in memory, lost on restart
+//	s3     an S3 compatible object store, see NewS3StoreFromEnv
+func NewFromEnv() (BlobStore, error) {
+	switch backend := strings.ToLower(shared.GetEnv("STORAGE_BACKEND", "local")); backend {
+	case "local":
+		return NewLocalStore(shared.GetEnv("STORAGE_ROOT", "./avenuectl/temp/")), nil
+	case "memory":
+		return NewMemoryStore(), nil
+	case "s3":
+		return NewS3StoreFromEnv()
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+// NewLocalStore stores content on the local disk below root.
+func NewLocalStore(root string) *AferoStore {
+	return NewAferoStore(afero.NewBasePathFs(afero.NewOsFs(), root))
+}
+
+// NewMemoryStore stores content in memory, for tests.
+func NewMemoryStore() *AferoStore {
+	return NewAferoStore(afero.NewMemMapFs())
+}
@@ -0,0 +1,89 @@
+package thumbnail
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+var textFiles = map[string]bool{
+	"txt":      true,
+	"text":     true,
+	"md":       true,
+	"markdown": true,
+	"log":      true,
+	"csv":      true,
+	"json":     true,
+	"yaml":     true,
+	"yml":      true,
+	"toml":     true,
+	"xml":      true,
+	"html":     true,
+	"css":      true,
+	"js":       true,
+	"ts":       true,
+	"go":       true,
+	"py":       true,
+	"rb":       true,
+	"rs":       true,
+	"c":        true,
+	"h":        true,
+	"cpp":      true,
+	"hpp":      true,
+	"java":     true,
+	"kt":       true,
+	"sh":       true,
+	"sql":      true,
+}
+
+// The page text is rendered on, in characters of basicfont.Face7x13.
+const (
+	pageColumns = 64
+	pageLines   = 48
+	pageMargin  = 16
+	tabWidth    = 4
+)
+
+// renderText draws the first page of the text in r. Characters the font
+// doesn't have are left blank.
+func renderText(r io.Reader) (image.Image, error) {
+	// a page is never more than this, even with every line full
+	b, err := io.ReadAll(io.LimitReader(r, pageColumns*pageLines*utf8.UTFMax))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.IndexByte(b, 0) >= 0 {
+		return nil, fmt.Errorf("%w: content is binary", ErrUnsupported)
+	}
+
+	face := basicfont.Face7x13
+	w := pageColumns*face.Advance + 2*pageMargin
+	h := pageLines*face.Height + 2*pageMargin
+	page := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(page, page.Bounds(), image.White, image.Point{}, draw.Src)
+
+	d := font.Drawer{
+		Dst:  page,
+		Src:  image.NewUniform(color.Gray{Y: 0x30}),
+		Face: face,
+	}
+	lines := strings.Split(strings.ToValidUTF8(string(b), ""), "\n")
+	for i, line := range lines[:min(len(lines), pageLines)] {
+		line = strings.TrimRight(strings.ReplaceAll(line, "\t", strings.Repeat(" ", tabWidth)), "\r")
+		if utf8.RuneCountInString(line) > pageColumns {
+			line = string([]rune(line)[:pageColumns])
+		}
+		d.Dot = fixed.P(pageMargin, pageMargin+i*face.Height+face.Ascent)
+		d.DrawString(line)
+	}
+	return page, nil
+}
@@ -0,0 +1,143 @@
+// Package thumbnail renders small previews of images and text files.
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"slices"
+	"strings"
+
+	// decoders for the image formats previews are made of
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// ErrUnsupported is returned for content Generate can't preview, trying again
+// won't help.
+var ErrUnsupported = errors.New("thumbnail: unsupported file type")
+
+// maxPixels is the largest image that is decoded, bigger ones would take too
+// much memory.
+const maxPixels = 64 << 20
+
+var images = map[string]bool{
+	"png":  true,
+	"jpg":  true,
+	"jpeg": true,
+	"gif":  true,
+	"webp": true,
+}
+
+// Image is a rendered preview.
+type Image struct {
+	// Size is the most pixels along either side.
+	Size        int
+	ContentType string
+	Data        []byte
+}
+
+// Supported reports whether Generate can preview files with extension ext.
+func Supported(ext string) bool {
+	ext = strings.ToLower(ext)
+	return images[ext] || textFiles[ext]
+}
+
+// Generate renders previews of the content with extension ext in r, one for
+// each of sizes. Images are scaled to fit, but never up. Text files show
+// their first page.
+func Generate(ext string, r io.ReadSeeker, sizes []int) ([]Image, error) {
+	ext = strings.ToLower(ext)
+	var (
+		src image.Image
+		err error
+	)
+	switch {
+	case images[ext]:
+		src, err = decodeImage(r)
+	case textFiles[ext]:
+		src, err = renderText(r)
+	default:
+		return nil, ErrUnsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// scaling the largest first and each smaller one from the last is much
+	// cheaper than scaling the original every time
+	sizes = slices.Clone(sizes)
+	slices.SortFunc(sizes, func(a, b int) int { return b - a })
+	out := make([]Image, 0, len(sizes))
+	for _, size := range sizes {
+		src = scale(src, size)
+		img, err := encode(src)
+		if err != nil {
+			return nil, err
+		}
+		img.Size = size
+		out = append(out, img)
+	}
+	return out, nil
+}
+
+func decodeImage(r io.ReadSeeker) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(r)
+	if errors.Is(err, image.ErrFormat) {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxPixels {
+		return nil, fmt.Errorf("%w: image is %dx%d", ErrUnsupported, cfg.Width, cfg.Height)
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(r)
+	return img, err
+}
+
+// scale returns src fitted into a size by size square.
+func scale(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+	if w >= h {
+		w, h = size, max(1, h*size/w)
+	} else {
+		w, h = max(1, w*size/h), size
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+	return dst
+}
+
+// encode writes img as a JPEG, or as a PNG if it has transparency.
+func encode(img image.Image) (Image, error) {
+	var buf bytes.Buffer
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80}); err != nil {
+			return Image{}, err
+		}
+		return Image{ContentType: "image/jpeg", Data: buf.Bytes()}, nil
+	}
+	if err := png.Encode(&buf, img); err != nil {
+		return Image{}, err
+	}
+	return Image{ContentType: "image/png", Data: buf.Bytes()}, nil
+}